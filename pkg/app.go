@@ -2,6 +2,7 @@ package hls_downloader
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -10,7 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
 	"time"
 
@@ -24,6 +25,36 @@ type Config struct {
 	OutputDir               string
 	SegmentDownloadTimeout  time.Duration
 	PlaylistDownloadTimeout time.Duration
+	Monitor                 *MonitorConfig
+	Merge                   *MergeOptions
+	Remux                   *RemuxOptions
+	// Retention keeps only the last segments in the output directory. nil keeps all segments.
+	Retention *RetentionOptions
+	// AnalyzeTS checks the integrity of each downloaded MPEG-TS segment and reports it in report.jsonl.
+	AnalyzeTS bool
+	// VerifyDuration compares the actual duration of each downloaded segment with EXTINF and reports it in report.jsonl.
+	VerifyDuration bool
+	// ExtractMetadata extracts ID3 timed metadata of each downloaded MPEG-TS segment into metadata.jsonl.
+	ExtractMetadata bool
+	// Auth adds the credentials to the playlist and segment requests. nil sends Token as a bearer token.
+	Auth Authenticator
+	// Header is added to the playlist and segment requests. i.g. Referer
+	Header http.Header
+	// UserAgent is the User-Agent of the requests. "" is the default of net/http.
+	UserAgent string
+	// CookieFile is a Netscape cookies file which is loaded into the cookie jar of the requests.
+	CookieFile string
+	// Throttle limits the bandwidth and the playlist reloads. nil is unlimited.
+	Throttle *ThrottleOptions
+	// HTTP configures the transport of the playlist and segment requests. nil is the same as http.DefaultTransport.
+	HTTP *HTTPOptions
+	// Storage stores the recorded files. nil stores them in OutputDir.
+	Storage Storage
+	// SegmentNaming is the template of the names of the segments, keys and init sections. i.g. {variant}/{msn:08d}_{basename}
+	// "" is DefaultSegmentNaming. see segmentNamer
+	SegmentNaming string
+	// Resume continues the interrupted recording in the storage by journal.jsonl.
+	Resume bool
 }
 
 type App struct {
@@ -37,30 +68,98 @@ func NewApp(config *Config, logger *zap.Logger) (*App, error) {
 
 type client struct {
 	httpClient *http.Client
-	token      string
+	// auth adds the credentials to each request. nil sends no credentials.
+	auth Authenticator
+	// header is added to each request.
+	header http.Header
+	// bandwidth limits the reading of each response body.
+	bandwidth []*RateLimiter
 }
 
-func (cli *client) get(uri string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", uri, nil)
-	if err != nil {
-		return nil, xerrors.Errorf("http.NewRequest failed : %w", err)
+// newClient returns the client of the config. The clients of a recording share tr and jar.
+func (config *Config) newClient(tr http.RoundTripper, jar http.CookieJar, timeout time.Duration) *client {
+	cli := &client{
+		httpClient: &http.Client{
+			Transport: tr,
+			Jar:       jar,
+			Timeout:   timeout,
+		},
+		auth:   config.Auth,
+		header: config.Header.Clone(),
 	}
-	req.Header.Add("authorization", fmt.Sprintf("bearer %v", cli.token))
-
-	resp, err := cli.httpClient.Do(req)
-	if err != nil {
-		return resp, xerrors.Errorf("httpClient.Do failed : %w", err)
+	if cli.auth == nil {
+		cli.auth = tokenAuth(config.Token)
 	}
-	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		return resp, xerrors.Errorf("status code %v", resp.Status)
+	if config.UserAgent != "" {
+		if cli.header == nil {
+			cli.header = http.Header{}
+		}
+		cli.header.Set("User-Agent", config.UserAgent)
+	}
+	return cli
+}
+
+func (cli *client) get(uri string) (*http.Response, error) {
+	resp, _, err := cli.fetch(uri)
+	return resp, err
+}
+
+// maxAuthRetries is the number of the retries after the credentials are refreshed.
+const maxAuthRetries = 1
+
+// fetch gets the URI and returns the number of the retries.
+// If the server rejects the credentials by 401 or 403, they are refreshed by Refresher and the request is retried.
+func (cli *client) fetch(uri string) (*http.Response, int, error) {
+	for retries := 0; ; retries++ {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			return nil, retries, xerrors.Errorf("http.NewRequest failed : %w", err)
+		}
+		for k, v := range cli.header {
+			req.Header[k] = append([]string(nil), v...)
+		}
+		if cli.auth != nil {
+			if err := cli.auth.Authenticate(req); err != nil {
+				return nil, retries, xerrors.Errorf("Authenticate failed: %w", err)
+			}
+		}
+
+		resp, err := cli.httpClient.Do(req)
+		if err != nil {
+			return resp, retries, xerrors.Errorf("httpClient.Do failed : %w", err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			if refresher, ok := cli.auth.(Refresher); ok && retries < maxAuthRetries {
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+				if err := refresher.Refresh(req); err != nil {
+					return nil, retries, xerrors.Errorf("status code %v, Refresh failed : %w", resp.Status, err)
+				}
+				continue
+			}
+		}
+		if len(cli.bandwidth) > 0 {
+			resp.Body = &throttledReader{r: resp.Body, limiters: cli.bandwidth}
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return resp, retries, xerrors.Errorf("status code %v", resp.Status)
+		}
+		return resp, retries, nil
 	}
-	return resp, nil
 }
 
 type segment struct {
-	duration float64
-	uri      string
-	no       int
+	duration        float64
+	uri             string
+	no              int
+	title           string
+	discontinuity   bool
+	gap             bool
+	programDateTime time.Time
+	key             *segmentKey
+	initSection     *initSection
+	// local is the copy whose URIs are the names in the storage. see localize
+	local *segment
 }
 
 type downloadResult struct {
@@ -68,36 +167,59 @@ type downloadResult struct {
 	err error
 }
 
+// i.g. http://example.com/live/1.ts?token=abc -> 1.ts, http://example.com/ -> ""
 func uri2basename(uri string) (string, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return "", xerrors.Errorf("url.Parse failed: %w", err)
 	}
-	return filepath.Base(u.Path), nil
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return "", nil
+	}
+	return path.Base(u.Path), nil
 }
 
-// i.g. live/v1/playlist.m3u8, outputDir:out1, count:2 -> out1/playlist_2.m3u8
-func uri2playlistPath(uri string, outputDir string, count int) (string, error) {
+// i.g. live/v1/playlist.m3u8, count:2 -> playlist_2.m3u8, live/v1/playlist.v2.m3u8, count:2 -> playlist.v2_2.m3u8
+func uri2playlistName(uri string, count int) (string, error) {
 	basename, err := uri2basename(uri)
 	if err != nil {
 		return "", err
 	}
-	strs := strings.Split(basename, ".")
-	// FIXME It won't work if there are more than two `. ` in the path does not work.
-	if len(strs) != 2 {
-		return "", xerrors.New("parse `.` dot error")
+	if basename == "" {
+		return "", xerrors.Errorf("no basename in %s", uri)
 	}
-
-	return fmt.Sprintf("%s/%s_%v.%s", outputDir, strs[0], count, strs[1]), nil
+	ext := path.Ext(basename)
+	return fmt.Sprintf("%s_%v%s", strings.TrimSuffix(basename, ext), count, ext), nil
 }
 
 const channelCapa = 3
 
+// sourceErrMax is the number of consecutive playlist or segment fetch errors to give up the variant.
+const sourceErrMax = 3
+
+// sourceRetryInterval is the interval to request the playlist after a playlist fetch error.
+const sourceRetryInterval = time.Second
+
 type streamingController struct {
 	sequence           int
 	downloadResultChan chan downloadResult
 	config             *Config
 	logger             *zap.Logger
+	selector           *pathwaySelector
+	segmentSources     map[int]*variant
+	sourceErrCount     int
+	storage            Storage
+	writer             *playlistWriter
+	retention          *segmentRetention
+	journal            *recordingJournal
+	manifest           *recordingManifest
+	checksums          *checksumFile
+	namer              *segmentNamer
+	throttle           *throttle
+	pendingSegments    map[int]*segment
+	resources          map[string]string
+	// retryInterval is the interval to request the playlist after a fetch error. i.g. shorter for tests
+	retryInterval time.Duration
 }
 
 func newStreamingController(c *Config, l *zap.Logger) *streamingController {
@@ -105,93 +227,194 @@ func newStreamingController(c *Config, l *zap.Logger) *streamingController {
 		downloadResultChan: make(chan downloadResult, channelCapa),
 		config:             c,
 		logger:             l,
+		segmentSources:     map[int]*variant{},
+		pendingSegments:    map[int]*segment{},
+		resources:          map[string]string{},
+		retryInterval:      sourceRetryInterval,
 	}
 }
 
 func (sc *streamingController) Run(ctx context.Context) error {
 
-	err := os.Mkdir(sc.config.OutputDir, 0755)
-	if err != nil && !errors.Is(err, fs.ErrExist) {
-		return xerrors.Errorf("Mkdir failed : %w", err)
+	sc.storage = sc.config.Storage
+	if sc.storage == nil {
+		sc.storage = NewLocalStorage(sc.config.OutputDir)
+	}
+	var err error
+	if local, ok := sc.storage.(*LocalStorage); ok {
+		if err := os.MkdirAll(local.dir, 0755); err != nil {
+			return xerrors.Errorf("MkdirAll failed : %w", err)
+		}
+		removed, err := local.RemovePartialFiles()
+		if err != nil {
+			return err
+		}
+		for _, name := range removed {
+			sc.logger.Warn("partial file removed", zap.String("name", name))
+		}
 	}
 
-	// There shall be one transport to guarantee the order of requesting playlist and segment
-	tr := http.DefaultTransport
-	cli := &client{
-		httpClient: &http.Client{
-			Transport: tr,
-			Timeout:   sc.config.PlaylistDownloadTimeout,
-		},
-		token: sc.config.Token,
+	if sc.namer, err = newSegmentNamer(sc.config.SegmentNaming); err != nil {
+		return err
 	}
 
-	startTime := time.Now()
-	timingInfo := sc.config.OutputDir + "/timing_info.txt"
-	ft, err := os.Create(timingInfo)
-	if err != nil {
-		return xerrors.Errorf("os.Create failed: %w", err)
+	var state *journalState
+	if sc.config.Resume {
+		state, err = readJournal(sc.storage, sc.logger)
+		if err != nil {
+			return err
+		}
+		sc.journal = resumeRecordingJournal(sc.storage)
+		sc.checksums = resumeChecksumFile(sc.storage)
+	} else {
+		if sc.journal, err = newRecordingJournal(sc.storage); err != nil {
+			return err
+		}
+		if sc.checksums, err = newChecksumFile(sc.storage); err != nil {
+			return err
+		}
 	}
-	defer func() { _ = ft.Close() }()
 
-	resp, err := cli.get(sc.config.URI)
+	// There shall be one transport to guarantee the order of requesting playlist and segment
+	tr, err := newTransport(sc.config.HTTP)
 	if err != nil {
-		return xerrors.Errorf("cli.get failed: %w", err)
+		return err
 	}
-	f1st, err := os.CreateTemp(sc.config.OutputDir, "playlist")
+	jar, err := newCookieJar(sc.config.CookieFile)
 	if err != nil {
-		return xerrors.Errorf("os.CreateTemp failed : %w", err)
+		return err
 	}
-	defer func() {
-		_ = f1st.Close()
-		_ = os.Remove(f1st.Name())
-	}()
+	cli := sc.config.newClient(tr, jar, sc.config.PlaylistDownloadTimeout)
+	sc.throttle = newThrottle(sc.config.Throttle)
+	sc.throttle.limit(cli)
+	defer sc.throttle.report(sc.logger)
 
-	reader := io.TeeReader(resp.Body, f1st)
-
-	s := bufio.NewScanner(reader)
+	startTime := time.Now()
+	var timingInfo []byte
+	if state != nil {
+		// append to the timing of the interrupted recording
+		if timingInfo, err = readFile(sc.storage, "timing_info.txt"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	writeTimingInfo := func() error {
+		timingInfo = append(timingInfo, fmt.Sprintf("%d\n", time.Since(startTime).Milliseconds())...)
+		return putFile(sc.storage, "timing_info.txt", func(w io.Writer) error {
+			_, err := w.Write(timingInfo)
+			return err
+		})
+	}
 
-	parser := playlistParser{logger: sc.logger}
-	uri, err := parser.parse1st(s)
-	if err != nil {
+	var master bytes.Buffer
+	var variantURI string
+	if state != nil {
+		variantURI = state.variant
+	}
+	if err := sc.loadMaster(ctx, cli, &master, variantURI); err != nil {
+		return err
+	}
+	if err := sc.namer.reservePlaylists(sc.selector.master.variants); err != nil {
+		return err
+	}
+	uri := sc.selector.variant().uri
+	if err := sc.journal.variant(uri.String()); err != nil {
 		return err
 	}
+	if state != nil {
+		if sc.manifest, err = resumeRecordingManifest(sc.storage, sc.config.URI); err != nil {
+			return err
+		}
+	} else {
+		sc.manifest = newRecordingManifest(sc.storage, sc.config.URI)
+	}
+	sc.manifest.setVariant(uri.String())
+	parser := playlistParser{logger: sc.logger}
 
-	_, err = ft.Write([]byte(fmt.Sprintf("%d\n", time.Since(startTime).Milliseconds())))
-	if err != nil {
-		return xerrors.Errorf("Write failed: %w", err)
+	if err := writeTimingInfo(); err != nil {
+		return err
 	}
 
 	count := 0
-	u, err := uri2playlistPath(uri.String(), sc.config.OutputDir, count)
+	if state != nil {
+		// the playlists of the interrupted recording are not overwritten
+		count = state.count + 1
+	}
+	name, err := uri2playlistName(uri.String(), count)
 	if err != nil {
 		return err
 	}
+	if err := putFile(sc.storage, name, func(w io.Writer) error {
+		_, err := w.Write(master.Bytes())
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := sc.journal.playlist(count); err != nil {
+		return err
+	}
 
-	err = os.Rename(f1st.Name(), u)
+	err = writeMasterPlaylist(sc.storage, sc.selector.variant(), sc.selector.master.renditions, localMediaPlaylist)
 	if err != nil {
-		return xerrors.Errorf("os.Rename failed : %w", err)
+		return err
 	}
+	sc.writer = newPlaylistWriter(sc.config.OutputDir, localMediaPlaylist)
+	sc.writer.storage = sc.storage
+	if sc.config.Retention != nil {
+		sc.writer.sliding = true
+		sc.retention = newSegmentRetention(sc.config.Retention, sc.storage)
+	}
+	if state != nil {
+		sc.resume(state)
+	}
+	defer sc.finishLocalPlaylist()
+	defer sc.finishManifest()
 
 	segChan := make(chan segment, channelCapa)
 
 	// start downloader
 	downloader := newSegmentDownloader(sc, segChan, tr, sc.config.SegmentDownloadTimeout, sc.config.OutputDir, sc.config.Token)
+	downloader.cli = sc.config.newClient(tr, jar, sc.config.SegmentDownloadTimeout)
+	sc.throttle.limit(downloader.cli)
+	downloader.storage = sc.storage
+	downloader.logger = sc.logger
+	if state != nil {
+		downloader.report = resumeRecordingReport(sc.storage)
+	} else if downloader.report, err = newRecordingReport(sc.storage); err != nil {
+		return err
+	}
+	downloader.manifest = sc.manifest
+	downloader.checksums = sc.checksums
+	if sc.config.AnalyzeTS {
+		downloader.processors = append(downloader.processors, newTSAnalyzer())
+	}
+	if sc.config.VerifyDuration {
+		downloader.processors = append(downloader.processors, newDurationVerifier(sc.storage, sc.logger))
+	}
+	if sc.config.ExtractMetadata {
+		var e *metadataExtractor
+		if state != nil {
+			e = resumeMetadataExtractor(sc.storage)
+		} else if e, err = newMetadataExtractor(sc.storage); err != nil {
+			return err
+		}
+		downloader.processors = append(downloader.processors, e)
+	}
 	go downloader.Run()
 	defer close(segChan)
 
 	var prevPlaylist *playlist
-	var to time.Timer
-	for count = 1; ; {
-		if prevPlaylist != nil {
+	var to *time.Timer
+	// fetchErrors is the consecutive playlist fetch errors on all sources.
+	// The recording fails when every source has failed sourceErrMax times.
+	fetchErrors := 0
+	for count++; ; {
+		if to != nil {
 			// not first loop
 			select {
 			case r := <-sc.downloadResultChan:
 				// download result is reported
-				if r.err != nil {
-					if !errors.Is(r.err, ErrSegmentDownloadTimeout) && !errors.Is(r.err, ErrSegmentDownloadClientFactor) {
-						return r.err
-					}
-					sc.logger.Info("download failed", zap.Int("segment", r.no), zap.Error(r.err))
+				if err := sc.handleDownloadResult(r); err != nil {
+					return err
 				}
 				continue
 			case <-ctx.Done():
@@ -201,22 +424,29 @@ func (sc *streamingController) Run(ctx context.Context) error {
 				// This is the time to request playlist
 			}
 		}
-		resp, err = cli.get(uri.String())
+		v := sc.selector.variant()
+		uri = v.uri
+		sc.throttle.waitPlaylist()
+		resp, err := cli.get(uri.String())
 		if err != nil {
-			return xerrors.Errorf("cli.get failed: %w", err)
-		}
-		f, err := os.CreateTemp(sc.config.OutputDir, "playlist")
-		if err != nil {
-			return xerrors.Errorf("os.CreateTemp failed : %w", err)
+			if resp != nil {
+				_ = resp.Body.Close()
+			}
+			fetchErrors++
+			if !sc.selector.alternative() || fetchErrors >= sourceErrMax*sc.selector.sources() {
+				return xerrors.Errorf("cli.get failed: %w", err)
+			}
+			sc.logger.Info("playlist fetch failed", zap.Stringer("uri", uri), zap.Error(err))
+			sc.onSourceError(v, err)
+			to = time.NewTimer(sc.retryInterval)
+			continue
 		}
-		defer func() {
-			_ = f.Close()
-			_ = os.Remove(f.Name())
-		}()
-
-		reader = io.TeeReader(resp.Body, f)
+		fetchErrors = 0
+		var raw bytes.Buffer
+		reader := io.TeeReader(resp.Body, &raw)
 
 		newPlaylist, err := parser.parse2nd(bufio.NewScanner(reader))
+		_ = resp.Body.Close()
 		if err != nil {
 			return err
 		}
@@ -230,7 +460,7 @@ func (sc *streamingController) Run(ctx context.Context) error {
 		if prevPlaylist != nil {
 			if newPlaylist == prevPlaylist {
 				// If there is no change in the playlist, do not acquire the segment and wait only for targetDuration
-				to = *time.NewTimer(nextDuration)
+				to = time.NewTimer(nextDuration)
 				continue
 			} else {
 				// If there is a change in the playlist, acquire the segment and wait for targetDuration/2
@@ -238,42 +468,322 @@ func (sc *streamingController) Run(ctx context.Context) error {
 			}
 		}
 
-		u, err := uri2playlistPath(uri.String(), sc.config.OutputDir, count)
+		name, err := uri2playlistName(uri.String(), count)
 		if err != nil {
 			return err
 		}
-
-		err = os.Rename(f.Name(), u)
-		if err != nil {
-			return xerrors.Errorf("os.Rename failed : %w", err)
+		if err := putFile(sc.storage, name, func(w io.Writer) error {
+			_, err := w.Write(raw.Bytes())
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := sc.journal.playlist(count); err != nil {
+			return err
 		}
 
-		_, err = ft.Write([]byte(fmt.Sprintf("%d\n", time.Since(startTime).Milliseconds())))
-		if err != nil {
-			return xerrors.Errorf("Write failed: %w", err)
+		if err := writeTimingInfo(); err != nil {
+			return err
 		}
 
+		sc.writer.targetDuration = newPlaylist.targetDuration
+
 		// send segment to downloader
 		for i := 0; i < len(newPlaylist.segments); i++ {
-			segChan <- *newPlaylist.segments[i]
+			seg := newPlaylist.segments[i]
+			if seg.no < sc.sequence {
+				// already sent
+				continue
+			}
+			local, err := sc.localize(cli, seg, v)
+			if err != nil {
+				return err
+			}
+			if sc.sequence > 0 && seg.no > sc.sequence {
+				// i.g. the backup stream is ahead of the primary stream
+				sc.logger.Warn("media sequence gap", zap.Int("expected", sc.sequence), zap.Int("actual", seg.no))
+				local.discontinuity = true
+			}
+			sc.pendingSegments[seg.no] = local
+			sc.segmentSources[seg.no] = v
+			remote := *seg
+			remote.local = local
+			segChan <- remote
+			sc.sequence = seg.no + 1
 		}
 
 		prevPlaylist = newPlaylist
-		to = *time.NewTimer(nextDuration)
+		to = time.NewTimer(nextDuration)
 		count++
 	}
 }
 
+// loadMaster fetches the master playlist and selects the variant.
+// The variant of variantURI is selected if it is in the master playlist. i.g. to resume the recording
+// The master playlist is also written to w.
+func (sc *streamingController) loadMaster(ctx context.Context, cli *client, w io.Writer, variantURI string) error {
+	resp, err := cli.get(sc.config.URI)
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return xerrors.Errorf("cli.get failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	parser := playlistParser{logger: sc.logger}
+	master, err := parser.parse1st(bufio.NewScanner(io.TeeReader(resp.Body, w)))
+	if err != nil {
+		return err
+	}
+	masterURI, err := url.Parse(sc.config.URI)
+	if err != nil {
+		return xerrors.Errorf("url.Parse failed: %w", err)
+	}
+	master.resolve(masterURI)
+
+	target := master.variants[len(master.variants)-1]
+	for _, v := range master.variants {
+		if v.uri.String() == variantURI {
+			target = v
+			break
+		}
+	}
+	sc.selector = newPathwaySelector(master, target, sc.logger)
+	if master.steering != nil {
+		poller := &steeringPoller{cli: cli, uri: master.steering.serverURI, selector: sc.selector, logger: sc.logger}
+		go poller.Run(ctx)
+	}
+	return nil
+}
+
+func (sc *streamingController) handleDownloadResult(r downloadResult) error {
+	v := sc.segmentSources[r.no]
+	delete(sc.segmentSources, r.no)
+	local := sc.pendingSegments[r.no]
+	delete(sc.pendingSegments, r.no)
+	if r.err == nil {
+		if v == sc.selector.variant() {
+			sc.sourceErrCount = 0
+		}
+		if local != nil {
+			return sc.addLocalSegment(local)
+		}
+		return nil
+	}
+	if local != nil {
+		// keep the media sequence of the local playlist
+		local.gap = true
+		if err := sc.addLocalSegment(local); err != nil {
+			return err
+		}
+	}
+	if !errors.Is(r.err, ErrSegmentDownloadTimeout) && !errors.Is(r.err, ErrSegmentDownloadClientFactor) && !errors.Is(r.err, ErrSegmentDownloadServerFactor) &&
+		!errors.Is(r.err, ErrSegmentTruncated) && !errors.Is(r.err, ErrChecksumMismatch) {
+		return r.err
+	}
+	if errors.Is(r.err, ErrSegmentDownloadServerFactor) && !sc.selector.alternative() {
+		return r.err
+	}
+	sc.logger.Info("download failed", zap.Int("segment", r.no), zap.Error(r.err))
+	sc.onSourceError(v, r.err)
+	return nil
+}
+
+// resume restores the local media playlist and the downloaded resources of the interrupted recording.
+// The media sequences up to the last recorded segment are not downloaded again.
+func (sc *streamingController) resume(state *journalState) {
+	sc.writer.segments = state.segments
+	sc.writer.discontinuitySequence = state.discontinuitySequence
+	for remote, name := range state.resources {
+		sc.resources[remote] = name
+		sc.namer.reserve(name)
+	}
+	for _, s := range state.segments {
+		sc.namer.reserve(s.uri)
+	}
+	if n := len(state.segments); n > 0 {
+		sc.sequence = state.segments[n-1].no + 1
+	}
+	sc.logger.Info("resume recording", zap.Int("segments", len(state.segments)), zap.Int("sequence", sc.sequence))
+}
+
+// addLocalSegment adds the segment to the local media playlist.
+// With the retention, the old segments are removed from the playlist, then their files are deleted.
+func (sc *streamingController) addLocalSegment(local *segment) error {
+	sc.writer.add(local)
+	var removed []*segment
+	if sc.retention != nil {
+		removed = sc.retention.evict(sc.writer)
+	}
+	if err := sc.writer.write(); err != nil {
+		return err
+	}
+	if err := sc.journal.segment(local); err != nil {
+		return err
+	}
+	sc.manifest.remove(removed)
+	if err := sc.manifest.add(local); err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	inUse := append([]*segment{}, sc.writer.segments...)
+	for _, s := range sc.pendingSegments {
+		inUse = append(inUse, s)
+	}
+	resources, err := sc.retention.remove(removed, inUse)
+	for _, s := range removed {
+		sc.namer.release(s.uri)
+	}
+	for _, name := range resources {
+		sc.namer.release(name)
+	}
+	for remote, p := range sc.resources {
+		if containsString(resources, p) {
+			// download again if it appears
+			delete(sc.resources, remote)
+		}
+	}
+	if err != nil {
+		sc.logger.Warn("retention failed", zap.Error(err))
+	}
+	return sc.journal.removed(len(removed), resources)
+}
+
+// onSourceError switches to the backup stream or another pathway when fetches on the variant fail repeatedly.
+// The media sequence continues on the new variant since sc.sequence is kept.
+func (sc *streamingController) onSourceError(v *variant, err error) {
+	if v == nil || v != sc.selector.variant() {
+		// the variant is already switched
+		return
+	}
+	sc.sourceErrCount++
+	if sc.sourceErrCount >= sourceErrMax {
+		sc.selector.failover(v, err)
+		sc.sourceErrCount = 0
+	}
+}
+
+// localize returns a copy of the segment whose URIs are the names in the storage.
+// Keys and init sections are downloaded when they appear first.
+func (sc *streamingController) localize(cli *client, seg *segment, v *variant) (*segment, error) {
+	local := *seg
+	var err error
+	if local.uri, err = sc.namer.name(seg.uri, seg, v); err != nil {
+		return nil, err
+	}
+	if seg.key != nil && seg.key.uri != "" {
+		k := *seg.key
+		if k.uri, err = sc.downloadResource(cli, seg.key.uri, seg, v); err != nil {
+			return nil, err
+		}
+		local.key = &k
+	}
+	if seg.initSection != nil {
+		m := *seg.initSection
+		if m.uri, err = sc.downloadResource(cli, seg.initSection.uri, seg, v); err != nil {
+			return nil, err
+		}
+		local.initSection = &m
+	}
+	return &local, nil
+}
+
+// downloadResource downloads a key or an init section and returns the name in the storage.
+// seg is the first segment which refers to it.
+func (sc *streamingController) downloadResource(cli *client, uri string, seg *segment, v *variant) (string, error) {
+	if p, ok := sc.resources[uri]; ok {
+		return p, nil
+	}
+	resp, err := cli.get(uri)
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return "", xerrors.Errorf("cli.get failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	name, err := sc.namer.name(uri, seg, v)
+	if err != nil {
+		return "", err
+	}
+	checksum := newChecksumWriter(contentDigests(resp.Header))
+	if err := putFile(sc.storage, name, func(w io.Writer) error {
+		if _, err := io.Copy(io.MultiWriter(w, checksum), resp.Body); err != nil {
+			return err
+		}
+		return checksum.verify()
+	}); err != nil {
+		return "", err
+	}
+	if err := sc.checksums.write(checksum.sha256(), name); err != nil {
+		return "", err
+	}
+	if err := sc.journal.resource(uri, name); err != nil {
+		return "", err
+	}
+	sc.resources[uri] = name
+	return name, nil
+}
+
+// finishLocalPlaylist writes EXT-X-ENDLIST to the local media playlist.
+func (sc *streamingController) finishLocalPlaylist() {
+	sc.writer.end = true
+	if err := sc.writer.write(); err != nil {
+		sc.logger.Error("local playlist write failed", zap.Error(err))
+	}
+}
+
+// finishManifest finalizes manifest.json.
+func (sc *streamingController) finishManifest() {
+	if err := sc.manifest.finish(); err != nil {
+		sc.logger.Error("manifest write failed", zap.Error(err))
+	}
+}
+
 func (sc *streamingController) onDownload(no int, err error) {
 	sc.downloadResultChan <- downloadResult{no: no, err: err}
 }
 
 func (app *App) Run(ctx context.Context) error {
+	if app.Config.Storage != nil && (app.Config.Merge != nil || app.Config.Remux != nil) {
+		// merge and remux read the recording in OutputDir
+		return xerrors.New("merge and remux are not supported with a storage other than OutputDir")
+	}
 	controller := newStreamingController(app.Config, app.Logger)
+	if app.Config.Monitor != nil {
+		err := controller.Monitor(ctx)
+		if err != nil {
+			app.Logger.Error("error", zap.Error(err))
+		}
+		return err
+	}
 	// TODO Even if an error returns, Run is performed again up to a certain number of errors
 	err := controller.Run(ctx)
 	if err != nil {
 		app.Logger.Error("error", zap.Error(err))
 	}
+	if app.Config.Merge != nil {
+		// merge also the segments recorded before an error
+		_, mergeErr := app.Merge(app.Config.Merge)
+		if mergeErr != nil {
+			app.Logger.Error("merge failed", zap.Error(mergeErr))
+			if err == nil {
+				err = mergeErr
+			}
+		}
+	}
+	if app.Config.Remux != nil {
+		_, remuxErr := app.remuxRecording(app.Config.Remux)
+		if remuxErr != nil {
+			app.Logger.Error("remux failed", zap.Error(remuxErr))
+			if err == nil {
+				err = remuxErr
+			}
+		}
+	}
 	return err
 }
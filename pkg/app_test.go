@@ -16,9 +16,17 @@ func TestURI2basename(t *testing.T) {
 			exp: "",
 		},
 		{
-			in:  "http://localhost/aaa/playlist.m3u8",
+			in:  "http://localhost:8080/live/",
 			exp: "",
 		},
+		{
+			in:  "http://localhost/aaa/playlist.m3u8",
+			exp: "playlist.m3u8",
+		},
+		{
+			in:  "http://localhost/aaa/segment.ts?seq=123",
+			exp: "segment.ts",
+		},
 	}
 
 	for _, tt := range testcase {
@@ -27,3 +35,31 @@ func TestURI2basename(t *testing.T) {
 		assert.Equal(t, basename, tt.exp)
 	}
 }
+
+func TestURI2playlistName(t *testing.T) {
+	testcase := []struct {
+		in  string
+		exp string
+	}{
+		{
+			in:  "http://localhost/live/v1/playlist.m3u8",
+			exp: "playlist_2.m3u8",
+		},
+		{
+			in:  "http://localhost/live/v1/playlist.v1.m3u8?token=abc",
+			exp: "playlist.v1_2.m3u8",
+		},
+		{
+			in:  "http://localhost/live/v1/playlist",
+			exp: "playlist_2",
+		},
+	}
+
+	for _, tt := range testcase {
+		name, err := uri2playlistName(tt.in, 2)
+		assert.Nil(t, err)
+		assert.Equal(t, name, tt.exp)
+	}
+	_, err := uri2playlistName("http://localhost/", 2)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,246 @@
+package hls_downloader
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseError is a syntax error of a playlist with the position.
+// Line and Column are 1-based.
+type ParseError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+func newParseError(line, column int, format string, args ...interface{}) *ParseError {
+	return &ParseError{Line: line, Column: column, Msg: fmt.Sprintf(format, args...)}
+}
+
+// splitTag splits a tag line into the name and the value at the first colon.
+// i.g. #EXT-X-PROGRAM-DATE-TIME:2010-02-19T14:54:23.031+08:00 -> #EXT-X-PROGRAM-DATE-TIME, 2010-02-19T14:54:23.031+08:00
+func splitTag(line string) (string, string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], line[i+1:]
+}
+
+// valueColumn returns the column of the value of the tag.
+func valueColumn(name string) int {
+	return len(name) + 2
+}
+
+type attribute struct {
+	name  string
+	value string
+	// quoted is true if the value is a quoted-string. The quotes are removed from value.
+	quoted bool
+	column int
+}
+
+// attributeList is an attribute-list of a tag. see RFC8216 4.2
+type attributeList struct {
+	attrs  []*attribute
+	line   int
+	column int
+}
+
+func isAttributeNameChar(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-'
+}
+
+// parseAttributeList tokenizes s which starts at the line and the column.
+// i.g. BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"
+func parseAttributeList(s string, line, column int) (*attributeList, error) {
+	l := &attributeList{line: line, column: column}
+	seen := map[string]bool{}
+	i := 0
+	for i < len(s) {
+		start := i
+		for i < len(s) && isAttributeNameChar(s[i]) {
+			i++
+		}
+		if i == start {
+			return nil, newParseError(line, column+i, "invalid character %q in attribute name", s[i])
+		}
+		name := s[start:i]
+		if i >= len(s) || s[i] != '=' {
+			return nil, newParseError(line, column+i, "'=' is expected after attribute name %s", name)
+		}
+		if seen[name] {
+			return nil, newParseError(line, column+start, "duplicated attribute %s", name)
+		}
+		seen[name] = true
+		i++
+
+		a := &attribute{name: name, column: column + i}
+		if i < len(s) && s[i] == '"' {
+			end := strings.IndexAny(s[i+1:], "\"\r\n")
+			if end < 0 || s[i+1+end] != '"' {
+				return nil, newParseError(line, column+i, "unterminated quoted-string of %s", name)
+			}
+			a.value = s[i+1 : i+1+end]
+			a.quoted = true
+			i += end + 2
+		} else {
+			end := strings.IndexByte(s[i:], ',')
+			if end < 0 {
+				end = len(s) - i
+			}
+			a.value = s[i : i+end]
+			if a.value == "" {
+				return nil, newParseError(line, column+i, "empty value of %s", name)
+			}
+			if j := strings.IndexAny(a.value, "\" \t"); j >= 0 {
+				return nil, newParseError(line, column+i+j, "invalid character %q in value of %s", a.value[j], name)
+			}
+			i += end
+		}
+		l.attrs = append(l.attrs, a)
+
+		if i < len(s) {
+			if s[i] != ',' {
+				return nil, newParseError(line, column+i, "',' is expected after attribute %s", name)
+			}
+			i++
+			if i == len(s) {
+				return nil, newParseError(line, column+i, "attribute is expected after ','")
+			}
+		}
+	}
+	return l, nil
+}
+
+func (l *attributeList) get(name string) *attribute {
+	for _, a := range l.attrs {
+		if a.name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+func (l *attributeList) has(name string) bool {
+	return l.get(name) != nil
+}
+
+func (l *attributeList) lookup(name string) (*attribute, error) {
+	a := l.get(name)
+	if a == nil {
+		return nil, newParseError(l.line, l.column, "attribute %s is required", name)
+	}
+	return a, nil
+}
+
+func (l *attributeList) unquoted(name, kind string) (*attribute, error) {
+	a, err := l.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if a.quoted {
+		return nil, newParseError(l.line, a.column, "%s must be a %s, not a quoted-string", name, kind)
+	}
+	return a, nil
+}
+
+// decimalInteger returns the decimal-integer value.
+func (l *attributeList) decimalInteger(name string) (uint64, error) {
+	a, err := l.unquoted(name, "decimal-integer")
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(a.value, 10, 64)
+	if err != nil || len(a.value) > 20 {
+		return 0, newParseError(l.line, a.column, "invalid decimal-integer %q of %s", a.value, name)
+	}
+	return v, nil
+}
+
+// decimalFloatingPoint returns the decimal-floating-point or signed-decimal-floating-point value.
+func (l *attributeList) decimalFloatingPoint(name string) (float64, error) {
+	a, err := l.unquoted(name, "decimal-floating-point")
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseFloat(a.value, 64)
+	if err != nil || strings.ContainsAny(a.value, "eExXpP+") {
+		return 0, newParseError(l.line, a.column, "invalid decimal-floating-point %q of %s", a.value, name)
+	}
+	return v, nil
+}
+
+// quotedString returns the quoted-string value without the quotes.
+func (l *attributeList) quotedString(name string) (string, error) {
+	a, err := l.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if !a.quoted {
+		return "", newParseError(l.line, a.column, "%s must be a quoted-string", name)
+	}
+	return a.value, nil
+}
+
+// hexadecimalSequence returns the hexadecimal-sequence value. i.g. 0x9c7db8778570d05c3177c349fd9236aa
+func (l *attributeList) hexadecimalSequence(name string) ([]byte, error) {
+	a, err := l.unquoted(name, "hexadecimal-sequence")
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(a.value, "0x") && !strings.HasPrefix(a.value, "0X") || len(a.value) == 2 {
+		return nil, newParseError(l.line, a.column, "invalid hexadecimal-sequence %q of %s", a.value, name)
+	}
+	digits := a.value[2:]
+	if len(digits)%2 == 1 {
+		digits = "0" + digits
+	}
+	b, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, newParseError(l.line, a.column, "invalid hexadecimal-sequence %q of %s", a.value, name)
+	}
+	return b, nil
+}
+
+// decimalResolution returns the decimal-resolution value. i.g. 1280x720
+func (l *attributeList) decimalResolution(name string) (int, int, error) {
+	a, err := l.unquoted(name, "decimal-resolution")
+	if err != nil {
+		return 0, 0, err
+	}
+	strs := strings.Split(a.value, "x")
+	if len(strs) != 2 {
+		return 0, 0, newParseError(l.line, a.column, "invalid decimal-resolution %q of %s", a.value, name)
+	}
+	width, err1 := strconv.ParseUint(strs[0], 10, 32)
+	height, err2 := strconv.ParseUint(strs[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		return 0, 0, newParseError(l.line, a.column, "invalid decimal-resolution %q of %s", a.value, name)
+	}
+	return int(width), int(height), nil
+}
+
+// enumeratedString returns the enumerated-string value.
+// If values are given, the value must be one of them.
+func (l *attributeList) enumeratedString(name string, values ...string) (string, error) {
+	a, err := l.unquoted(name, "enumerated-string")
+	if err != nil {
+		return "", err
+	}
+	if len(values) == 0 {
+		return a.value, nil
+	}
+	for _, v := range values {
+		if a.value == v {
+			return a.value, nil
+		}
+	}
+	return "", newParseError(l.line, a.column, "invalid %s %q, must be one of %v", name, a.value, values)
+}
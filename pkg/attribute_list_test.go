@@ -0,0 +1,94 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func TestParseAttributeList(t *testing.T) {
+	line := `#EXT-X-KEY:METHOD=AES-128,URI="https://example.com:8443/key?a=1,b=2",IV=0x9c7db8778570d05c3177c349fd9236aa`
+	name, value := splitTag(line)
+	assert.Equal(t, name, "#EXT-X-KEY")
+
+	l, err := parseAttributeList(value, 1, valueColumn(name))
+	assert.Nil(t, err)
+	method, err := l.enumeratedString("METHOD", "NONE", "AES-128")
+	assert.Nil(t, err)
+	assert.Equal(t, method, "AES-128")
+	uri, err := l.quotedString("URI")
+	assert.Nil(t, err)
+	assert.Equal(t, uri, "https://example.com:8443/key?a=1,b=2")
+	iv, err := l.hexadecimalSequence("IV")
+	assert.Nil(t, err)
+	assert.Equal(t, len(iv), 16)
+	assert.Equal(t, iv[0], byte(0x9c))
+
+	l, err = parseAttributeList(`BANDWIDTH=1280000,RESOLUTION=1280x720,FRAME-RATE=29.970`, 1, 1)
+	assert.Nil(t, err)
+	bandwidth, err := l.decimalInteger("BANDWIDTH")
+	assert.Nil(t, err)
+	assert.Equal(t, bandwidth, uint64(1280000))
+	width, height, err := l.decimalResolution("RESOLUTION")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{width, height}, []int{1280, 720})
+	frameRate, err := l.decimalFloatingPoint("FRAME-RATE")
+	assert.Nil(t, err)
+	assert.Equal(t, frameRate, 29.97)
+	assert.False(t, l.has("CODECS"))
+}
+
+func TestParseAttributeListError(t *testing.T) {
+	testcase := []struct {
+		in     string
+		column int
+	}{
+		{in: `BANDWIDTH=1280000,CODECS="avc1`, column: 26},
+		{in: `BANDWIDTH=1280000,codecs="avc1"`, column: 19},
+		{in: `BANDWIDTH=1280000,BANDWIDTH=1`, column: 19},
+		{in: `BANDWIDTH=1280000,`, column: 19},
+		{in: `BANDWIDTH`, column: 10},
+		{in: `NAME="a"b`, column: 9},
+	}
+	for _, tt := range testcase {
+		_, err := parseAttributeList(tt.in, 3, 1)
+		var pe *ParseError
+		assert.True(t, errors.As(err, &pe), tt.in)
+		assert.Equal(t, pe.Line, 3)
+		assert.Equal(t, pe.Column, tt.column, tt.in)
+	}
+
+	l, err := parseAttributeList(`BANDWIDTH="1",RESOLUTION=1280*720`, 2, 19)
+	assert.Nil(t, err)
+	_, err = l.decimalInteger("BANDWIDTH")
+	assert.Equal(t, err.Error(), "line 2, column 29: BANDWIDTH must be a decimal-integer, not a quoted-string")
+	_, _, err = l.decimalResolution("RESOLUTION")
+	assert.Equal(t, err.Error(), "line 2, column 44: invalid decimal-resolution \"1280*720\" of RESOLUTION")
+	_, err = l.quotedString("URI")
+	assert.Equal(t, err.Error(), "line 2, column 19: attribute URI is required")
+}
+
+func TestParsePlaylistErrorPosition(t *testing.T) {
+	parser := playlistParser{logger: zap.NewNop()}
+	_, err := parser.parse1st(bufio.NewScanner(strings.NewReader(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720
+high.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=high
+low.m3u8
+`)))
+	var pe *ParseError
+	assert.True(t, errors.As(err, &pe))
+	assert.Equal(t, []int{pe.Line, pe.Column}, []int{4, 29})
+
+	_, err = parser.parse2nd(bufio.NewScanner(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:6.0
+a.ts
+`)))
+	assert.True(t, errors.As(err, &pe))
+	assert.Equal(t, []int{pe.Line, pe.Column}, []int{3, 12})
+}
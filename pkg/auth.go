@@ -0,0 +1,121 @@
+package hls_downloader
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Authenticator adds the credentials to a request.
+// It is called just before each playlist and segment request, so it can give a new credential every time.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// Refresher is implemented by the Authenticator which can renew the credentials.
+// The client calls Refresh with the rejected request on 401 or 403, then retries the request.
+type Refresher interface {
+	Refresh(req *http.Request) error
+}
+
+// BearerAuth sends the token in the Authorization header. An empty token sends no header.
+type BearerAuth struct {
+	Token string
+}
+
+func (a *BearerAuth) Authenticate(req *http.Request) error {
+	if a.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	}
+	return nil
+}
+
+// BasicAuth sends the user and the password by HTTP basic authentication. see RFC7617
+// Both empty sends no header.
+type BasicAuth struct {
+	User     string
+	Password string
+}
+
+func (a *BasicAuth) Authenticate(req *http.Request) error {
+	if a.User != "" || a.Password != "" {
+		req.SetBasicAuth(a.User, a.Password)
+	}
+	return nil
+}
+
+// DefaultTokenParam is the query parameter of QueryTokenAuth.
+const DefaultTokenParam = "token"
+
+// QueryTokenAuth sends the token in the query string. i.g. http://example.com/live/1.ts?token=abc
+// An existing parameter of the same name is replaced. An empty token sends nothing.
+type QueryTokenAuth struct {
+	// Param is the name of the query parameter. "" is DefaultTokenParam.
+	Param string
+	Token string
+}
+
+func (a *QueryTokenAuth) Authenticate(req *http.Request) error {
+	if a.Token == "" {
+		return nil
+	}
+	param := a.Param
+	if param == "" {
+		param = DefaultTokenParam
+	}
+	q := req.URL.Query()
+	q.Set(param, a.Token)
+	req.URL.RawQuery = q.Encode()
+	return nil
+}
+
+// URLSigner signs a URL in place. i.g. it adds an expiry and a signature in the query string
+type URLSigner interface {
+	Sign(u *url.URL) error
+}
+
+// URLSignerFunc is an adapter to use a function as URLSigner.
+type URLSignerFunc func(u *url.URL) error
+
+func (f URLSignerFunc) Sign(u *url.URL) error {
+	return f(u)
+}
+
+// SignedURLAuth signs the URL of each request. The URL is signed again on every request,
+// so the recording isn't limited by the lifetime of a signature.
+type SignedURLAuth struct {
+	Signer URLSigner
+}
+
+func (a *SignedURLAuth) Authenticate(req *http.Request) error {
+	if err := a.Signer.Sign(req.URL); err != nil {
+		return xerrors.Errorf("Sign failed: %w", err)
+	}
+	return nil
+}
+
+// tokenAuth returns BearerAuth of the token, or nil if the token is empty.
+func tokenAuth(token string) Authenticator {
+	if token == "" {
+		return nil
+	}
+	return &BearerAuth{Token: token}
+}
+
+// ParseHeader parses "Name: value" like curl -H.
+func ParseHeader(s string) (string, string, error) {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return "", "", xerrors.Errorf("invalid header %q, want Name: value", s)
+	}
+	name, value := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+	// a name is a token of RFC7230, and a value has no line break
+	if name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	}) >= 0 || strings.ContainsAny(value, "\r\n\x00") {
+		return "", "", xerrors.Errorf("invalid header %q", s)
+	}
+	return http.CanonicalHeaderKey(name), value, nil
+}
@@ -0,0 +1,107 @@
+package hls_downloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestAuthenticators(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   Authenticator
+		header string
+		query  string
+	}{
+		{name: "bearer", auth: &BearerAuth{Token: "abc"}, header: "Bearer abc", query: "a=1"},
+		{name: "empty bearer", auth: &BearerAuth{}, query: "a=1"},
+		{name: "basic", auth: &BasicAuth{User: "user", Password: "pass"}, header: "Basic dXNlcjpwYXNz", query: "a=1"},
+		{name: "empty basic", auth: &BasicAuth{}, query: "a=1"},
+		{name: "query", auth: &QueryTokenAuth{Token: "abc"}, query: "a=1&token=abc"},
+		{name: "query param", auth: &QueryTokenAuth{Param: "a", Token: "abc"}, query: "a=abc"},
+		{name: "empty query", auth: &QueryTokenAuth{}, query: "a=1"},
+		{
+			name: "signed url",
+			auth: &SignedURLAuth{Signer: URLSignerFunc(func(u *url.URL) error {
+				u.RawQuery += "&sig=" + u.Path
+				return nil
+			})},
+			query: "a=1&sig=/live/1.ts",
+		},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/live/1.ts?a=1", nil)
+		assert.Nil(t, err)
+		assert.Nil(t, tt.auth.Authenticate(req), tt.name)
+		assert.Equal(t, req.Header.Get("Authorization"), tt.header, tt.name)
+		assert.Equal(t, req.URL.RawQuery, tt.query, tt.name)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		in    string
+		name  string
+		value string
+		err   bool
+	}{
+		{in: "Referer: https://example.com/", name: "Referer", value: "https://example.com/"},
+		{in: "x-custom:a:b", name: "X-Custom", value: "a:b"},
+		{in: "X-Empty:", name: "X-Empty", value: ""},
+		{in: "Referer", err: true},
+		{in: ": value", err: true},
+		{in: " : value", err: true},
+		{in: "Bad Name: value", err: true},
+		{in: "X-Bad: a\nb", err: true},
+	}
+	for _, tt := range tests {
+		name, value, err := ParseHeader(tt.in)
+		if tt.err {
+			assert.NotNil(t, err, tt.in)
+			continue
+		}
+		assert.Nil(t, err, tt.in)
+		assert.Equal(t, name, tt.name, tt.in)
+		assert.Equal(t, value, tt.value, tt.in)
+	}
+}
+
+func TestClientGet(t *testing.T) {
+	var got *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer ts.Close()
+
+	config := &Config{
+		Header:    http.Header{"Referer": {"https://example.com/"}, "X-Multi": {"a", "b"}},
+		UserAgent: "test-agent",
+	}
+	resp, err := config.newClient(http.DefaultTransport, nil, 0).get(ts.URL)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, got.Header.Get("Referer"), "https://example.com/")
+	assert.Equal(t, got.Header.Values("X-Multi"), []string{"a", "b"})
+	assert.Equal(t, got.Header.Get("User-Agent"), "test-agent")
+	// no credentials without a token
+	_, ok := got.Header["Authorization"]
+	assert.False(t, ok)
+	// the header of the config is not changed
+	assert.Equal(t, config.Header.Get("User-Agent"), "")
+
+	config = &Config{Token: "abc"}
+	resp, err = config.newClient(http.DefaultTransport, nil, 0).get(ts.URL)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, got.Header.Get("Authorization"), "Bearer abc")
+
+	config = &Config{Token: "abc", Auth: &QueryTokenAuth{Token: "xyz"}}
+	resp, err = config.newClient(http.DefaultTransport, nil, 0).get(ts.URL + "/1.ts")
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, got.Header.Get("Authorization"), "")
+	assert.Equal(t, got.URL.Query().Get("token"), "xyz")
+}
@@ -0,0 +1,225 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// localChecksums is the SHA-256 checksums of the downloaded files in the format of sha256sum.
+const localChecksums = "SHA256SUMS"
+
+// ErrChecksumMismatch is the error that a downloaded file differs from the digest given by the origin.
+var ErrChecksumMismatch = xerrors.New("checksum mismatch")
+
+const (
+	digestMD5    = "md5"
+	digestSHA256 = "sha-256"
+)
+
+// contentDigest is a digest of the response body given by the origin.
+type contentDigest struct {
+	// header is the header which gives the digest. i.g. Content-MD5
+	header    string
+	algorithm string
+	sum       []byte
+}
+
+// contentDigests returns the digests in Content-MD5, ETag and Digest. see RFC1864, RFC3230
+// ETag is used only if it looks like a MD5 digest, which is the case of S3 and many web servers.
+func contentDigests(h http.Header) []contentDigest {
+	var digests []contentDigest
+	if v := h.Get("Content-MD5"); v != "" {
+		if sum, err := base64.StdEncoding.DecodeString(v); err == nil && len(sum) == md5.Size {
+			digests = append(digests, contentDigest{header: "Content-MD5", algorithm: digestMD5, sum: sum})
+		}
+	}
+	if v := h.Get("ETag"); v != "" && !strings.HasPrefix(v, "W/") {
+		if sum, err := hex.DecodeString(strings.Trim(v, `"`)); err == nil && len(sum) == md5.Size {
+			digests = append(digests, contentDigest{header: "ETag", algorithm: digestMD5, sum: sum})
+		}
+	}
+	for _, v := range h.Values("Digest") {
+		// i.g. SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=,MD5=HUXZLQLMuI/KZ5KDcJPcOA==
+		for _, d := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			algorithm := strings.ToLower(kv[0])
+			sum, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				continue
+			}
+			if (algorithm == digestMD5 && len(sum) == md5.Size) || (algorithm == digestSHA256 && len(sum) == sha256.Size) {
+				digests = append(digests, contentDigest{header: "Digest", algorithm: algorithm, sum: sum})
+			}
+		}
+	}
+	return digests
+}
+
+// checksumWriter computes SHA-256 of a downloaded file, and MD5 if the origin gives it.
+type checksumWriter struct {
+	digests []contentDigest
+	hashes  map[string]hash.Hash
+}
+
+func newChecksumWriter(digests []contentDigest) *checksumWriter {
+	w := &checksumWriter{digests: digests, hashes: map[string]hash.Hash{digestSHA256: sha256.New()}}
+	for _, d := range digests {
+		if d.algorithm == digestMD5 {
+			w.hashes[digestMD5] = md5.New()
+		}
+	}
+	return w
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	for _, h := range w.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// sha256 returns the hex digits of SHA-256.
+func (w *checksumWriter) sha256() string {
+	return hex.EncodeToString(w.hashes[digestSHA256].Sum(nil))
+}
+
+// verify compares the file with the digests given by the origin.
+func (w *checksumWriter) verify() error {
+	for _, d := range w.digests {
+		if sum := w.hashes[d.algorithm].Sum(nil); !bytes.Equal(sum, d.sum) {
+			return xerrors.Errorf("%s %s: %w", d.header, base64.StdEncoding.EncodeToString(d.sum), ErrChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+// checksumFile appends the checksums of the downloaded files to SHA256SUMS in the storage.
+// The files can be verified by "sha256sum -c SHA256SUMS" or the verify subcommand.
+type checksumFile struct {
+	writer *jsonLinesWriter
+}
+
+// newChecksumFile starts a new SHA256SUMS. The checksums of the previous recording are removed.
+func newChecksumFile(s Storage) (*checksumFile, error) {
+	f := resumeChecksumFile(s)
+	if err := f.writer.reset(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// resumeChecksumFile continues SHA256SUMS.
+func resumeChecksumFile(s Storage) *checksumFile {
+	return &checksumFile{writer: newJSONLinesWriter(s, localChecksums)}
+}
+
+func (f *checksumFile) write(sum, name string) error {
+	return f.writer.writeLine(fmt.Sprintf("%s  %s", sum, name))
+}
+
+// VerifyReport is the result of the verify subcommand.
+type VerifyReport struct {
+	Files int `json:"files"`
+	// Removed is the number of the files which are removed by the retention. They are not verified.
+	Removed    int      `json:"removed"`
+	OK         int      `json:"ok"`
+	Mismatched []string `json:"mismatched"`
+	Missing    []string `json:"missing"`
+}
+
+// Verify compares the files in the storage with SHA256SUMS in the storage.
+// If a file appears more than once, the last checksum is used.
+// The files removed by the retention are skipped according to journal.jsonl.
+func (app *App) Verify() (*VerifyReport, error) {
+	storage := app.Config.Storage
+	if storage == nil {
+		storage = NewLocalStorage(app.Config.OutputDir)
+	}
+	sums, names, err := readChecksums(storage)
+	if err != nil {
+		return nil, err
+	}
+	removed := map[string]bool{}
+	if b, err := readFile(storage, localJournal); err == nil {
+		// the journal may be being written by the recording, so a partial line is not truncated
+		state, _, err := parseJournal(b)
+		if err != nil {
+			return nil, err
+		}
+		removed = state.removed
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	report := &VerifyReport{Mismatched: []string{}, Missing: []string{}}
+	for _, name := range names {
+		if removed[name] {
+			report.Removed++
+			continue
+		}
+		report.Files++
+		r, err := storage.Get(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			report.Missing = append(report.Missing, name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		_ = r.Close()
+		if err != nil {
+			return nil, xerrors.Errorf("io.Copy failed: %w", err)
+		}
+		if hex.EncodeToString(h.Sum(nil)) != sums[name] {
+			report.Mismatched = append(report.Mismatched, name)
+			continue
+		}
+		report.OK++
+	}
+	return report, nil
+}
+
+// readChecksums reads SHA256SUMS in the storage and returns the checksums and the names in order.
+func readChecksums(s Storage) (map[string]string, []string, error) {
+	f, err := s.Get(localChecksums)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+	sums := map[string]string{}
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		// "<sum>  <name>" or "<sum> *<name>" in binary mode
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 || len(fields[1]) < 2 {
+			return nil, nil, xerrors.Errorf("line %d: invalid checksum %q", line, scanner.Text())
+		}
+		name := fields[1][1:]
+		if _, ok := sums[name]; !ok {
+			names = append(names, name)
+		}
+		sums[name] = strings.ToLower(fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, xerrors.Errorf("scanner.Err: %w", err)
+	}
+	return sums, names, nil
+}
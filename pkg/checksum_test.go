@@ -0,0 +1,74 @@
+package hls_downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func TestContentDigests(t *testing.T) {
+	digests := contentDigests(map[string][]string{
+		"Content-Md5": {"ruU35sjTYzpDyJPRShuo7w=="},
+		"Etag":        {`"aee537e6c8d3633a43c893d14a1ba8ef"`},
+		"Digest":      {"SHA-256=8r643oLn9+zvKanwqOw3J9fev1pZ/A88pEHbBk99MDM=, UNIXsum=30637, md5=invalid"},
+	})
+	assert.Equal(t, len(digests), 3)
+	assert.Equal(t, digests[0].header, "Content-MD5")
+	assert.Equal(t, digests[1].header, "ETag")
+	assert.Equal(t, digests[2].algorithm, digestSHA256)
+
+	w := newChecksumWriter(digests)
+	_, err := w.Write([]byte("a_ts_file"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.verify())
+	assert.Equal(t, w.sha256(), "f2beb8de82e7f7ecef29a9f0a8ec3727d7debf5a59fc0f3ca441db064f7d3033")
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newChecksumFile(NewLocalStorage(dir))
+	assert.Nil(t, err)
+	for _, name := range []string{"1.ts", "2.ts", "3.ts"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte("a_ts_file"), 0644))
+		assert.Nil(t, c.write("f2beb8de82e7f7ecef29a9f0a8ec3727d7debf5a59fc0f3ca441db064f7d3033", name))
+	}
+	// altered and deleted
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "2.ts"), []byte("altered"), 0644))
+	assert.Nil(t, os.Remove(filepath.Join(dir, "3.ts")))
+
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	report, err := app.Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, *report, VerifyReport{Files: 3, OK: 1, Mismatched: []string{"2.ts"}, Missing: []string{"3.ts"}})
+
+	// a new recording starts new checksums
+	_, err = newChecksumFile(NewLocalStorage(dir))
+	assert.Nil(t, err)
+	_, err = app.Verify()
+	assert.NotNil(t, err)
+}
+
+func TestVerifyRetention(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewLocalStorage(dir)
+	c, err := newChecksumFile(storage)
+	assert.Nil(t, err)
+	j, err := newRecordingJournal(storage)
+	assert.Nil(t, err)
+	for no, name := range []string{"1.ts", "2.ts"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte("a_ts_file"), 0644))
+		assert.Nil(t, c.write("f2beb8de82e7f7ecef29a9f0a8ec3727d7debf5a59fc0f3ca441db064f7d3033", name))
+		assert.Nil(t, j.segment(&segment{no: no + 1, duration: 6, uri: name}))
+	}
+	// 1.ts is removed by the retention
+	assert.Nil(t, j.removed(1, nil))
+	assert.Nil(t, os.Remove(filepath.Join(dir, "1.ts")))
+
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	report, err := app.Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, *report, VerifyReport{Files: 1, Removed: 1, OK: 1, Mismatched: []string{}, Missing: []string{}})
+}
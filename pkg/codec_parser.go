@@ -0,0 +1,346 @@
+package hls_downloader
+
+import (
+	"bytes"
+
+	"golang.org/x/xerrors"
+)
+
+var ErrInvalidBitstream = xerrors.New("invalid bitstream")
+
+// bitReader reads bits of RBSP in big endian.
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			r.err = ErrInvalidBitstream
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) {
+	if r.pos+n > len(r.b)*8 {
+		r.err = ErrInvalidBitstream
+		return
+	}
+	r.pos += n
+}
+
+// ue reads ue(v) Exp-Golomb code.
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros >= 32 {
+			r.err = ErrInvalidBitstream
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads se(v) Exp-Golomb code.
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+// splitNALUnits splits Annex B byte stream into NAL units without start codes.
+func splitNALUnits(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); {
+		if b[i] == 0 && b[i+1] == 0 && b[i+2] == 1 {
+			if start >= 0 {
+				nalus = append(nalus, bytes.TrimRight(b[start:i], "\x00"))
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(b) {
+		nalus = append(nalus, b[start:])
+	}
+	return nalus
+}
+
+// removeEmulationPrevention converts NAL unit payload to RBSP.
+func removeEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 0x03 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// H.264 NAL unit types. see ITU-T H.264 7.4.1
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+	h264NALPPS = 8
+	h264NALAUD = 9
+)
+
+// H.265 NAL unit types. see ITU-T H.265 7.4.2.2
+const (
+	h265NALBLAWLP = 16
+	h265NALCRANUT = 21
+	h265NALVPS    = 32
+	h265NALSPS    = 33
+	h265NALPPS    = 34
+	h265NALAUD    = 35
+)
+
+func h264NALType(nalu []byte) int {
+	return int(nalu[0] & 0x1f)
+}
+
+func h265NALType(nalu []byte) int {
+	return int(nalu[0]>>1) & 0x3f
+}
+
+type videoInfo struct {
+	width  int
+	height int
+}
+
+// parseH264SPS parses the resolution of H.264 SPS. see ITU-T H.264 7.3.2.1.1
+func parseH264SPS(nalu []byte) (*videoInfo, error) {
+	r := &bitReader{b: removeEmulationPrevention(nalu[1:])}
+	profile := r.bits(8)
+	r.skip(16)
+	r.ue()
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.skip(1)
+		}
+		r.ue()
+		r.ue()
+		r.skip(1)
+		if r.bits(1) == 1 {
+			n := 8
+			if chromaFormat == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue()
+	switch r.ue() {
+	case 0:
+		r.ue()
+	case 1:
+		r.skip(1)
+		r.se()
+		r.se()
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()
+	r.skip(1)
+	widthInMbs := int(r.ue()) + 1
+	heightInMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bits(1))
+	if frameMbsOnly == 0 {
+		r.skip(1)
+	}
+	r.skip(1)
+	var left, right, top, bottom int
+	if r.bits(1) == 1 {
+		left, right, top, bottom = int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+	}
+	if r.err != nil {
+		return nil, xerrors.Errorf("SPS: %w", r.err)
+	}
+	cropX, cropY := 1, 2-frameMbsOnly
+	switch chromaFormat {
+	case 1:
+		cropX, cropY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropX = 2
+	}
+	return &videoInfo{
+		width:  widthInMbs*16 - (left+right)*cropX,
+		height: (2-frameMbsOnly)*heightInMapUnits*16 - (top+bottom)*cropY,
+	}, nil
+}
+
+type h265SPS struct {
+	videoInfo
+	// generalProfileTierLevel is general_profile_space to general_level_idc (12 bytes).
+	generalProfileTierLevel []byte
+	chromaFormat            int
+	bitDepthLuma            int
+	bitDepthChroma          int
+	maxSubLayers            int
+	temporalIDNesting       bool
+}
+
+// parseH265SPS parses H.265 SPS. see ITU-T H.265 7.3.2.2.1
+func parseH265SPS(nalu []byte) (*h265SPS, error) {
+	rbsp := removeEmulationPrevention(nalu[2:])
+	if len(rbsp) < 13 {
+		return nil, xerrors.Errorf("SPS: %w", ErrInvalidBitstream)
+	}
+	sps := &h265SPS{generalProfileTierLevel: rbsp[1:13]}
+	r := &bitReader{b: rbsp}
+	r.skip(4)
+	maxSubLayersMinus1 := int(r.bits(3))
+	sps.maxSubLayers = maxSubLayersMinus1 + 1
+	sps.temporalIDNesting = r.bits(1) == 1
+	// profile_tier_level
+	r.skip(96)
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = r.bits(1) == 1
+		levelPresent[i] = r.bits(1) == 1
+	}
+	if maxSubLayersMinus1 > 0 {
+		r.skip(2 * (8 - maxSubLayersMinus1))
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+	r.ue()
+	sps.chromaFormat = int(r.ue())
+	if sps.chromaFormat == 3 {
+		r.skip(1)
+	}
+	sps.width = int(r.ue())
+	sps.height = int(r.ue())
+	if r.bits(1) == 1 {
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		subWidth, subHeight := 1, 1
+		switch sps.chromaFormat {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		sps.width -= subWidth * (left + right)
+		sps.height -= subHeight * (top + bottom)
+	}
+	sps.bitDepthLuma = int(r.ue()) + 8
+	sps.bitDepthChroma = int(r.ue()) + 8
+	if r.err != nil {
+		return nil, xerrors.Errorf("SPS: %w", r.err)
+	}
+	return sps, nil
+}
+
+// adtsFrame is an AAC frame in ADTS. see ISO/IEC 13818-7 6.2
+type adtsFrame struct {
+	objectType      int
+	sampleRate      int
+	sampleRateIndex int
+	channels        int
+	data            []byte
+}
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// parseADTS splits ADTS frames.
+func parseADTS(b []byte) ([]*adtsFrame, error) {
+	var frames []*adtsFrame
+	for len(b) > 0 {
+		if len(b) < 7 || b[0] != 0xff || b[1]&0xf6 != 0xf0 {
+			return frames, xerrors.Errorf("ADTS header: %w", ErrInvalidBitstream)
+		}
+		headerLength := 7
+		if b[1]&0x01 == 0 {
+			// CRC
+			headerLength = 9
+		}
+		sampleRateIndex := int(b[2]>>2) & 0x0f
+		frameLength := int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5])>>5
+		if sampleRateIndex >= len(adtsSampleRates) || frameLength < headerLength || frameLength > len(b) {
+			return frames, xerrors.Errorf("ADTS header: %w", ErrInvalidBitstream)
+		}
+		frames = append(frames, &adtsFrame{
+			objectType:      int(b[2]>>6) + 1,
+			sampleRate:      adtsSampleRates[sampleRateIndex],
+			sampleRateIndex: sampleRateIndex,
+			channels:        int(b[2]&0x01)<<2 | int(b[3])>>6,
+			data:            b[headerLength:frameLength],
+		})
+		b = b[frameLength:]
+	}
+	return frames, nil
+}
+
+// audioSpecificConfig returns AudioSpecificConfig of the frame. see ISO/IEC 14496-3 1.6.2.1
+func (f *adtsFrame) audioSpecificConfig() []byte {
+	return []byte{
+		byte(f.objectType<<3 | f.sampleRateIndex>>1),
+		byte(f.sampleRateIndex<<7 | f.channels<<3),
+	}
+}
+
+// isRandomAccess returns true if the access unit of H.264 or H.265 has an IDR or IRAP picture.
+func isRandomAccess(streamType byte, data []byte) bool {
+	for _, nalu := range splitNALUnits(data) {
+		if len(nalu) == 0 {
+			continue
+		}
+		if streamType == streamTypeH264 && h264NALType(nalu) == h264NALIDR {
+			return true
+		}
+		if streamType == streamTypeH265 && h265NALType(nalu) >= h265NALBLAWLP && h265NALType(nalu) <= h265NALCRANUT {
+			return true
+		}
+	}
+	return false
+}
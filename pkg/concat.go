@@ -0,0 +1,201 @@
+package hls_downloader
+
+import (
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// isFMP4Recording returns true if the segments of the local playlist are fMP4.
+func isFMP4Recording(p *playlist) bool {
+	for _, s := range p.segments {
+		if !s.gap {
+			return s.initSection != nil
+		}
+	}
+	return false
+}
+
+// concatTrack is the decode time of a track in the progressive MP4.
+type concatTrack struct {
+	first uint64
+	next  uint64
+}
+
+// Concat combines the init section and the fragments of the recorded fMP4 (CMAF) segments in the output directory
+// into a MP4 file in order of the media sequence. It is the counterpart of Remux for fMP4 recordings.
+// With Fragmented, moof and mdat are copied as they are. Otherwise the samples are defragmented into
+// a progressive MP4 with a rebuilt moov.
+// Segments which are not downloaded or can't be read are skipped and reported.
+func (app *App) Concat(opt *RemuxOptions) (*RemuxReport, error) {
+	dir := app.Config.OutputDir
+	p, err := loadLocalPlaylist(dir)
+	if err != nil {
+		return nil, err
+	}
+	output := opt.Output
+	if output == "" {
+		output = filepath.Join(dir, defaultRemuxOutput)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return nil, xerrors.Errorf("os.Create failed: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	report := &RemuxReport{Output: output, Tracks: []string{}, Skipped: []SkippedSegment{}}
+	var initSection *initSection
+	var initSegment *mp4Init
+	var w *progressiveMP4Writer
+	tracks := map[*mp4Track]*concatTrack{}
+	for _, s := range p.segments {
+		reason := ""
+		if s.gap {
+			reason = "not downloaded"
+		} else if s.key != nil && s.key.method != "NONE" {
+			reason = "encrypted segment is not supported"
+		} else if s.initSection == nil {
+			reason = "not fMP4 segment"
+		} else if s.initSection.byteRange != "" {
+			reason = "BYTERANGE of EXT-X-MAP is not supported"
+		} else if initSection != nil && !sameInitSection(initSection, s.initSection) {
+			reason = "init section is changed"
+		}
+
+		if reason == "" && initSegment == nil {
+			b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(s.initSection.uri)))
+			if err == nil {
+				initSegment, err = parseMP4Init(b)
+			}
+			if err != nil {
+				reason = err.Error()
+			} else if opt.Fragmented {
+				if _, err := f.Write(b); err != nil {
+					return nil, xerrors.Errorf("Write failed: %w", err)
+				}
+			} else if w, err = newProgressiveMP4Writer(f, nil); err != nil {
+				return nil, err
+			}
+			if reason == "" {
+				initSection = s.initSection
+			}
+		}
+
+		var data []byte
+		var fragments []*mp4Fragment
+		if reason == "" {
+			data, err = os.ReadFile(filepath.Join(dir, filepath.FromSlash(s.uri)))
+			if err == nil {
+				fragments, err = parseMP4Fragments(data, initSegment)
+			}
+			if err != nil {
+				reason = err.Error()
+			}
+		}
+		if reason != "" {
+			report.Skipped = append(report.Skipped, SkippedSegment{No: s.no, URI: s.uri, Reason: reason})
+			continue
+		}
+
+		for _, fragment := range fragments {
+			t := tracks[fragment.track]
+			if t == nil {
+				t = &concatTrack{first: fragment.baseDecodeTime, next: fragment.baseDecodeTime}
+				tracks[fragment.track] = t
+			}
+			if n := len(fragment.track.samples); fragment.baseDecodeTime > t.next && n > 0 && !opt.Fragmented {
+				// fill the gap of a missing segment by the last sample
+				fragment.track.samples[n-1].duration += uint32(fragment.baseDecodeTime - t.next)
+			}
+			t.next = fragment.baseDecodeTime
+			offset := 0
+			for _, sample := range fragment.samples {
+				t.next += uint64(sample.duration)
+				if opt.Fragmented {
+					continue
+				}
+				if err := w.writeSample(fragment.track, sample, fragment.data[offset:offset+int(sample.size)]); err != nil {
+					return nil, err
+				}
+				offset += int(sample.size)
+			}
+		}
+		if opt.Fragmented {
+			if err := writeMP4Boxes(f, data, "moof", "mdat", "emsg"); err != nil {
+				return nil, err
+			}
+		}
+		report.Segments++
+	}
+	if initSegment == nil {
+		return nil, xerrors.New("no fMP4 segment is found")
+	}
+
+	// align the tracks by the decode time
+	first := -1.0
+	for track, t := range tracks {
+		if v := float64(t.first) / float64(track.timescale); first < 0 || v < first {
+			first = v
+		}
+	}
+	for _, track := range initSegment.tracks {
+		t := tracks[track]
+		if t == nil {
+			continue
+		}
+		start := float64(t.first)/float64(track.timescale) - first
+		track.startTime = int64(start * mp4MovieTimescale)
+		report.Tracks = append(report.Tracks, string(track.sampleEntry[4:8]))
+		if d := start + float64(t.next-t.first)/float64(track.timescale); d > report.Duration {
+			report.Duration = d
+		}
+	}
+	if !opt.Fragmented {
+		w.tracks = initSegment.tracks
+		if err := w.close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return nil, xerrors.Errorf("Close failed: %w", err)
+	}
+	app.Logger.Info("concatenated",
+		zap.String("output", report.Output),
+		zap.Strings("tracks", report.Tracks),
+		zap.Int("segments", report.Segments),
+		zap.Int("skipped", len(report.Skipped)))
+	return report, nil
+}
+
+// writeMP4Boxes writes the boxes of the types in b.
+func writeMP4Boxes(f *os.File, b []byte, types ...string) error {
+	boxes, err := readMP4Boxes(b)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		for _, typ := range types {
+			if box.typ != typ {
+				continue
+			}
+			if _, err := f.Write(b[box.offset : box.offset+box.header+len(box.payload)]); err != nil {
+				return xerrors.Errorf("Write failed: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// remuxRecording remuxes MPEG-TS recordings or concatenates fMP4 recordings.
+func (app *App) remuxRecording(opt *RemuxOptions) (*RemuxReport, error) {
+	p, err := loadLocalPlaylist(app.Config.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	if isFMP4Recording(p) {
+		return app.Concat(opt)
+	}
+	return app.Remux(opt)
+}
@@ -0,0 +1,169 @@
+package hls_downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func testMP4Tracks() []*mp4Track {
+	sps := testH264SPS(320, 240)
+	info, _ := parseH264SPS(sps)
+	frames, _ := parseADTS(testADTS([]byte{0}))
+	return []*mp4Track{
+		{id: 1, handler: "vide", timescale: 90000, width: 320, height: 240, sampleEntry: avcSampleEntry(sps, []byte{0x68, 0xce, 0x38, 0x80}, info)},
+		{id: 2, handler: "soun", timescale: 48000, sampleEntry: aacSampleEntry(frames[0])},
+	}
+}
+
+// testFMP4Segment returns a segment of 2 video samples and 4 audio samples from the decode time in sec.
+func testFMP4Segment(t *testing.T, tracks []*mp4Track, sequence uint32, sec uint64) []byte {
+	var buf bytes.Buffer
+	buf.Write(mp4Box("styp", []byte("msdh"), u32(0)))
+	err := writeMP4Fragment(&buf, sequence, []*mp4Fragment{
+		{
+			track:          tracks[0],
+			baseDecodeTime: sec * 90000,
+			samples: []mp4Sample{
+				{size: 3, duration: 45000, cto: 3000, sync: true},
+				{size: 2, duration: 45000, cto: 3000},
+			},
+			data: []byte{1, 1, 1, 2, 2},
+		},
+		{
+			track:          tracks[1],
+			baseDecodeTime: sec * 48000,
+			samples: []mp4Sample{
+				{size: 1, duration: 12000, sync: true},
+				{size: 1, duration: 12000, sync: true},
+				{size: 1, duration: 12000, sync: true},
+				{size: 1, duration: 12000, sync: true},
+			},
+			data: []byte{3, 4, 5, 6},
+		},
+	})
+	assert.Nil(t, err)
+	return buf.Bytes()
+}
+
+func testConcatDir(t *testing.T) string {
+	dir := t.TempDir()
+	tracks := testMP4Tracks()
+	var init bytes.Buffer
+	assert.Nil(t, writeMP4Init(&init, tracks))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "init.mp4"), init.Bytes(), 0644))
+
+	m := &initSection{uri: "init.mp4"}
+	w := newPlaylistWriter(dir, localMediaPlaylist)
+	w.add(&segment{no: 1, duration: 1, uri: "1.m4s", initSection: m})
+	w.add(&segment{no: 2, duration: 1, uri: "2.m4s", initSection: m})
+	w.add(&segment{no: 3, duration: 1, uri: "3.m4s", initSection: m, gap: true})
+	w.add(&segment{no: 4, duration: 1, uri: "4.m4s", initSection: m})
+	w.end = true
+	assert.Nil(t, w.write())
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "1.m4s"), testFMP4Segment(t, tracks, 1, 10), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "2.m4s"), testFMP4Segment(t, tracks, 2, 11), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "4.m4s"), testFMP4Segment(t, tracks, 4, 13), 0644))
+	return dir
+}
+
+func TestParseMP4(t *testing.T) {
+	tracks := testMP4Tracks()
+	var init bytes.Buffer
+	assert.Nil(t, writeMP4Init(&init, tracks))
+	m, err := parseMP4Init(init.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, len(m.tracks), 2)
+	assert.Equal(t, m.tracks[0].id, uint32(1))
+	assert.Equal(t, m.tracks[0].handler, "vide")
+	assert.Equal(t, m.tracks[0].timescale, uint32(90000))
+	assert.Equal(t, m.tracks[0].width, 320)
+	assert.Equal(t, m.tracks[0].sampleEntry, tracks[0].sampleEntry)
+	assert.Equal(t, m.tracks[1].timescale, uint32(48000))
+	assert.Equal(t, m.tracks[1].sampleEntry, tracks[1].sampleEntry)
+
+	fragments, err := parseMP4Fragments(testFMP4Segment(t, tracks, 1, 10), m)
+	assert.Nil(t, err)
+	assert.Equal(t, len(fragments), 2)
+	assert.Equal(t, fragments[0].track, m.tracks[0])
+	assert.Equal(t, fragments[0].baseDecodeTime, uint64(900000))
+	assert.Equal(t, fragments[0].samples, []mp4Sample{
+		{size: 3, duration: 45000, cto: 3000, sync: true},
+		{size: 2, duration: 45000, cto: 3000},
+	})
+	assert.Equal(t, fragments[0].data, []byte{1, 1, 1, 2, 2})
+	assert.Equal(t, fragments[1].data, []byte{3, 4, 5, 6})
+
+	_, err = parseMP4Init([]byte{0, 0, 0, 9, 'm', 'o', 'o', 'v'})
+	assert.True(t, err != nil)
+}
+
+func TestConcat(t *testing.T) {
+	dir := testConcatDir(t)
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	report, err := app.Concat(&RemuxOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Output, filepath.Join(dir, "recording.mp4"))
+	assert.Equal(t, report.Segments, 3)
+	assert.Equal(t, report.Tracks, []string{"avc1", "mp4a"})
+	assert.Equal(t, report.Duration, 4.0)
+	assert.Equal(t, report.Skipped, []SkippedSegment{{No: 3, URI: "3.m4s", Reason: "not downloaded"}})
+
+	b, err := os.ReadFile(report.Output)
+	assert.Nil(t, err)
+	assert.True(t, testFindBox(b, "moof") == nil)
+	traks := testFindBoxes(testFindBox(b, "moov"), "trak")
+	assert.Equal(t, len(traks), 2)
+	video := testFindBox(traks[0], "mdia", "minf", "stbl")
+	// the gap of the missing segment is filled by the last sample before it
+	assert.Equal(t, testFindBox(video, "stts")[4:], []byte{
+		0, 0, 0, 3, 0, 0, 0, 3, 0, 0, 0xaf, 0xc8, 0, 0, 0, 1, 0, 2, 0x0f, 0x58, 0, 0, 0, 2, 0, 0, 0xaf, 0xc8})
+	assert.Equal(t, testFindBox(video, "stss")[4:], []byte{0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 0, 5})
+	stco := testFindBox(video, "stco")
+	assert.Equal(t, b[binary.BigEndian.Uint32(stco[8:])], byte(1))
+	audio := testFindBox(traks[1], "mdia", "minf", "stbl")
+	stsz := testFindBox(audio, "stsz")
+	assert.Equal(t, binary.BigEndian.Uint32(stsz[8:]), uint32(12))
+}
+
+func TestConcatFragmented(t *testing.T) {
+	dir := testConcatDir(t)
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	output := filepath.Join(dir, "out.mp4")
+	report, err := app.Concat(&RemuxOptions{Output: output, Fragmented: true})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Segments, 3)
+
+	b, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	assert.True(t, testFindBox(b, "moov", "mvex") != nil)
+	assert.Equal(t, len(testFindBoxes(b, "moof")), 3)
+	assert.Equal(t, len(testFindBoxes(b, "mdat")), 3)
+	// styp of segments is not copied
+	assert.Equal(t, len(testFindBoxes(b, "styp")), 0)
+
+	// the output is readable as fMP4
+	m, err := parseMP4Init(b)
+	assert.Nil(t, err)
+	fragments, err := parseMP4Fragments(b, m)
+	assert.Nil(t, err)
+	assert.Equal(t, len(fragments), 6)
+	assert.Equal(t, fragments[4].baseDecodeTime, uint64(13*90000))
+	assert.Equal(t, fragments[4].data, []byte{1, 1, 1, 2, 2})
+}
+
+func TestRemuxRecording(t *testing.T) {
+	dir := testConcatDir(t)
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	report, err := app.remuxRecording(&RemuxOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Tracks, []string{"avc1", "mp4a"})
+
+	_, err = app.Remux(&RemuxOptions{})
+	assert.True(t, err != nil)
+}
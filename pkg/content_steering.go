@@ -0,0 +1,238 @@
+package hls_downloader
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// defaultPathwayID is the PATHWAY-ID of a variant which doesn't have the attribute.
+const defaultPathwayID = "."
+
+// defaultSteeringTTL is used when the steering manifest doesn't have TTL.
+const defaultSteeringTTL = 300 * time.Second
+
+type contentSteering struct {
+	serverURI *url.URL
+	pathwayID string
+}
+
+func newContentSteering(attrs *attributeList) (*contentSteering, error) {
+	s, err := attrs.quotedString("SERVER-URI")
+	if err != nil {
+		return nil, err
+	}
+	serverURI, err := url.Parse(s)
+	if err != nil {
+		return nil, xerrors.Errorf("url.Parse failed: %w", err)
+	}
+	cs := &contentSteering{serverURI: serverURI}
+	if attrs.has("PATHWAY-ID") {
+		cs.pathwayID, err = attrs.quotedString("PATHWAY-ID")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// steeringManifest is the response of the steering server.
+// see draft-pantos-hls-rfc8216bis 7.1. Steering Manifest
+type steeringManifest struct {
+	Version         int      `json:"VERSION"`
+	TTL             int      `json:"TTL"`
+	ReloadURI       string   `json:"RELOAD-URI"`
+	PathwayPriority []string `json:"PATHWAY-PRIORITY"`
+}
+
+// pathwaySelector selects a pathway to fetch the playlist and segments.
+// The pathway is switched when the steering server reorders the pathways or a pathway fails.
+type pathwaySelector struct {
+	mu       sync.Mutex
+	master   *masterPlaylist
+	key      string
+	priority []string
+	failed   map[string]bool
+	current  string
+	backup   int
+	logger   *zap.Logger
+}
+
+func newPathwaySelector(master *masterPlaylist, target *variant, logger *zap.Logger) *pathwaySelector {
+	ps := &pathwaySelector{
+		master:   master,
+		key:      target.key(),
+		priority: master.pathways(),
+		failed:   map[string]bool{},
+		current:  target.pathwayID,
+		logger:   logger,
+	}
+	if master.steering != nil && master.steering.pathwayID != "" {
+		ps.switchTo(master.steering.pathwayID, "initial PATHWAY-ID")
+	}
+	return ps
+}
+
+// variant returns the variant of the current pathway.
+func (ps *pathwaySelector) variant() *variant {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.currentVariant()
+}
+
+func (ps *pathwaySelector) currentVariant() *variant {
+	vs := ps.master.backups(ps.current, ps.key)
+	if len(vs) == 0 {
+		return nil
+	}
+	return vs[ps.backup%len(vs)]
+}
+
+func (ps *pathwaySelector) pathway() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.current
+}
+
+// alternative reports whether there is another pathway or backup stream to switch.
+func (ps *pathwaySelector) alternative() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(ps.master.backups(ps.current, ps.key)) > 1 {
+		return true
+	}
+	for _, id := range ps.priority {
+		if id != ps.current && ps.master.lookup(id, ps.key) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sources returns the number of the variants of all pathways including the backup streams.
+func (ps *pathwaySelector) sources() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	n := 0
+	for _, id := range ps.master.pathways() {
+		n += len(ps.master.backups(id, ps.key))
+	}
+	return n
+}
+
+// setPriority is called when the steering manifest is reloaded.
+func (ps *pathwaySelector) setPriority(priority []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.priority = priority
+	ps.reselect("steering manifest")
+}
+
+// fail marks the pathway as failed and switches to the next pathway.
+func (ps *pathwaySelector) fail(pathwayID string, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.failLocked(pathwayID, err)
+}
+
+// failLocked is fail with ps.mu held.
+func (ps *pathwaySelector) failLocked(pathwayID string, err error) {
+	ps.failed[pathwayID] = true
+	ps.logger.Warn("pathway failed", zap.String("pathway", pathwayID), zap.Error(err))
+	if pathwayID == ps.current {
+		ps.reselect("pathway failure")
+	}
+}
+
+func (ps *pathwaySelector) reselect(reason string) {
+	for i := 0; i < 2; i++ {
+		for _, id := range ps.priority {
+			if ps.failed[id] || ps.master.lookup(id, ps.key) == nil {
+				continue
+			}
+			ps.switchTo(id, reason)
+			return
+		}
+		// all pathways are failed, try them again
+		ps.failed = map[string]bool{}
+	}
+}
+
+func (ps *pathwaySelector) switchTo(pathwayID, reason string) {
+	if pathwayID == ps.current || ps.master.lookup(pathwayID, ps.key) == nil {
+		return
+	}
+	ps.logger.Info("switch pathway", zap.String("from", ps.current), zap.String("to", pathwayID), zap.String("reason", reason))
+	ps.current = pathwayID
+	ps.backup = 0
+}
+
+// steeringPoller fetches the steering manifest periodically.
+type steeringPoller struct {
+	cli      *client
+	uri      *url.URL
+	selector *pathwaySelector
+	logger   *zap.Logger
+}
+
+// Run reloads the steering manifest until ctx is canceled.
+func (sp *steeringPoller) Run(ctx context.Context) {
+	for {
+		ttl := defaultSteeringTTL
+		m, err := sp.fetch()
+		if err != nil {
+			// keep the current priority and retry after TTL
+			sp.logger.Warn("steering manifest fetch failed", zap.Stringer("uri", sp.uri), zap.Error(err))
+		} else {
+			if m.TTL > 0 {
+				ttl = time.Duration(m.TTL) * time.Second
+			}
+			if len(m.PathwayPriority) > 0 {
+				sp.selector.setPriority(m.PathwayPriority)
+			}
+			if m.ReloadURI != "" {
+				reloadURI, err := url.Parse(m.ReloadURI)
+				if err != nil {
+					sp.logger.Warn("invalid RELOAD-URI", zap.String("uri", m.ReloadURI), zap.Error(err))
+				} else {
+					sp.uri = sp.uri.ResolveReference(reloadURI)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ttl):
+		}
+	}
+}
+
+func (sp *steeringPoller) fetch() (*steeringManifest, error) {
+	u := *sp.uri
+	q := u.Query()
+	q.Set("_HLS_pathway", sp.selector.pathway())
+	u.RawQuery = q.Encode()
+
+	resp, err := sp.cli.get(u.String())
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return nil, xerrors.Errorf("cli.get failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var m steeringManifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, xerrors.Errorf("json.Decode failed: %w", err)
+	}
+	if m.Version != 1 {
+		return nil, xerrors.Errorf("unsupported steering manifest VERSION %d", m.Version)
+	}
+	return &m, nil
+}
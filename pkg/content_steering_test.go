@@ -0,0 +1,99 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+const steeringMasterPlaylist = `#EXTM3U
+#EXT-X-CONTENT-STEERING:SERVER-URI="steering.json",PATHWAY-ID="CDN-A"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2",PATHWAY-ID="CDN-A"
+https://a.example.com/720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2",PATHWAY-ID="CDN-B"
+https://b.example.com/720p.m3u8
+`
+
+func parseSteeringMaster(t *testing.T) *masterPlaylist {
+	parser := playlistParser{logger: zap.NewNop()}
+	master, err := parser.parse1st(bufio.NewScanner(strings.NewReader(steeringMasterPlaylist)))
+	assert.Nil(t, err)
+	base, _ := url.Parse("https://example.com/live/master.m3u8")
+	master.resolve(base)
+	return master
+}
+
+func TestParseContentSteering(t *testing.T) {
+	master := parseSteeringMaster(t)
+
+	assert.Equal(t, len(master.variants), 2)
+	assert.Equal(t, master.steering.serverURI.String(), "https://example.com/live/steering.json")
+	assert.Equal(t, master.steering.pathwayID, "CDN-A")
+	assert.Equal(t, master.variants[0].bandwidth, 1280000)
+	assert.Equal(t, master.variants[0].codecs, "avc1.4d401f,mp4a.40.2")
+	assert.Equal(t, master.pathways(), []string{"CDN-A", "CDN-B"})
+}
+
+func TestPathwaySelector(t *testing.T) {
+	master := parseSteeringMaster(t)
+	ps := newPathwaySelector(master, master.variants[1], zap.NewNop())
+
+	// initial PATHWAY-ID of EXT-X-CONTENT-STEERING is preferred
+	assert.Equal(t, ps.pathway(), "CDN-A")
+	assert.Equal(t, ps.variant().uri.String(), "https://a.example.com/720p.m3u8")
+	assert.True(t, ps.alternative())
+
+	ps.setPriority([]string{"CDN-B", "CDN-A"})
+	assert.Equal(t, ps.variant().uri.String(), "https://b.example.com/720p.m3u8")
+
+	ps.fail("CDN-B", fmt.Errorf("timeout"))
+	assert.Equal(t, ps.pathway(), "CDN-A")
+
+	// all pathways are failed, retry from the top priority
+	ps.fail("CDN-A", fmt.Errorf("timeout"))
+	assert.Equal(t, ps.pathway(), "CDN-B")
+}
+
+func TestSteeringPoller(t *testing.T) {
+	pathways := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathways <- r.URL.Query().Get("_HLS_pathway")
+		_, _ = w.Write([]byte(`{"VERSION":1,"TTL":300,"PATHWAY-PRIORITY":["CDN-B","CDN-A"]}`))
+	}))
+	defer ts.Close()
+
+	master := parseSteeringMaster(t)
+	ps := newPathwaySelector(master, master.variants[0], zap.NewNop())
+	u, _ := url.Parse(ts.URL + "/steering.json")
+	sp := &steeringPoller{
+		cli:      &client{httpClient: ts.Client()},
+		uri:      u,
+		selector: ps,
+		logger:   zap.NewNop(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sp.Run(ctx)
+
+	select {
+	case p := <-pathways:
+		assert.Equal(t, p, "CDN-A")
+	case <-time.After(time.Second):
+		t.Fatal("steering manifest is not requested")
+	}
+	deadline := time.Now().Add(time.Second)
+	for ps.pathway() != "CDN-B" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, ps.pathway(), "CDN-B")
+}
@@ -0,0 +1,83 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// httpOnlyPrefix marks a HttpOnly cookie in the Netscape cookies file, which is not a comment.
+const httpOnlyPrefix = "#HttpOnly_"
+
+// newCookieJar returns the cookie jar which is shared by the playlist and segment requests.
+// The cookies in the Netscape cookies file are loaded into it. i.g. the file exported by curl -c or a browser
+// "" returns nil, which sends no cookies.
+func newCookieJar(path string) (http.CookieJar, error) {
+	if path == "" {
+		return nil, nil
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cookiejar.New failed: %w", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("os.Open failed: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(text, httpOnlyPrefix)
+		if httpOnly {
+			text = strings.TrimPrefix(text, httpOnlyPrefix)
+		} else if strings.HasPrefix(text, "#") || strings.TrimSpace(text) == "" {
+			continue
+		}
+		// domain, include subdomains, path, secure, expiry, name, value
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return nil, xerrors.Errorf("line %d: invalid cookie %q", line, text)
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, xerrors.Errorf("line %d: invalid expiry %q", line, fields[4])
+		}
+		c := &http.Cookie{
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if expiry > 0 {
+			c.Expires = time.Unix(expiry, 0)
+			if c.Expires.Before(now) {
+				continue
+			}
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") || strings.HasPrefix(fields[0], ".") {
+			// a cookie without Domain is sent only to the host
+			c.Domain = host
+		}
+		u := &url.URL{Scheme: "http", Host: host, Path: c.Path}
+		if c.Secure {
+			u.Scheme = "https"
+		}
+		jar.SetCookies(u, []*http.Cookie{c})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("scanner.Err: %w", err)
+	}
+	return jar, nil
+}
@@ -0,0 +1,84 @@
+package hls_downloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func testCookieNames(t *testing.T, jar http.CookieJar, uri string) string {
+	u, err := url.Parse(uri)
+	assert.Nil(t, err)
+	var names []string
+	for _, c := range jar.Cookies(u) {
+		names = append(names, c.Name+"="+c.Value)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+func TestNewCookieJar(t *testing.T) {
+	jar, err := newCookieJar("")
+	assert.Nil(t, err)
+	assert.Nil(t, jar)
+
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	assert.Nil(t, os.WriteFile(path, []byte(strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		"",
+		".example.com\tTRUE\t/\tFALSE\t0\tdomain\t1",
+		"cdn.example.com\tFALSE\t/live\tFALSE\t4102444800\thost\t2",
+		"cdn.example.com\tFALSE\t/\tTRUE\t0\tsecure\t3",
+		"#HttpOnly_cdn.example.com\tFALSE\t/\tFALSE\t0\thttponly\t4",
+		"cdn.example.com\tFALSE\t/\tFALSE\t1\texpired\t5",
+	}, "\n")), 0644))
+	jar, err = newCookieJar(path)
+	assert.Nil(t, err)
+	assert.Equal(t, testCookieNames(t, jar, "http://cdn.example.com/live/1.ts"), "domain=1;host=2;httponly=4")
+	assert.Equal(t, testCookieNames(t, jar, "https://cdn.example.com/live/1.ts"), "domain=1;host=2;httponly=4;secure=3")
+	assert.Equal(t, testCookieNames(t, jar, "http://cdn.example.com/other/1.ts"), "domain=1;httponly=4")
+	assert.Equal(t, testCookieNames(t, jar, "http://www.example.com/"), "domain=1")
+	assert.Equal(t, testCookieNames(t, jar, "http://example.org/"), "")
+
+	assert.Nil(t, os.WriteFile(path, []byte("example.com\tTRUE\t/\n"), 0644))
+	_, err = newCookieJar(path)
+	assert.NotNil(t, err)
+}
+
+func TestClientCookies(t *testing.T) {
+	var cookies []*http.Cookie
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = r.Cookies()
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "new"})
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	assert.Nil(t, os.WriteFile(path, []byte(u.Hostname()+"\tFALSE\t/\tFALSE\t0\tauth\tabc\n"), 0644))
+	jar, err := newCookieJar(path)
+	assert.Nil(t, err)
+	config := &Config{}
+	playlistCli := config.newClient(http.DefaultTransport, jar, 0)
+	segmentCli := config.newClient(http.DefaultTransport, jar, 0)
+
+	resp, err := playlistCli.get(ts.URL + "/index.m3u8")
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, len(cookies), 1)
+	assert.Equal(t, cookies[0].Value, "abc")
+
+	// the cookie set by the playlist response is sent with the segment request
+	resp, err = segmentCli.get(ts.URL + "/1.ts")
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, len(cookies), 2)
+}
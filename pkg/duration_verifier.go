@@ -0,0 +1,221 @@
+package hls_downloader
+
+import (
+	"io"
+	"math"
+	"sort"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// durationDriftTolerance is the drift in sec which is logged as a warning.
+const durationDriftTolerance = 0.1
+
+// DurationCheck is the result of the duration verifier for a segment.
+type DurationCheck struct {
+	EXTINF float64 `json:"extinf"`
+	// Actual is the duration of the media in sec.
+	Actual float64 `json:"actual"`
+	// Drift is Actual - EXTINF.
+	Drift float64 `json:"drift"`
+	// TotalDrift is the sum of Drift from the start of the recording.
+	TotalDrift float64 `json:"total_drift"`
+}
+
+// durationVerifier compares the actual duration of each segment with EXTINF.
+// The duration is computed from PTS in MPEG-TS or from tfdt and trun in fMP4.
+type durationVerifier struct {
+	storage    Storage
+	logger     *zap.Logger
+	inits      map[string]*mp4Init
+	totalDrift float64
+}
+
+func newDurationVerifier(storage Storage, logger *zap.Logger) *durationVerifier {
+	return &durationVerifier{storage: storage, logger: logger, inits: map[string]*mp4Init{}}
+}
+
+func (v *durationVerifier) process(seg *segment, data []byte, report *SegmentReport) error {
+	if seg.key != nil && seg.key.method != "NONE" {
+		// encrypted
+		return nil
+	}
+	var actual float64
+	var err error
+	if seg.initSection != nil {
+		var init *mp4Init
+		if init, err = v.init(seg); err != nil {
+			return err
+		}
+		actual, err = fmp4Duration(data, init)
+	} else {
+		actual, err = tsDuration(data)
+	}
+	if err != nil {
+		return xerrors.Errorf("duration of segment %d: %w", seg.no, err)
+	}
+
+	drift := actual - seg.duration
+	v.totalDrift += drift
+	report.Duration = &DurationCheck{EXTINF: seg.duration, Actual: actual, Drift: drift, TotalDrift: v.totalDrift}
+	log := v.logger.Debug
+	if math.Abs(drift) > durationDriftTolerance {
+		log = v.logger.Warn
+	}
+	log("duration drift",
+		zap.Int("no", seg.no),
+		zap.Float64("extinf", seg.duration),
+		zap.Float64("actual", actual),
+		zap.Float64("drift", drift),
+		zap.Float64("totalDrift", v.totalDrift))
+	return nil
+}
+
+// init returns the init section of the segment which is downloaded into the storage.
+func (v *durationVerifier) init(seg *segment) (*mp4Init, error) {
+	m := seg.initSection
+	if init, ok := v.inits[m.uri]; ok {
+		return init, nil
+	}
+	var name string
+	var err error
+	if seg.local != nil && seg.local.initSection != nil {
+		name = seg.local.initSection.uri
+	} else if name, err = segmentName(m.uri); err != nil {
+		return nil, err
+	}
+	r, err := v.storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, xerrors.Errorf("io.ReadAll failed: %w", err)
+	}
+	init, err := parseMP4Init(b)
+	if err != nil {
+		return nil, err
+	}
+	v.inits[m.uri] = init
+	return init, nil
+}
+
+// fmp4Duration returns the duration of the video track, or the first track if there is no video track.
+func fmp4Duration(data []byte, init *mp4Init) (float64, error) {
+	fragments, err := parseMP4Fragments(data, init)
+	if err != nil {
+		return 0, err
+	}
+	track := init.tracks[0]
+	for _, t := range init.tracks {
+		if t.handler == "vide" {
+			track = t
+			break
+		}
+	}
+	var start, end uint64
+	found := false
+	for _, f := range fragments {
+		if f.track != track {
+			continue
+		}
+		e := f.baseDecodeTime
+		for _, s := range f.samples {
+			e += uint64(s.duration)
+		}
+		if !found || f.baseDecodeTime < start {
+			start = f.baseDecodeTime
+		}
+		if !found || e > end {
+			end = e
+		}
+		found = true
+	}
+	if !found {
+		return 0, xerrors.Errorf("no sample of track %d: %w", track.id, ErrInvalidMP4)
+	}
+	return float64(end-start) / float64(track.timescale), nil
+}
+
+// tsStreamTimes is the presentation times of a stream in a segment.
+type tsStreamTimes struct {
+	streamType byte
+	pts        []int64
+	// end is the end of the last audio frame.
+	end int64
+}
+
+// tsDuration returns the duration of the video stream, or an audio stream if there is no video stream.
+// The duration of the video is the last PTS - the first PTS + the frame duration.
+func tsDuration(data []byte) (float64, error) {
+	streams := map[int]*tsStreamTimes{}
+	first := int64(-1)
+	d := newTSDemuxer(func(pes *pesPacket) error {
+		if pes.pts < 0 {
+			return nil
+		}
+		if first < 0 {
+			first = pes.pts
+		}
+		// relative to the first PTS with the wrap around
+		pts := (pes.pts - first) & (1<<33 - 1)
+		if pts >= 1<<32 {
+			pts -= 1 << 33
+		}
+		s := streams[pes.pid]
+		if s == nil {
+			s = &tsStreamTimes{streamType: pes.streamType}
+			streams[pes.pid] = s
+		}
+		s.pts = append(s.pts, pts)
+		if pes.streamType == streamTypeAAC {
+			frames, _ := parseADTS(pes.data)
+			if len(frames) > 0 {
+				end := pts + int64(len(frames)*aacFrameSamples*tsTimescale/frames[0].sampleRate)
+				if end > s.end {
+					s.end = end
+				}
+			}
+		}
+		return nil
+	})
+	if err := d.feed(data); err != nil {
+		return 0, err
+	}
+	if err := d.flush(); err != nil {
+		return 0, err
+	}
+
+	var video, audio *tsStreamTimes
+	for _, s := range streams {
+		switch s.streamType {
+		case streamTypeH264, streamTypeH265:
+			video = s
+		case streamTypeAAC:
+			audio = s
+		}
+	}
+	if video != nil {
+		sort.Slice(video.pts, func(i, j int) bool { return video.pts[i] < video.pts[j] })
+		// the frame duration is the minimum interval
+		frame := int64(0)
+		for i := 1; i < len(video.pts); i++ {
+			if d := video.pts[i] - video.pts[i-1]; d > 0 && (frame == 0 || d < frame) {
+				frame = d
+			}
+		}
+		return float64(video.pts[len(video.pts)-1]-video.pts[0]+frame) / tsTimescale, nil
+	}
+	if audio != nil {
+		start := audio.pts[0]
+		for _, pts := range audio.pts {
+			if pts < start {
+				start = pts
+			}
+		}
+		return float64(audio.end-start) / tsTimescale, nil
+	}
+	return 0, xerrors.New("no video or AAC stream")
+}
@@ -0,0 +1,64 @@
+package hls_downloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func TestTSDuration(t *testing.T) {
+	// 4 frames of 3840
+	d, err := tsDuration(testTSSegment(900000, 4))
+	assert.Nil(t, err)
+	assert.Equal(t, d, 4*testFrameDuration/90000.0)
+
+	// wrap around
+	d, err = tsDuration(testTSSegment(1<<33-testFrameDuration, 4))
+	assert.Nil(t, err)
+	assert.Equal(t, d, 4*testFrameDuration/90000.0)
+
+	// audio only: 2 AAC frames of 1024 samples at 48kHz in each PES
+	m := newTestTSMuxer(map[int]byte{testAudioPID: streamTypeAAC})
+	d, err = tsDuration(m.segment(0, 4))
+	assert.Nil(t, err)
+	assert.Equal(t, d, 4*2*1024/48000.0)
+
+	_, err = tsDuration(nil)
+	assert.NotNil(t, err)
+}
+
+func TestDurationVerifier(t *testing.T) {
+	dir := t.TempDir()
+	v := newDurationVerifier(NewLocalStorage(dir), zap.NewNop())
+
+	report := &SegmentReport{}
+	assert.Nil(t, v.process(&segment{no: 1, duration: 0.2}, testTSSegment(0, 4), report))
+	actual := 4 * testFrameDuration / 90000.0
+	assert.Equal(t, *report.Duration, DurationCheck{EXTINF: 0.2, Actual: actual, Drift: actual - 0.2, TotalDrift: actual - 0.2})
+
+	// fMP4 with the init section in the output directory
+	tracks := testMP4Tracks()
+	var init bytes.Buffer
+	assert.Nil(t, writeMP4Init(&init, tracks))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "init.mp4"), init.Bytes(), 0644))
+	m := &initSection{uri: "http://example.com/live/init.mp4"}
+	report = &SegmentReport{}
+	assert.Nil(t, v.process(&segment{no: 2, duration: 1.5, initSection: m}, testFMP4Segment(t, tracks, 2, 10), report))
+	assert.Equal(t, report.Duration.Actual, 1.0)
+	assert.Equal(t, report.Duration.Drift, -0.5)
+	assert.Equal(t, report.Duration.TotalDrift, actual-0.2-0.5)
+
+	// the init section is not downloaded
+	report = &SegmentReport{}
+	m = &initSection{uri: "http://example.com/live/init2.mp4"}
+	assert.NotNil(t, v.process(&segment{no: 3, duration: 1, initSection: m}, testFMP4Segment(t, tracks, 3, 11), report))
+	assert.True(t, report.Duration == nil)
+
+	// encrypted segments are not verified
+	assert.Nil(t, v.process(&segment{no: 4, key: &segmentKey{method: "AES-128"}}, []byte{0}, report))
+	assert.True(t, report.Duration == nil)
+}
@@ -0,0 +1,290 @@
+package hls_downloader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestParseResolve(t *testing.T) {
+	tests := []struct {
+		in   string
+		key  string
+		addr string
+		err  bool
+	}{
+		{in: "example.com:127.0.0.1", key: "example.com", addr: "127.0.0.1"},
+		{in: "example.com:443:127.0.0.1", key: "example.com:443", addr: "127.0.0.1"},
+		{in: "example.com:443:[::1]", key: "example.com:443", addr: "::1"},
+		{in: "example.com:::1", key: "example.com", addr: "::1"},
+		{in: "example.com", err: true},
+		{in: ":127.0.0.1", err: true},
+		{in: "example.com:443:localhost", err: true},
+	}
+	for _, tt := range tests {
+		key, addr, err := ParseResolve(tt.in)
+		if tt.err {
+			assert.NotNil(t, err, tt.in)
+			continue
+		}
+		assert.Nil(t, err, tt.in)
+		assert.Equal(t, key, tt.key, tt.in)
+		assert.Equal(t, addr, tt.addr, tt.in)
+	}
+}
+
+// testWriteCA writes the certificate of the test server in PEM.
+func testWriteCA(t *testing.T, ts *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+	return path
+}
+
+func testGet(opt *HTTPOptions, uri string) (*http.Response, error) {
+	tr, err := newTransport(opt)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp, nil
+}
+
+func TestNewTransportTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	// the certificate of httptest is valid for example.com
+	uri := "https://example.com:" + port + "/"
+	resolve := map[string]string{"example.com:" + port: "127.0.0.1"}
+
+	_, err := testGet(&HTTPOptions{Resolve: resolve}, uri)
+	assert.NotNil(t, err)
+
+	resp, err := testGet(&HTTPOptions{CAFile: testWriteCA(t, ts), Resolve: resolve}, uri)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	_, err = newTransport(&HTTPOptions{CAFile: filepath.Join(t.TempDir(), "none.pem")})
+	assert.NotNil(t, err)
+}
+
+func TestNewTransportHTTPVersion(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	ca := testWriteCA(t, ts)
+
+	for _, tt := range []struct {
+		version    string
+		protoMajor int
+	}{
+		{version: HTTPVersionAuto, protoMajor: 2},
+		{version: HTTPVersion1, protoMajor: 1},
+		{version: HTTPVersion2, protoMajor: 2},
+	} {
+		resp, err := testGet(&HTTPOptions{CAFile: ca, HTTPVersion: tt.version}, ts.URL)
+		assert.Nil(t, err, tt.version)
+		assert.Equal(t, resp.ProtoMajor, tt.protoMajor, tt.version)
+	}
+
+	http1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer http1.Close()
+	_, err := testGet(&HTTPOptions{CAFile: testWriteCA(t, http1), HTTPVersion: HTTPVersion2}, http1.URL)
+	assert.True(t, errors.Is(err, ErrHTTP2NotNegotiated))
+
+	_, err = newTransport(&HTTPOptions{HTTPVersion: "3"})
+	assert.NotNil(t, err)
+}
+
+func TestNewTransportClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	ts.StartTLS()
+	defer ts.Close()
+	ca := testWriteCA(t, ts)
+
+	_, err = testGet(&HTTPOptions{CAFile: ca}, ts.URL)
+	assert.NotNil(t, err)
+
+	resp, err := testGet(&HTTPOptions{CAFile: ca, CertFile: certFile, KeyFile: keyFile}, ts.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
+
+// testSOCKS5Server is a SOCKS5 proxy which requires the user and the password.
+// It sends the address of each CONNECT request to addrs.
+func testSOCKS5Server(t *testing.T, user, password string, addrs chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				b := make([]byte, 2)
+				if _, err := io.ReadFull(conn, b); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, b[1])); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte{socks5Version, socks5AuthPassword})
+
+				// VER ULEN UNAME PLEN PASSWD
+				if _, err := io.ReadFull(conn, b); err != nil {
+					return
+				}
+				u := make([]byte, b[1])
+				if _, err := io.ReadFull(conn, u); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, b[:1]); err != nil {
+					return
+				}
+				p := make([]byte, b[0])
+				if _, err := io.ReadFull(conn, p); err != nil {
+					return
+				}
+				if string(u) != user || string(p) != password {
+					_, _ = conn.Write([]byte{0x01, 0x01})
+					return
+				}
+				_, _ = conn.Write([]byte{0x01, 0x00})
+
+				head := make([]byte, 4)
+				if _, err := io.ReadFull(conn, head); err != nil {
+					return
+				}
+				var host string
+				switch head[3] {
+				case socks5AddrIPv4:
+					ip := make([]byte, net.IPv4len)
+					if _, err := io.ReadFull(conn, ip); err != nil {
+						return
+					}
+					host = net.IP(ip).String()
+				case socks5AddrDomain:
+					if _, err := io.ReadFull(conn, b[:1]); err != nil {
+						return
+					}
+					name := make([]byte, b[0])
+					if _, err := io.ReadFull(conn, name); err != nil {
+						return
+					}
+					host = string(name)
+				default:
+					return
+				}
+				if _, err := io.ReadFull(conn, b); err != nil {
+					return
+				}
+				addr := net.JoinHostPort(host, strconv.Itoa(int(b[0])<<8|int(b[1])))
+				addrs <- addr
+				if host == "localhost" {
+					addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(int(b[0])<<8|int(b[1])))
+				}
+				target, err := net.Dial("tcp", addr)
+				if err != nil {
+					_, _ = conn.Write([]byte{socks5Version, 0x05, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer func() { _ = target.Close() }()
+				_, _ = conn.Write([]byte{socks5Version, 0x00, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+				go func() { _, _ = io.Copy(target, conn) }()
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestNewTransportSOCKS5(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	addrs := make(chan string, 10)
+	l := testSOCKS5Server(t, "user", "pass", addrs)
+	defer func() { _ = l.Close() }()
+
+	resp, err := testGet(&HTTPOptions{Proxy: "socks5://user:pass@" + l.Addr().String(), DisableKeepAlives: true}, ts.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, <-addrs, "127.0.0.1:"+port)
+
+	// socks5h sends the host name to the proxy
+	resp, err = testGet(&HTTPOptions{Proxy: "socks5h://user:pass@" + l.Addr().String(), DisableKeepAlives: true}, "http://localhost:"+port+"/")
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, <-addrs, "localhost:"+port)
+
+	// Resolve is applied before the proxy
+	resp, err = testGet(&HTTPOptions{
+		Proxy:             "socks5h://user:pass@" + l.Addr().String(),
+		Resolve:           map[string]string{"example.com": "127.0.0.1"},
+		DisableKeepAlives: true,
+	}, "http://example.com:"+port+"/")
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, <-addrs, "127.0.0.1:"+port)
+
+	_, err = testGet(&HTTPOptions{Proxy: "socks5://user:wrong@" + l.Addr().String()}, ts.URL)
+	assert.NotNil(t, err)
+
+	_, err = newTransport(&HTTPOptions{Proxy: "ftp://proxy"})
+	assert.NotNil(t, err)
+}
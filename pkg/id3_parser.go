@@ -0,0 +1,174 @@
+package hls_downloader
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/xerrors"
+)
+
+var ErrInvalidID3 = xerrors.New("invalid ID3")
+
+// id3HeaderSize is the size of the header and the footer of ID3v2 tag.
+const id3HeaderSize = 10
+
+// id3Frame is a frame of ID3v2 tag. see https://id3.org/id3v2.4.0-structure
+type id3Frame struct {
+	id string
+	// text is the value of the text information frames. i.g. TIT2, TXXX
+	text string
+	// description is the description of TXXX and WXXX.
+	description string
+	// url is the value of the URL link frames. i.g. WOAR, WXXX
+	url string
+	// owner is the owner identifier of PRIV.
+	owner string
+	// data is the private data of PRIV or the body of the other frames.
+	data []byte
+}
+
+// syncsafe decodes a 28 bits syncsafe integer.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// parseID3 parses ID3v2.3 and ID3v2.4 tags which are concatenated in b.
+func parseID3(b []byte) ([]*id3Frame, error) {
+	var frames []*id3Frame
+	for len(b) >= id3HeaderSize && string(b[:3]) == "ID3" {
+		version, flags := b[3], b[5]
+		if version != 3 && version != 4 {
+			return frames, xerrors.Errorf("ID3v2.%d is not supported: %w", version, ErrInvalidID3)
+		}
+		size := syncsafe(b[6:10])
+		if id3HeaderSize+size > len(b) {
+			return frames, xerrors.Errorf("tag size %d is too long: %w", size, ErrInvalidID3)
+		}
+		tag := b[id3HeaderSize : id3HeaderSize+size]
+		b = b[id3HeaderSize+size:]
+		if version == 4 && flags&0x10 != 0 {
+			// footer
+			if len(b) < id3HeaderSize {
+				return frames, xerrors.Errorf("footer is not found: %w", ErrInvalidID3)
+			}
+			b = b[id3HeaderSize:]
+		}
+		if version == 3 && flags&0x80 != 0 {
+			// unsynchronisation of the whole tag
+			tag = bytes.ReplaceAll(tag, []byte{0xff, 0x00}, []byte{0xff})
+		}
+		if flags&0x40 != 0 {
+			// extended header
+			if len(tag) < 4 {
+				return frames, xerrors.Errorf("extended header is too short: %w", ErrInvalidID3)
+			}
+			n := syncsafe(tag)
+			if version == 3 {
+				n = int(tag[0])<<24 | int(tag[1])<<16 | int(tag[2])<<8 | int(tag[3]) + 4
+			}
+			if n > len(tag) {
+				return frames, xerrors.Errorf("extended header size %d is too long: %w", n, ErrInvalidID3)
+			}
+			tag = tag[n:]
+		}
+		fs, err := parseID3Frames(tag, version)
+		frames = append(frames, fs...)
+		if err != nil {
+			return frames, err
+		}
+	}
+	return frames, nil
+}
+
+func parseID3Frames(b []byte, version byte) ([]*id3Frame, error) {
+	var frames []*id3Frame
+	for len(b) >= id3HeaderSize && b[0] != 0 {
+		id := string(b[:4])
+		size := int(b[4])<<24 | int(b[5])<<16 | int(b[6])<<8 | int(b[7])
+		if version == 4 {
+			size = syncsafe(b[4:8])
+		}
+		if id3HeaderSize+size > len(b) {
+			return frames, xerrors.Errorf("frame %s size %d is too long: %w", id, size, ErrInvalidID3)
+		}
+		frames = append(frames, newID3Frame(id, b[id3HeaderSize:id3HeaderSize+size]))
+		b = b[id3HeaderSize+size:]
+	}
+	return frames, nil
+}
+
+func newID3Frame(id string, body []byte) *id3Frame {
+	f := &id3Frame{id: id}
+	switch {
+	case id == "TXXX" && len(body) > 0:
+		var value []byte
+		f.description, value = splitID3Text(body[0], body[1:])
+		f.text = decodeID3Text(body[0], value)
+	case id[0] == 'T' && len(body) > 0:
+		f.text = decodeID3Text(body[0], body[1:])
+	case id == "WXXX" && len(body) > 0:
+		var url []byte
+		f.description, url = splitID3Text(body[0], body[1:])
+		// the URL is always ISO-8859-1
+		f.url = decodeID3Text(0, url)
+	case id[0] == 'W':
+		f.url = decodeID3Text(0, body)
+	case id == "PRIV":
+		f.owner, f.data = splitID3Text(0, body)
+	default:
+		f.data = body
+	}
+	return f
+}
+
+// splitID3Text splits the text terminated by a null character and the rest.
+func splitID3Text(encoding byte, b []byte) (string, []byte) {
+	// the terminator of UTF-16 is 2 bytes
+	terminator, step := []byte{0}, 1
+	if encoding == 1 || encoding == 2 {
+		terminator, step = []byte{0, 0}, 2
+	}
+	for i := 0; i+len(terminator) <= len(b); i += step {
+		if bytes.Equal(b[i:i+len(terminator)], terminator) {
+			return decodeID3Text(encoding, b[:i]), b[i+len(terminator):]
+		}
+	}
+	return decodeID3Text(encoding, b), nil
+}
+
+// decodeID3Text decodes the text in the encoding.
+// 0: ISO-8859-1, 1: UTF-16 with BOM, 2: UTF-16BE, 3: UTF-8
+func decodeID3Text(encoding byte, b []byte) string {
+	var s string
+	switch encoding {
+	case 1, 2:
+		bigEndian := true
+		if encoding == 1 && len(b) >= 2 {
+			if b[0] == 0xff && b[1] == 0xfe {
+				bigEndian = false
+				b = b[2:]
+			} else if b[0] == 0xfe && b[1] == 0xff {
+				b = b[2:]
+			}
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			if bigEndian {
+				u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+			} else {
+				u[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+			}
+		}
+		s = string(utf16.Decode(u))
+	case 3:
+		s = string(b)
+	default:
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		s = string(r)
+	}
+	return strings.TrimRight(s, "\x00")
+}
@@ -0,0 +1,236 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// localJournal is the state of the recording to resume it.
+const localJournal = "journal.jsonl"
+
+const (
+	// journalTypeVariant is the chosen variant.
+	journalTypeVariant = "variant"
+	// journalTypePlaylist is the count of the fetched media playlist. i.g. 2 of playlist_2.m3u8
+	journalTypePlaylist = "playlist"
+	// journalTypeResource is a downloaded key or init section.
+	journalTypeResource = "resource"
+	// journalTypeSegment is a segment added to the local media playlist.
+	journalTypeSegment = "segment"
+	// journalTypeRemoved is the segments and the resources removed by the retention.
+	journalTypeRemoved = "removed"
+)
+
+// journalEntry is a line of journal.jsonl.
+type journalEntry struct {
+	Type      string          `json:"type"`
+	Variant   string          `json:"variant,omitempty"`
+	Count     int             `json:"count,omitempty"`
+	URI       string          `json:"uri,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Segment   *journalSegment `json:"segment,omitempty"`
+	Removed   int             `json:"removed,omitempty"`
+	Resources []string        `json:"resources,omitempty"`
+}
+
+// journalSegment is a segment of the local media playlist. The URIs are the names in the storage.
+type journalSegment struct {
+	No              int                 `json:"no"`
+	Duration        float64             `json:"duration"`
+	URI             string              `json:"uri"`
+	Title           string              `json:"title,omitempty"`
+	Discontinuity   bool                `json:"discontinuity,omitempty"`
+	Gap             bool                `json:"gap,omitempty"`
+	ProgramDateTime *time.Time          `json:"program_date_time,omitempty"`
+	Key             *journalKey         `json:"key,omitempty"`
+	InitSection     *journalInitSection `json:"init_section,omitempty"`
+}
+
+type journalKey struct {
+	Method            string `json:"method"`
+	URI               string `json:"uri,omitempty"`
+	IV                string `json:"iv,omitempty"`
+	KeyFormat         string `json:"key_format,omitempty"`
+	KeyFormatVersions string `json:"key_format_versions,omitempty"`
+}
+
+type journalInitSection struct {
+	URI       string `json:"uri"`
+	ByteRange string `json:"byte_range,omitempty"`
+}
+
+func newJournalSegment(s *segment) *journalSegment {
+	js := &journalSegment{
+		No:            s.no,
+		Duration:      s.duration,
+		URI:           s.uri,
+		Title:         s.title,
+		Discontinuity: s.discontinuity,
+		Gap:           s.gap,
+	}
+	if !s.programDateTime.IsZero() {
+		pdt := s.programDateTime
+		js.ProgramDateTime = &pdt
+	}
+	if k := s.key; k != nil {
+		js.Key = &journalKey{Method: k.method, URI: k.uri, IV: k.iv, KeyFormat: k.keyFormat, KeyFormatVersions: k.keyFormatVersions}
+	}
+	if m := s.initSection; m != nil {
+		js.InitSection = &journalInitSection{URI: m.uri, ByteRange: m.byteRange}
+	}
+	return js
+}
+
+func (js *journalSegment) segment() *segment {
+	s := &segment{
+		no:            js.No,
+		duration:      js.Duration,
+		uri:           js.URI,
+		title:         js.Title,
+		discontinuity: js.Discontinuity,
+		gap:           js.Gap,
+	}
+	if js.ProgramDateTime != nil {
+		s.programDateTime = *js.ProgramDateTime
+	}
+	if k := js.Key; k != nil {
+		s.key = &segmentKey{method: k.Method, uri: k.URI, iv: k.IV, keyFormat: k.KeyFormat, keyFormatVersions: k.KeyFormatVersions}
+	}
+	if m := js.InitSection; m != nil {
+		s.initSection = &initSection{uri: m.URI, byteRange: m.ByteRange}
+	}
+	return s
+}
+
+// journalState is the state of an interrupted recording.
+type journalState struct {
+	variant string
+	// count is the count of the last fetched media playlist. -1 if no playlist is fetched.
+	count     int
+	resources map[string]string
+	// segments and discontinuitySequence are of the local media playlist.
+	segments              []*segment
+	discontinuitySequence int
+	// removed is the names of the files removed by the retention, which are not added again.
+	removed map[string]bool
+}
+
+// readJournal reads the journal in the storage. A partial last line is truncated since the process may die while writing it.
+func readJournal(s Storage, logger *zap.Logger) (*journalState, error) {
+	data, err := readFile(s, localJournal)
+	if err != nil {
+		return nil, err
+	}
+	state, complete, err := parseJournal(data)
+	if err != nil {
+		return nil, err
+	}
+	if complete < len(data) {
+		logger.Warn("partial journal entry truncated", zap.Int("line", bytes.Count(data[:complete], []byte("\n"))+1))
+		if err := putFile(s, localJournal, func(w io.Writer) error {
+			_, err := w.Write(data[:complete])
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// parseJournal replays the journal. It returns the length of the complete lines, which excludes a partial last line.
+func parseJournal(data []byte) (*journalState, int, error) {
+	state := &journalState{count: -1, resources: map[string]string{}, removed: map[string]bool{}}
+	// replay the local media playlist
+	w := &playlistWriter{}
+	r := bufio.NewReader(bytes.NewReader(data))
+	var offset int
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, xerrors.Errorf("ReadBytes failed: %w", err)
+		}
+		offset += len(b)
+		var e journalEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, 0, xerrors.Errorf("line %d: json.Unmarshal failed: %w", line, err)
+		}
+		switch e.Type {
+		case journalTypeVariant:
+			state.variant = e.Variant
+		case journalTypePlaylist:
+			state.count = e.Count
+		case journalTypeResource:
+			state.resources[e.URI] = e.Name
+			delete(state.removed, e.Name)
+		case journalTypeSegment:
+			if e.Segment != nil {
+				w.add(e.Segment.segment())
+				delete(state.removed, e.Segment.URI)
+			}
+		case journalTypeRemoved:
+			for _, seg := range w.remove(e.Removed) {
+				state.removed[seg.uri] = true
+			}
+			for remote, name := range state.resources {
+				if containsString(e.Resources, name) {
+					delete(state.resources, remote)
+				}
+			}
+			for _, name := range e.Resources {
+				state.removed[name] = true
+			}
+		}
+	}
+	state.segments = w.segments
+	state.discontinuitySequence = w.discontinuitySequence
+	return state, offset, nil
+}
+
+// recordingJournal appends the state of the recording to journal.jsonl in the storage.
+type recordingJournal struct {
+	writer *jsonLinesWriter
+}
+
+// newRecordingJournal starts a new journal. The journal of the previous recording is removed.
+func newRecordingJournal(s Storage) (*recordingJournal, error) {
+	j := resumeRecordingJournal(s)
+	if err := j.writer.reset(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// resumeRecordingJournal continues the journal.
+func resumeRecordingJournal(s Storage) *recordingJournal {
+	return &recordingJournal{writer: newJSONLinesWriter(s, localJournal)}
+}
+
+func (j *recordingJournal) variant(uri string) error {
+	return j.writer.write(&journalEntry{Type: journalTypeVariant, Variant: uri})
+}
+
+func (j *recordingJournal) playlist(count int) error {
+	return j.writer.write(&journalEntry{Type: journalTypePlaylist, Count: count})
+}
+
+func (j *recordingJournal) resource(uri, name string) error {
+	return j.writer.write(&journalEntry{Type: journalTypeResource, URI: uri, Name: name})
+}
+
+func (j *recordingJournal) segment(s *segment) error {
+	return j.writer.write(&journalEntry{Type: journalTypeSegment, Segment: newJournalSegment(s)})
+}
+
+func (j *recordingJournal) removed(n int, resources []string) error {
+	return j.writer.write(&journalEntry{Type: journalTypeRemoved, Removed: n, Resources: resources})
+}
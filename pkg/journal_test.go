@@ -0,0 +1,71 @@
+package hls_downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func TestRecordingJournal(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, localJournal), []byte("old\n"), 0644))
+	j, err := newRecordingJournal(NewLocalStorage(dir))
+	assert.Nil(t, err)
+
+	key := &segmentKey{method: "AES-128", uri: "key1", iv: "0x01"}
+	pdt := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, j.variant("https://example.com/live/720p.m3u8"))
+	assert.Nil(t, j.playlist(0))
+	assert.Nil(t, j.resource("https://example.com/live/key1", "key1"))
+	assert.Nil(t, j.resource("https://example.com/live/init.mp4", "init.mp4"))
+	assert.Nil(t, j.segment(&segment{no: 10, duration: 6, uri: "10.ts", key: key, programDateTime: pdt}))
+	assert.Nil(t, j.playlist(1))
+	assert.Nil(t, j.segment(&segment{no: 11, duration: 6, uri: "11.ts", discontinuity: true, initSection: &initSection{uri: "init.mp4"}}))
+	assert.Nil(t, j.segment(&segment{no: 12, duration: 6, uri: "12.ts", gap: true, initSection: &initSection{uri: "init.mp4"}}))
+	assert.Nil(t, j.removed(1, []string{"key1"}))
+
+	// the process died while writing
+	f, err := os.OpenFile(filepath.Join(dir, localJournal), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteString(`{"type":"segm`)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	state, err := readJournal(NewLocalStorage(dir), zap.NewNop())
+	assert.Nil(t, err)
+	assert.Equal(t, state.variant, "https://example.com/live/720p.m3u8")
+	assert.Equal(t, state.count, 1)
+	assert.Equal(t, state.resources, map[string]string{"https://example.com/live/init.mp4": "init.mp4"})
+	assert.Equal(t, len(state.segments), 2)
+	assert.Equal(t, *state.segments[0], segment{no: 11, duration: 6, uri: "11.ts", discontinuity: true, initSection: &initSection{uri: "init.mp4"}})
+	assert.True(t, state.segments[1].gap)
+	assert.Equal(t, state.discontinuitySequence, 1)
+	assert.Equal(t, state.removed, map[string]bool{"10.ts": true, "key1": true})
+
+	// the partial line is truncated, then the journal continues
+	j = resumeRecordingJournal(NewLocalStorage(dir))
+	assert.Nil(t, j.segment(&segment{no: 13, duration: 6, uri: "13.ts"}))
+	state, err = readJournal(NewLocalStorage(dir), zap.NewNop())
+	assert.Nil(t, err)
+	assert.Equal(t, len(state.segments), 3)
+
+	_, err = readJournal(NewLocalStorage(t.TempDir()), zap.NewNop())
+	assert.NotNil(t, err)
+}
+
+func TestJournalSegment(t *testing.T) {
+	s := &segment{
+		no:              1,
+		duration:        5.005,
+		uri:             "1.ts",
+		title:           "title",
+		programDateTime: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		key:             &segmentKey{method: "SAMPLE-AES", uri: "key", keyFormat: "identity", keyFormatVersions: "1"},
+		initSection:     &initSection{uri: "init.mp4", byteRange: "100@0"},
+	}
+	assert.Equal(t, newJournalSegment(s).segment(), s)
+}
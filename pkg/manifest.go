@@ -0,0 +1,221 @@
+package hls_downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// localManifest is the manifest of the recording in the storage.
+const localManifest = "manifest.json"
+
+// Manifest is the summary of a recording. It is rewritten at most every manifestWriteInterval while recording,
+// and at the end of the recording.
+type Manifest struct {
+	URI       string     `json:"uri"`
+	Variant   string     `json:"variant,omitempty"`
+	StartTime time.Time  `json:"start_time"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	// Complete is true if the manifest is finalized at the end of the recording.
+	// false means that the recording is in progress or interrupted.
+	Complete bool `json:"complete"`
+	// Segments is the segments in the local media playlist. The segments removed by the retention are not included.
+	Segments []*ManifestSegment `json:"segments"`
+	// Totals is of all the recorded segments including the removed segments.
+	Totals ManifestTotals `json:"totals"`
+}
+
+// ManifestSegment is a segment in the local media playlist.
+type ManifestSegment struct {
+	No              int        `json:"no"`
+	URI             string     `json:"uri,omitempty"`
+	Path            string     `json:"path"`
+	Size            int64      `json:"size"`
+	Duration        float64    `json:"duration"`
+	ProgramDateTime *time.Time `json:"program_date_time,omitempty"`
+	// LatencyMS is the time from the request to the end of the download.
+	LatencyMS int64  `json:"latency_ms"`
+	Status    int    `json:"status,omitempty"`
+	Retries   int    `json:"retries"`
+	SHA256    string `json:"sha256,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ManifestTotals is the totals of the segments.
+type ManifestTotals struct {
+	Segments int `json:"segments"`
+	// Duration is the duration of the recorded segments in seconds.
+	Duration float64 `json:"duration"`
+	Bytes    int64   `json:"bytes"`
+	// Gaps is the number of the media sequences which are not recorded, failed or skipped.
+	Gaps     int `json:"gaps"`
+	Failures int `json:"failures"`
+	// FailureRate is the rate of the failed downloads.
+	FailureRate float64 `json:"failure_rate"`
+	// DownloadMS is the time spent downloading the recorded segments.
+	DownloadMS int64 `json:"download_ms"`
+	// Throughput is the actual bytes per second while the segments are downloaded.
+	Throughput float64 `json:"throughput"`
+}
+
+// segmentDownload is the result of a download by segmentDownloader.
+type segmentDownload struct {
+	uri     string
+	latency time.Duration
+	status  int
+	retries int
+	size    int64
+	sha256  string
+	err     error
+}
+
+// manifestWriteInterval is the minimum interval of rewriting manifest.json while recording.
+// The segments recorded in the interval may be missing in the manifest of an interrupted recording.
+const manifestWriteInterval = 10 * time.Second
+
+// recordingManifest writes manifest.json.
+// segmentDownloader sets the results of the downloads, then streamingController adds the segments.
+type recordingManifest struct {
+	mu        sync.Mutex
+	storage   Storage
+	manifest  Manifest
+	downloads map[int]*segmentDownload
+	// written is the time of the last write.
+	written time.Time
+	now     func() time.Time
+}
+
+func newRecordingManifest(s Storage, uri string) *recordingManifest {
+	return &recordingManifest{
+		storage:   s,
+		manifest:  Manifest{URI: uri, StartTime: time.Now(), Segments: []*ManifestSegment{}},
+		downloads: map[int]*segmentDownload{},
+		now:       time.Now,
+	}
+}
+
+// resumeRecordingManifest continues the manifest of the interrupted recording.
+func resumeRecordingManifest(s Storage, uri string) (*recordingManifest, error) {
+	m := newRecordingManifest(s, uri)
+	b, err := readFile(s, localManifest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m.manifest); err != nil {
+		return nil, xerrors.Errorf("json.Unmarshal failed: %w", err)
+	}
+	m.manifest.EndTime = nil
+	m.manifest.Complete = false
+	return m, nil
+}
+
+func (m *recordingManifest) setVariant(uri string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.manifest.Variant = uri
+}
+
+// download sets the result of the download of the segment.
+func (m *recordingManifest) download(no int, d *segmentDownload) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.downloads[no] = d
+}
+
+// remove removes the segments which are removed from the local media playlist by the retention.
+// They are written with the next segment.
+func (m *recordingManifest) remove(removed []*segment) {
+	if len(removed) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nos := map[int]bool{}
+	for _, s := range removed {
+		nos[s.no] = true
+	}
+	segments := m.manifest.Segments[:0]
+	for _, s := range m.manifest.Segments {
+		if !nos[s.No] {
+			segments = append(segments, s)
+		}
+	}
+	m.manifest.Segments = segments
+}
+
+// add adds the segment in the local media playlist and writes the manifest if manifestWriteInterval has passed.
+func (m *recordingManifest) add(local *segment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &ManifestSegment{No: local.no, Path: local.uri, Duration: local.duration}
+	if !local.programDateTime.IsZero() {
+		pdt := local.programDateTime
+		s.ProgramDateTime = &pdt
+	}
+	if d, ok := m.downloads[local.no]; ok {
+		delete(m.downloads, local.no)
+		s.URI = d.uri
+		s.LatencyMS = d.latency.Milliseconds()
+		s.Status = d.status
+		s.Retries = d.retries
+		s.Size = d.size
+		s.SHA256 = d.sha256
+		if d.err != nil {
+			s.Error = d.err.Error()
+		}
+	}
+	if local.gap && s.Error == "" {
+		s.Error = "not downloaded"
+	}
+
+	t := &m.manifest.Totals
+	if n := len(m.manifest.Segments); n > 0 && local.no > m.manifest.Segments[n-1].No+1 {
+		// skipped media sequences
+		t.Gaps += local.no - m.manifest.Segments[n-1].No - 1
+	}
+	m.manifest.Segments = append(m.manifest.Segments, s)
+	t.Segments++
+	if local.gap {
+		t.Gaps++
+		t.Failures++
+	} else {
+		t.Duration += local.duration
+		t.Bytes += s.Size
+		t.DownloadMS += s.LatencyMS
+		if t.DownloadMS > 0 {
+			t.Throughput = float64(t.Bytes) * 1000 / float64(t.DownloadMS)
+		}
+	}
+	t.FailureRate = float64(t.Failures) / float64(t.Segments)
+	if now := m.now(); m.written.IsZero() || now.Sub(m.written) >= manifestWriteInterval {
+		m.written = now
+		return m.write()
+	}
+	return nil
+}
+
+// finish writes the end of the recording.
+func (m *recordingManifest) finish() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.manifest.EndTime = &now
+	m.manifest.Complete = true
+	return m.write()
+}
+
+func (m *recordingManifest) write() error {
+	return putFile(m.storage, localManifest, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(&m.manifest)
+	})
+}
@@ -0,0 +1,100 @@
+package hls_downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func testReadManifest(t *testing.T, s Storage) *Manifest {
+	b, err := readFile(s, localManifest)
+	assert.Nil(t, err)
+	var m Manifest
+	assert.Nil(t, json.Unmarshal(b, &m))
+	return &m
+}
+
+func TestRecordingManifest(t *testing.T) {
+	s := NewMemoryStorage()
+	m := newRecordingManifest(s, "http://example.com/master.m3u8")
+	// every add writes the manifest
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time {
+		now = now.Add(manifestWriteInterval)
+		return now
+	}
+	m.setVariant("http://example.com/720p.m3u8")
+
+	pdt := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	m.download(1, &segmentDownload{uri: "http://example.com/1.ts", latency: 120 * time.Millisecond, status: 200, size: 1000, sha256: "abc"})
+	assert.Nil(t, m.add(&segment{no: 1, duration: 6, uri: "1.ts", programDateTime: pdt}))
+	m.download(2, &segmentDownload{uri: "http://example.com/2.ts", status: 404, err: errors.New("statusCode: 404")})
+	assert.Nil(t, m.add(&segment{no: 2, duration: 6, uri: "2.ts", gap: true}))
+	// 3 is skipped
+	m.download(4, &segmentDownload{uri: "http://example.com/4.ts", latency: 80 * time.Millisecond, status: 200, size: 500})
+	assert.Nil(t, m.add(&segment{no: 4, duration: 4, uri: "4.ts"}))
+
+	manifest := testReadManifest(t, s)
+	assert.False(t, manifest.Complete)
+	assert.Equal(t, manifest.Variant, "http://example.com/720p.m3u8")
+	assert.Equal(t, len(manifest.Segments), 3)
+	assert.Equal(t, *manifest.Segments[0], ManifestSegment{
+		No: 1, URI: "http://example.com/1.ts", Path: "1.ts", Size: 1000, Duration: 6, ProgramDateTime: &pdt,
+		LatencyMS: 120, Status: 200, SHA256: "abc",
+	})
+	assert.Equal(t, manifest.Segments[1].Error, "statusCode: 404")
+	assert.Equal(t, manifest.Totals, ManifestTotals{
+		Segments: 3, Duration: 10, Bytes: 1500, Gaps: 2, Failures: 1, FailureRate: 1.0 / 3, DownloadMS: 200, Throughput: 7500,
+	})
+
+	assert.Nil(t, m.finish())
+	manifest = testReadManifest(t, s)
+	assert.True(t, manifest.Complete)
+	assert.NotNil(t, manifest.EndTime)
+
+	// continue after a restart
+	m, err := resumeRecordingManifest(s, "http://example.com/master.m3u8")
+	assert.Nil(t, err)
+	assert.Nil(t, m.add(&segment{no: 5, duration: 6, uri: "5.ts"}))
+	manifest = testReadManifest(t, s)
+	assert.False(t, manifest.Complete)
+	assert.True(t, manifest.EndTime == nil)
+	assert.Equal(t, len(manifest.Segments), 4)
+	assert.Equal(t, manifest.Totals.Segments, 4)
+}
+
+func TestRecordingManifestThrottle(t *testing.T) {
+	s := NewMemoryStorage()
+	m := newRecordingManifest(s, "http://example.com/master.m3u8")
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time { return now }
+
+	var segments []*segment
+	for no := 1; no <= 3; no++ {
+		seg := &segment{no: no, duration: 6, uri: fmt.Sprintf("%d.ts", no)}
+		segments = append(segments, seg)
+		assert.Nil(t, m.add(seg))
+	}
+	// only the first segment is written in the interval
+	assert.Equal(t, len(testReadManifest(t, s).Segments), 1)
+
+	// the segments removed by the retention are not written, but they are in the totals
+	m.remove(segments[:2])
+	now = now.Add(manifestWriteInterval)
+	assert.Nil(t, m.add(&segment{no: 4, duration: 6, uri: "4.ts"}))
+	manifest := testReadManifest(t, s)
+	assert.Equal(t, len(manifest.Segments), 2)
+	assert.Equal(t, manifest.Segments[0].No, 3)
+	assert.Equal(t, manifest.Totals.Segments, 4)
+
+	// the end of the recording is always written
+	assert.Nil(t, m.add(&segment{no: 5, duration: 6, uri: "5.ts"}))
+	assert.Nil(t, m.finish())
+	manifest = testReadManifest(t, s)
+	assert.True(t, manifest.Complete)
+	assert.Equal(t, len(manifest.Segments), 3)
+}
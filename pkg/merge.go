@@ -0,0 +1,187 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// MergeOptions enables concatenating the recorded segments.
+type MergeOptions struct {
+	// Output is the path of the merged file. The default is merged.ts in the output directory.
+	Output string
+	// SplitOnDiscontinuity starts a new file at each discontinuity. i.g. merged_0.ts, merged_1.ts
+	SplitOnDiscontinuity bool
+}
+
+// SkippedSegment is a segment which is not merged.
+type SkippedSegment struct {
+	No     int    `json:"no"`
+	URI    string `json:"uri,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// MergeReport is the result of merging.
+type MergeReport struct {
+	Outputs  []string         `json:"outputs"`
+	Segments int              `json:"segments"`
+	Bytes    int64            `json:"bytes"`
+	Skipped  []SkippedSegment `json:"skipped"`
+}
+
+const defaultMergeOutput = "merged.ts"
+
+// loadLocalPlaylist reads the local media playlist in the output directory.
+func loadLocalPlaylist(dir string) (*playlist, error) {
+	f, err := os.Open(filepath.Join(dir, localMediaPlaylist))
+	if err != nil {
+		return nil, xerrors.Errorf("os.Open failed: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	parser := playlistParser{logger: zap.NewNop()}
+	return parser.parse2nd(bufio.NewScanner(f))
+}
+
+// splitName returns the name of n-th file. i.g. out/merged.ts, 1 -> out/merged_1.ts
+func splitName(output string, n int) string {
+	ext := filepath.Ext(output)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(output, ext), n, ext)
+}
+
+type mergeWriter struct {
+	opt    *MergeOptions
+	output string
+	report *MergeReport
+	f      *os.File
+	init   *initSection
+	dir    string
+}
+
+// next starts a new output file.
+func (w *mergeWriter) next() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	name := w.output
+	if w.opt.SplitOnDiscontinuity {
+		name = splitName(w.output, len(w.report.Outputs))
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return xerrors.Errorf("os.Create failed: %w", err)
+	}
+	w.f = f
+	w.report.Outputs = append(w.report.Outputs, name)
+	if w.init != nil {
+		// fMP4 needs the init section at the top of each file
+		return w.writeInit(w.init)
+	}
+	return nil
+}
+
+func (w *mergeWriter) writeInit(m *initSection) error {
+	if m.byteRange != "" {
+		return xerrors.Errorf("BYTERANGE of EXT-X-MAP is not supported: %s", m.uri)
+	}
+	return w.copy(filepath.Join(w.dir, filepath.FromSlash(m.uri)))
+}
+
+func (w *mergeWriter) copy(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return xerrors.Errorf("os.Open failed: %w", err)
+	}
+	defer func() { _ = in.Close() }()
+	n, err := io.Copy(w.f, in)
+	w.report.Bytes += n
+	if err != nil {
+		return xerrors.Errorf("io.Copy failed: %w", err)
+	}
+	return nil
+}
+
+func (w *mergeWriter) close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	if err != nil {
+		return xerrors.Errorf("Close failed: %w", err)
+	}
+	return nil
+}
+
+// Merge concatenates the recorded segments in the output directory in order of the media sequence.
+// Segments which are not downloaded or can't be read are skipped and reported.
+// With SplitOnDiscontinuity, a new file is also started after skipped segments.
+func (app *App) Merge(opt *MergeOptions) (*MergeReport, error) {
+	dir := app.Config.OutputDir
+	p, err := loadLocalPlaylist(dir)
+	if err != nil {
+		return nil, err
+	}
+	output := opt.Output
+	if output == "" {
+		output = filepath.Join(dir, defaultMergeOutput)
+	}
+
+	report := &MergeReport{Outputs: []string{}, Skipped: []SkippedSegment{}}
+	w := &mergeWriter{opt: opt, output: output, report: report, dir: dir}
+	defer func() { _ = w.close() }()
+
+	prev := -1
+	missing := false
+	for _, s := range p.segments {
+		if prev >= 0 && s.no > prev+1 {
+			missing = true
+		}
+		prev = s.no
+
+		reason := ""
+		path := filepath.Join(dir, filepath.FromSlash(s.uri))
+		if s.gap {
+			reason = "not downloaded"
+		} else if s.key != nil && s.key.method != "NONE" {
+			reason = "encrypted segment is not supported"
+		} else if _, err := os.Stat(path); err != nil {
+			reason = err.Error()
+		}
+		if reason != "" {
+			report.Skipped = append(report.Skipped, SkippedSegment{No: s.no, URI: s.uri, Reason: reason})
+			missing = true
+			continue
+		}
+
+		initChanged := !sameInitSection(w.init, s.initSection)
+		w.init = s.initSection
+		if w.f == nil || (opt.SplitOnDiscontinuity && (s.discontinuity || missing)) {
+			if err := w.next(); err != nil {
+				return nil, err
+			}
+		} else if initChanged && w.init != nil {
+			if err := w.writeInit(w.init); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.copy(path); err != nil {
+			return nil, err
+		}
+		report.Segments++
+		missing = false
+	}
+	if err := w.close(); err != nil {
+		return nil, err
+	}
+	app.Logger.Info("merged",
+		zap.Strings("outputs", report.Outputs),
+		zap.Int("segments", report.Segments),
+		zap.Int("skipped", len(report.Skipped)))
+	return report, nil
+}
@@ -0,0 +1,53 @@
+package hls_downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	w := newPlaylistWriter(dir, localMediaPlaylist)
+	w.targetDuration = 6
+	w.add(&segment{no: 1, duration: 6, uri: "a.ts"})
+	w.add(&segment{no: 2, duration: 6, uri: "b.ts"})
+	w.add(&segment{no: 3, duration: 6, uri: "c.ts", gap: true})
+	w.add(&segment{no: 4, duration: 6, uri: "d.ts"})
+	w.add(&segment{no: 5, duration: 6, uri: "e.ts"})
+	w.add(&segment{no: 6, duration: 6, uri: "f.ts", discontinuity: true})
+	w.end = true
+	assert.Nil(t, w.write())
+	for _, name := range []string{"a", "b", "d", "f"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name+".ts"), []byte(name), 0644))
+	}
+
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	report, err := app.Merge(&MergeOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Outputs, []string{filepath.Join(dir, "merged.ts")})
+	assert.Equal(t, report.Segments, 4)
+	assert.Equal(t, len(report.Skipped), 2)
+	assert.Equal(t, report.Skipped[0], SkippedSegment{No: 3, URI: "c.ts", Reason: "not downloaded"})
+	assert.Equal(t, report.Skipped[1].No, 5)
+	b, err := os.ReadFile(report.Outputs[0])
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), "abdf")
+
+	output := filepath.Join(dir, "out.ts")
+	report, err = app.Merge(&MergeOptions{Output: output, SplitOnDiscontinuity: true})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Outputs, []string{
+		filepath.Join(dir, "out_0.ts"),
+		filepath.Join(dir, "out_1.ts"),
+		filepath.Join(dir, "out_2.ts"),
+	})
+	for i, exp := range []string{"ab", "d", "f"} {
+		b, err := os.ReadFile(report.Outputs[i])
+		assert.Nil(t, err)
+		assert.Equal(t, string(b), exp)
+	}
+}
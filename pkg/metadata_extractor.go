@@ -0,0 +1,96 @@
+package hls_downloader
+
+import (
+	"bytes"
+
+	"golang.org/x/xerrors"
+)
+
+// localMetadata has a line of TimedMetadata for each ID3 frame in the downloaded segments.
+const localMetadata = "metadata.jsonl"
+
+// streamTypePrivate is PES packets containing private data. ID3 is also carried in it.
+const streamTypePrivate = 0x06
+
+// TimedMetadata is an ID3 frame in a segment.
+type TimedMetadata struct {
+	// No is the number of the segment.
+	No int `json:"no"`
+	// PTS is the presentation time of the PES packet in 90kHz.
+	PTS         int64  `json:"pts"`
+	ID          string `json:"id"`
+	Text        string `json:"text,omitempty"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+// metadataExtractor extracts ID3 timed metadata from MPEG-TS segments into metadata.jsonl.
+// see https://developer.apple.com/library/archive/documentation/AudioVideo/Conceptual/HTTP_Live_Streaming_Metadata_Spec/
+type metadataExtractor struct {
+	writer *jsonLinesWriter
+}
+
+// newMetadataExtractor starts a new metadata.jsonl in the storage. The metadata of the previous recording is removed.
+func newMetadataExtractor(s Storage) (*metadataExtractor, error) {
+	e := resumeMetadataExtractor(s)
+	if err := e.writer.reset(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// resumeMetadataExtractor appends to metadata.jsonl.
+func resumeMetadataExtractor(s Storage) *metadataExtractor {
+	return &metadataExtractor{writer: newJSONLinesWriter(s, localMetadata)}
+}
+
+func (e *metadataExtractor) process(seg *segment, data []byte, report *SegmentReport) error {
+	if (seg.key != nil && seg.key.method == "AES-128") || seg.initSection != nil {
+		// encrypted or not MPEG-TS. SAMPLE-AES doesn't encrypt metadata.
+		return nil
+	}
+	metadata, err := extractMetadata(seg.no, data)
+	for _, m := range metadata {
+		if err := e.writer.write(m); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// extractMetadata returns the ID3 frames in the segment.
+func extractMetadata(no int, data []byte) ([]*TimedMetadata, error) {
+	var metadata []*TimedMetadata
+	var id3Err error
+	d := newTSDemuxer(func(pes *pesPacket) error {
+		if pes.streamType != streamTypeMetadata && !(pes.streamType == streamTypePrivate && bytes.HasPrefix(pes.data, []byte("ID3"))) {
+			return nil
+		}
+		frames, err := parseID3(pes.data)
+		if err != nil && id3Err == nil {
+			id3Err = xerrors.Errorf("parseID3 failed, pts:%d: %w", pes.pts, err)
+		}
+		for _, f := range frames {
+			metadata = append(metadata, &TimedMetadata{
+				No:          no,
+				PTS:         pes.pts,
+				ID:          f.id,
+				Text:        f.text,
+				Description: f.description,
+				URL:         f.url,
+				Owner:       f.owner,
+				Data:        f.data,
+			})
+		}
+		return nil
+	})
+	if err := d.feed(data); err != nil {
+		return metadata, err
+	}
+	if err := d.flush(); err != nil {
+		return metadata, err
+	}
+	return metadata, id3Err
+}
@@ -0,0 +1,103 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func testSyncsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+// testID3Frame returns an ID3v2.4 frame.
+func testID3Frame(id string, body []byte) []byte {
+	return append(append(append([]byte(id), testSyncsafe(len(body))...), 0, 0), body...)
+}
+
+// testID3 returns an ID3v2.4 tag.
+func testID3(frames ...[]byte) []byte {
+	var body []byte
+	for _, f := range frames {
+		body = append(body, f...)
+	}
+	// padding
+	body = append(body, 0, 0, 0, 0)
+	return append(append([]byte{'I', 'D', '3', 4, 0, 0}, testSyncsafe(len(body))...), body...)
+}
+
+func TestParseID3(t *testing.T) {
+	frames, err := parseID3(testID3(
+		testID3Frame("TIT2", append([]byte{3}, "song\x00"...)),
+		testID3Frame("TXXX", []byte{1, 0xff, 0xfe, 'k', 0, 0, 0, 0xfe, 0xff, 0, 'v'}),
+		testID3Frame("WXXX", []byte{2, 0, 'd', 0, 0, 'h', 't', 't', 'p'}),
+		testID3Frame("WOAR", []byte("http://example.com")),
+		testID3Frame("PRIV", []byte("com.apple.streaming.transportStreamTimestamp\x00\x00\x00\x00\x00\x00\x01\x00\x00")),
+		testID3Frame("APIC", []byte{1, 2}),
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, len(frames), 6)
+	assert.Equal(t, *frames[0], id3Frame{id: "TIT2", text: "song"})
+	assert.Equal(t, *frames[1], id3Frame{id: "TXXX", description: "k", text: "v"})
+	assert.Equal(t, *frames[2], id3Frame{id: "WXXX", description: "d", url: "http"})
+	assert.Equal(t, *frames[3], id3Frame{id: "WOAR", url: "http://example.com"})
+	assert.Equal(t, frames[4].owner, "com.apple.streaming.transportStreamTimestamp")
+	assert.Equal(t, frames[4].data, []byte{0, 0, 0, 0, 0, 1, 0, 0})
+	assert.Equal(t, frames[5].data, []byte{1, 2})
+
+	// ID3v2.3 with ISO-8859-1
+	tag := []byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, 12, 'T', 'I', 'T', '2', 0, 0, 0, 2, 0, 0, 0, 0xe9}
+	frames, err = parseID3(tag)
+	assert.Nil(t, err)
+	assert.Equal(t, frames[0].text, "é")
+
+	_, err = parseID3([]byte{'I', 'D', '3', 2, 0, 0, 0, 0, 0, 0})
+	assert.NotNil(t, err)
+	_, err = parseID3(testID3(testID3Frame("TIT2", []byte{3, 'a'}))[:15])
+	assert.NotNil(t, err)
+}
+
+func TestMetadataExtractor(t *testing.T) {
+	dir := t.TempDir()
+	// the metadata of the previous recording is removed
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, localMetadata), []byte("{\"no\":100}\n"), 0644))
+	e, err := newMetadataExtractor(NewLocalStorage(dir))
+	assert.Nil(t, err)
+
+	m := newTestTSMuxer(map[int]byte{testVideoPID: streamTypeH264, testAudioPID: streamTypeAAC, testMetadataPID: streamTypeMetadata})
+	seg := m.segment(0, 2)
+	m.out = nil
+	m.pes(testMetadataPID, 90000, 90000, testID3(testID3Frame("TIT2", append([]byte{3}, "song"...))))
+	m.pes(testMetadataPID, 180000, 180000, testID3(testID3Frame("TIT2", []byte{3})))
+	seg = append(seg, m.out...)
+	assert.Nil(t, e.process(&segment{no: 7}, seg, &SegmentReport{}))
+
+	// broken ID3 in a private PES
+	m = newTestTSMuxer(map[int]byte{testMetadataPID: streamTypePrivate})
+	m.tables()
+	m.pes(testMetadataPID, 270000, 270000, []byte("ID3\x04\x00\x00\x00\x00\x00\x7f"))
+	m.pes(testMetadataPID, 270000, 270000, []byte("not ID3"))
+	assert.NotNil(t, e.process(&segment{no: 8}, m.out, &SegmentReport{}))
+
+	// encrypted segments are skipped
+	assert.Nil(t, e.process(&segment{no: 9, key: &segmentKey{method: "AES-128"}}, []byte{0}, &SegmentReport{}))
+
+	f, err := os.Open(filepath.Join(dir, localMetadata))
+	assert.Nil(t, err)
+	defer func() { _ = f.Close() }()
+	var metadata []TimedMetadata
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var m TimedMetadata
+		assert.Nil(t, json.Unmarshal(s.Bytes(), &m))
+		metadata = append(metadata, m)
+	}
+	assert.Equal(t, metadata, []TimedMetadata{
+		{No: 7, PTS: 90000, ID: "TIT2", Text: "song"},
+		{No: 7, PTS: 180000, ID: "TIT2"},
+	})
+}
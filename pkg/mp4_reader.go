@@ -0,0 +1,335 @@
+package hls_downloader
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+var ErrInvalidMP4 = xerrors.New("invalid mp4")
+
+// mp4RawBox is a box in a buffer. offset is the position of the box header.
+type mp4RawBox struct {
+	typ     string
+	offset  int
+	header  int
+	payload []byte
+}
+
+// readMP4Boxes returns the boxes in b.
+func readMP4Boxes(b []byte) ([]mp4RawBox, error) {
+	var boxes []mp4RawBox
+	for offset := 0; offset < len(b); {
+		if len(b)-offset < 8 {
+			return nil, xerrors.Errorf("box header at %d: %w", offset, ErrInvalidMP4)
+		}
+		size := uint64(binary.BigEndian.Uint32(b[offset:]))
+		header := 8
+		switch size {
+		case 0:
+			// to the end of the file
+			size = uint64(len(b) - offset)
+		case 1:
+			if len(b)-offset < 16 {
+				return nil, xerrors.Errorf("box header at %d: %w", offset, ErrInvalidMP4)
+			}
+			size = binary.BigEndian.Uint64(b[offset+8:])
+			header = 16
+		}
+		if size < uint64(header) || size > uint64(len(b)-offset) {
+			return nil, xerrors.Errorf("box size %d at %d: %w", size, offset, ErrInvalidMP4)
+		}
+		boxes = append(boxes, mp4RawBox{
+			typ:     string(b[offset+4 : offset+8]),
+			offset:  offset,
+			header:  header,
+			payload: b[offset+header : offset+int(size)],
+		})
+		offset += int(size)
+	}
+	return boxes, nil
+}
+
+// findMP4Box returns the payload of the first box in the path. i.g. moov, trak, mdia
+func findMP4Box(b []byte, path ...string) []byte {
+	boxes, err := readMP4Boxes(b)
+	if err != nil {
+		return nil
+	}
+	for _, box := range boxes {
+		if box.typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return box.payload
+		}
+		return findMP4Box(box.payload, path[1:]...)
+	}
+	return nil
+}
+
+// mp4TrackDefaults is trex or the defaults of tfhd.
+type mp4TrackDefaults struct {
+	duration uint32
+	size     uint32
+	flags    uint32
+}
+
+// mp4Init is the init section of fMP4.
+type mp4Init struct {
+	tracks   []*mp4Track
+	defaults map[uint32]*mp4TrackDefaults
+}
+
+func (m *mp4Init) track(id uint32) *mp4Track {
+	for _, t := range m.tracks {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// parseMP4Init parses the tracks and trex of moov.
+func parseMP4Init(b []byte) (*mp4Init, error) {
+	moov := findMP4Box(b, "moov")
+	if moov == nil {
+		return nil, xerrors.Errorf("moov is not found: %w", ErrInvalidMP4)
+	}
+	boxes, err := readMP4Boxes(moov)
+	if err != nil {
+		return nil, err
+	}
+	m := &mp4Init{defaults: map[uint32]*mp4TrackDefaults{}}
+	for _, box := range boxes {
+		switch box.typ {
+		case "trak":
+			t, err := parseMP4Track(box.payload)
+			if err != nil {
+				return nil, err
+			}
+			m.tracks = append(m.tracks, t)
+		case "mvex":
+			for _, trex := range mustReadMP4Boxes(box.payload) {
+				if trex.typ != "trex" || len(trex.payload) < 24 {
+					continue
+				}
+				p := trex.payload
+				m.defaults[binary.BigEndian.Uint32(p[4:])] = &mp4TrackDefaults{
+					duration: binary.BigEndian.Uint32(p[12:]),
+					size:     binary.BigEndian.Uint32(p[16:]),
+					flags:    binary.BigEndian.Uint32(p[20:]),
+				}
+			}
+		}
+	}
+	if len(m.tracks) == 0 {
+		return nil, xerrors.Errorf("trak is not found: %w", ErrInvalidMP4)
+	}
+	return m, nil
+}
+
+func mustReadMP4Boxes(b []byte) []mp4RawBox {
+	boxes, _ := readMP4Boxes(b)
+	return boxes
+}
+
+func parseMP4Track(trak []byte) (*mp4Track, error) {
+	t := &mp4Track{}
+	tkhd := findMP4Box(trak, "tkhd")
+	mdhd := findMP4Box(trak, "mdia", "mdhd")
+	hdlr := findMP4Box(trak, "mdia", "hdlr")
+	stsd := findMP4Box(trak, "mdia", "minf", "stbl", "stsd")
+	if len(tkhd) < 84 || len(mdhd) < 24 || len(hdlr) < 12 || len(stsd) < 16 {
+		return nil, xerrors.Errorf("trak: %w", ErrInvalidMP4)
+	}
+	if tkhd[0] == 1 {
+		t.id = binary.BigEndian.Uint32(tkhd[20:])
+	} else {
+		t.id = binary.BigEndian.Uint32(tkhd[12:])
+	}
+	t.width = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16)
+	t.height = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16)
+	if mdhd[0] == 1 {
+		t.timescale = binary.BigEndian.Uint32(mdhd[20:])
+	} else {
+		t.timescale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+	if t.timescale == 0 {
+		return nil, xerrors.Errorf("timescale of track %d: %w", t.id, ErrInvalidMP4)
+	}
+	t.handler = string(hdlr[8:12])
+	// the first sample entry
+	entries, err := readMP4Boxes(stsd[8:])
+	if err != nil || len(entries) == 0 {
+		return nil, xerrors.Errorf("stsd of track %d: %w", t.id, ErrInvalidMP4)
+	}
+	e := entries[0]
+	t.sampleEntry = stsd[8+e.offset : 8+e.offset+e.header+len(e.payload)]
+	return t, nil
+}
+
+// tfhd flags. see ISO/IEC 14496-12 8.8.7
+const (
+	tfhdBaseDataOffset         = 0x000001
+	tfhdSampleDescriptionIndex = 0x000002
+	tfhdDefaultSampleDuration  = 0x000008
+	tfhdDefaultSampleSize      = 0x000010
+	tfhdDefaultSampleFlags     = 0x000020
+)
+
+// trun flags. see ISO/IEC 14496-12 8.8.8
+const (
+	trunDataOffset                  = 0x000001
+	trunFirstSampleFlags            = 0x000004
+	trunSampleDuration              = 0x000100
+	trunSampleSize                  = 0x000200
+	trunSampleFlags                 = 0x000400
+	trunSampleCompositionTimeOffset = 0x000800
+)
+
+// mp4SampleIsNonSync is sample_is_non_sync_sample of the sample flags.
+const mp4SampleIsNonSync = 0x00010000
+
+// parseMP4Fragments parses moof and returns the samples and the data of each traf.
+func parseMP4Fragments(b []byte, m *mp4Init) ([]*mp4Fragment, error) {
+	boxes, err := readMP4Boxes(b)
+	if err != nil {
+		return nil, err
+	}
+	var fragments []*mp4Fragment
+	for _, moof := range boxes {
+		if moof.typ != "moof" {
+			continue
+		}
+		for _, traf := range mustReadMP4Boxes(moof.payload) {
+			if traf.typ != "traf" {
+				continue
+			}
+			f, err := parseMP4TrackFragment(b, moof.offset, traf.payload, m)
+			if err != nil {
+				return nil, err
+			}
+			fragments = append(fragments, f)
+		}
+	}
+	return fragments, nil
+}
+
+type mp4FieldReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *mp4FieldReader) u32() uint32 {
+	if r.pos+4 > len(r.b) {
+		r.err = ErrInvalidMP4
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *mp4FieldReader) u64() uint64 {
+	return uint64(r.u32())<<32 | uint64(r.u32())
+}
+
+func parseMP4TrackFragment(file []byte, moofOffset int, traf []byte, m *mp4Init) (*mp4Fragment, error) {
+	tfhd := findMP4Box(traf, "tfhd")
+	if tfhd == nil {
+		return nil, xerrors.Errorf("tfhd is not found: %w", ErrInvalidMP4)
+	}
+	r := &mp4FieldReader{b: tfhd}
+	flags := r.u32() & 0xffffff
+	id := r.u32()
+	track := m.track(id)
+	if track == nil {
+		return nil, xerrors.Errorf("track %d is not in the init section: %w", id, ErrInvalidMP4)
+	}
+	defaults := mp4TrackDefaults{}
+	if d, ok := m.defaults[id]; ok {
+		defaults = *d
+	}
+	base := uint64(moofOffset)
+	if flags&tfhdBaseDataOffset != 0 {
+		base = r.u64()
+	}
+	if flags&tfhdSampleDescriptionIndex != 0 {
+		r.u32()
+	}
+	if flags&tfhdDefaultSampleDuration != 0 {
+		defaults.duration = r.u32()
+	}
+	if flags&tfhdDefaultSampleSize != 0 {
+		defaults.size = r.u32()
+	}
+	if flags&tfhdDefaultSampleFlags != 0 {
+		defaults.flags = r.u32()
+	}
+	if r.err != nil {
+		return nil, xerrors.Errorf("tfhd: %w", r.err)
+	}
+
+	f := &mp4Fragment{track: track}
+	if tfdt := findMP4Box(traf, "tfdt"); tfdt != nil {
+		r := &mp4FieldReader{b: tfdt}
+		if r.u32()>>24 == 1 {
+			f.baseDecodeTime = r.u64()
+		} else {
+			f.baseDecodeTime = uint64(r.u32())
+		}
+		if r.err != nil {
+			return nil, xerrors.Errorf("tfdt: %w", r.err)
+		}
+	}
+
+	offset := base
+	for _, trun := range mustReadMP4Boxes(traf) {
+		if trun.typ != "trun" {
+			continue
+		}
+		r := &mp4FieldReader{b: trun.payload}
+		flags := r.u32() & 0xffffff
+		count := r.u32()
+		if flags&trunDataOffset != 0 {
+			offset = base + uint64(int32(r.u32()))
+		}
+		firstFlags, hasFirstFlags := uint32(0), flags&trunFirstSampleFlags != 0
+		if hasFirstFlags {
+			firstFlags = r.u32()
+		}
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			s := mp4Sample{duration: defaults.duration, size: defaults.size}
+			sampleFlags := defaults.flags
+			if i == 0 && hasFirstFlags {
+				sampleFlags = firstFlags
+			}
+			if flags&trunSampleDuration != 0 {
+				s.duration = r.u32()
+			}
+			if flags&trunSampleSize != 0 {
+				s.size = r.u32()
+			}
+			if flags&trunSampleFlags != 0 {
+				sampleFlags = r.u32()
+			}
+			if flags&trunSampleCompositionTimeOffset != 0 {
+				// unsigned in version 0, but it never exceeds int32
+				s.cto = int32(r.u32())
+			}
+			s.sync = sampleFlags&mp4SampleIsNonSync == 0
+			if offset+uint64(s.size) > uint64(len(file)) {
+				return nil, xerrors.Errorf("sample data of track %d: %w", id, ErrInvalidMP4)
+			}
+			f.samples = append(f.samples, s)
+			f.data = append(f.data, file[offset:offset+uint64(s.size)]...)
+			offset += uint64(s.size)
+		}
+		if r.err != nil {
+			return nil, xerrors.Errorf("trun: %w", r.err)
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,447 @@
+package hls_downloader
+
+import (
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// see ISO/IEC 14496-12
+const (
+	mp4MovieTimescale = 1000
+	// mp4LanguageUnd is the packed ISO-639-2/T language code "und".
+	mp4LanguageUnd = 0x55c4
+
+	mp4SampleFlagsSync    = 0x02000000
+	mp4SampleFlagsNonSync = 0x01010000
+)
+
+func mp4Box(typ string, children ...[]byte) []byte {
+	size := 8
+	for _, c := range children {
+		size += len(c)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, c := range children {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, children ...[]byte) []byte {
+	return mp4Box(typ, append([][]byte{u32(uint32(version)<<24 | flags&0xffffff)}, children...)...)
+}
+
+func u8(v uint8) []byte { return []byte{v} }
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func zeros(n int) []byte { return make([]byte, n) }
+
+type mp4Sample struct {
+	size     uint32
+	duration uint32
+	// cto is the composition time offset. (PTS - DTS)
+	cto    int32
+	sync   bool
+	offset int64
+}
+
+// mp4Track is a track of MP4 with the samples in the media timescale.
+type mp4Track struct {
+	id        uint32
+	handler   string
+	timescale uint32
+	width     int
+	height    int
+	// sampleEntry is the raw box in stsd. i.g. avc1, hvc1, mp4a
+	sampleEntry []byte
+	samples     []mp4Sample
+	// startTime is the presentation time of the first sample in the movie timescale.
+	// An empty edit is inserted to delay the track.
+	startTime int64
+}
+
+func (t *mp4Track) duration() uint64 {
+	var d uint64
+	for _, s := range t.samples {
+		d += uint64(s.duration)
+	}
+	return d
+}
+
+func (t *mp4Track) movieDuration() uint64 {
+	return t.duration() * mp4MovieTimescale / uint64(t.timescale)
+}
+
+func mp4FileType(major string, brands ...string) []byte {
+	children := [][]byte{[]byte(major), u32(0)}
+	for _, b := range brands {
+		children = append(children, []byte(b))
+	}
+	return mp4Box("ftyp", children...)
+}
+
+var mp4Matrix = [][]byte{u32(0x00010000), u32(0), u32(0), u32(0), u32(0x00010000), u32(0), u32(0), u32(0), u32(0x40000000)}
+
+func mp4MovieHeader(duration uint64, nextTrackID uint32) []byte {
+	children := [][]byte{u64(0), u64(0), u32(mp4MovieTimescale), u64(duration), u32(0x00010000), u16(0x0100), zeros(10)}
+	children = append(children, mp4Matrix...)
+	children = append(children, zeros(24), u32(nextTrackID))
+	return mp4FullBox("mvhd", 1, 0, children...)
+}
+
+func (t *mp4Track) header(duration uint64) []byte {
+	volume := uint16(0)
+	if t.handler == "soun" {
+		volume = 0x0100
+	}
+	children := [][]byte{u64(0), u64(0), u32(t.id), u32(0), u64(duration), zeros(8), u16(0), u16(0), u16(volume), u16(0)}
+	children = append(children, mp4Matrix...)
+	children = append(children, u32(uint32(t.width)<<16), u32(uint32(t.height)<<16))
+	// track_enabled | track_in_movie
+	return mp4FullBox("tkhd", 1, 3, children...)
+}
+
+// editList returns edts to align the tracks and to remove the composition offset of the first sample.
+func (t *mp4Track) editList() []byte {
+	var entries [][]byte
+	if t.startTime > 0 {
+		entries = append(entries, u64(uint64(t.startTime)), u64(0xffffffffffffffff), u32(0x00010000))
+	}
+	mediaTime := int64(0)
+	if len(t.samples) > 0 {
+		mediaTime = int64(t.samples[0].cto)
+	}
+	if len(entries) == 0 && mediaTime == 0 {
+		return nil
+	}
+	entries = append(entries, u64(t.movieDuration()), u64(uint64(mediaTime)), u32(0x00010000))
+	return mp4Box("edts", mp4FullBox("elst", 1, 0, append([][]byte{u32(uint32(len(entries) / 3))}, entries...)...))
+}
+
+func (t *mp4Track) mediaHeader(duration uint64) []byte {
+	return mp4FullBox("mdhd", 1, 0, u64(0), u64(0), u32(t.timescale), u64(duration), u16(mp4LanguageUnd), u16(0))
+}
+
+func (t *mp4Track) handlerBox() []byte {
+	name := "VideoHandler"
+	if t.handler == "soun" {
+		name = "SoundHandler"
+	}
+	return mp4FullBox("hdlr", 0, 0, u32(0), []byte(t.handler), zeros(12), []byte(name+"\x00"))
+}
+
+func (t *mp4Track) mediaInformationHeader() []byte {
+	if t.handler == "soun" {
+		return mp4FullBox("smhd", 0, 0, u16(0), u16(0))
+	}
+	return mp4FullBox("vmhd", 0, 1, zeros(8))
+}
+
+func mp4DataInformation() []byte {
+	// the media data is in the same file
+	return mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+}
+
+// sampleTable returns stbl. Each sample is a chunk in the progressive MP4. samples is empty in fMP4.
+func (t *mp4Track) sampleTable() []byte {
+	stsd := mp4FullBox("stsd", 0, 0, u32(1), t.sampleEntry)
+
+	var stts [][]byte
+	var ctts [][]byte
+	var stss [][]byte
+	var stsz [][]byte
+	var offsets [][]byte
+	hasCTO := false
+	large := false
+	for i, s := range t.samples {
+		if n := len(stts); n > 0 && binary.BigEndian.Uint32(stts[n-1][4:]) == s.duration {
+			binary.BigEndian.PutUint32(stts[n-1], binary.BigEndian.Uint32(stts[n-1])+1)
+		} else {
+			stts = append(stts, append(u32(1), u32(s.duration)...))
+		}
+		if n := len(ctts); n > 0 && int32(binary.BigEndian.Uint32(ctts[n-1][4:])) == s.cto {
+			binary.BigEndian.PutUint32(ctts[n-1], binary.BigEndian.Uint32(ctts[n-1])+1)
+		} else {
+			ctts = append(ctts, append(u32(1), u32(uint32(s.cto))...))
+		}
+		if s.cto != 0 {
+			hasCTO = true
+		}
+		if s.sync {
+			stss = append(stss, u32(uint32(i+1)))
+		}
+		stsz = append(stsz, u32(s.size))
+		if s.offset > 0xffffffff {
+			large = true
+		}
+	}
+	for _, s := range t.samples {
+		if large {
+			offsets = append(offsets, u64(uint64(s.offset)))
+		} else {
+			offsets = append(offsets, u32(uint32(s.offset)))
+		}
+	}
+
+	children := [][]byte{
+		stsd,
+		mp4FullBox("stts", 0, 0, append([][]byte{u32(uint32(len(stts)))}, stts...)...),
+	}
+	if hasCTO {
+		children = append(children, mp4FullBox("ctts", 1, 0, append([][]byte{u32(uint32(len(ctts)))}, ctts...)...))
+	}
+	if len(stss) > 0 && len(stss) < len(t.samples) {
+		children = append(children, mp4FullBox("stss", 0, 0, append([][]byte{u32(uint32(len(stss)))}, stss...)...))
+	}
+	stsc := [][]byte{u32(0)}
+	if len(t.samples) > 0 {
+		stsc = [][]byte{u32(1), u32(1), u32(1), u32(1)}
+	}
+	children = append(children,
+		mp4FullBox("stsc", 0, 0, stsc...),
+		mp4FullBox("stsz", 0, 0, append([][]byte{u32(0), u32(uint32(len(t.samples)))}, stsz...)...))
+	if large {
+		children = append(children, mp4FullBox("co64", 0, 0, append([][]byte{u32(uint32(len(offsets)))}, offsets...)...))
+	} else {
+		children = append(children, mp4FullBox("stco", 0, 0, append([][]byte{u32(uint32(len(offsets)))}, offsets...)...))
+	}
+	return mp4Box("stbl", children...)
+}
+
+func (t *mp4Track) box(fragmented bool) []byte {
+	duration := t.duration()
+	movieDuration := t.movieDuration()
+	children := [][]byte{t.header(movieDuration)}
+	if !fragmented {
+		if edts := t.editList(); edts != nil {
+			children = append(children, edts)
+		}
+	}
+	children = append(children, mp4Box("mdia",
+		t.mediaHeader(duration),
+		t.handlerBox(),
+		mp4Box("minf", t.mediaInformationHeader(), mp4DataInformation(), t.sampleTable())))
+	return mp4Box("trak", children...)
+}
+
+func mp4Movie(tracks []*mp4Track, fragmented bool) []byte {
+	var duration uint64
+	for _, t := range tracks {
+		if d := uint64(t.startTime) + t.movieDuration(); d > duration {
+			duration = d
+		}
+	}
+	if fragmented {
+		duration = 0
+	}
+	children := [][]byte{mp4MovieHeader(duration, uint32(len(tracks)+1))}
+	for _, t := range tracks {
+		children = append(children, t.box(fragmented))
+	}
+	if fragmented {
+		var trex [][]byte
+		for _, t := range tracks {
+			trex = append(trex, mp4FullBox("trex", 0, 0, u32(t.id), u32(1), u32(0), u32(0), u32(0)))
+		}
+		children = append(children, mp4Box("mvex", trex...))
+	}
+	return mp4Box("moov", children...)
+}
+
+// progressiveMP4Writer writes samples into mdat and writes moov at the end.
+type progressiveMP4Writer struct {
+	w         io.WriteSeeker
+	tracks    []*mp4Track
+	mdatStart int64
+	pos       int64
+}
+
+func newProgressiveMP4Writer(w io.WriteSeeker, tracks []*mp4Track) (*progressiveMP4Writer, error) {
+	ftyp := mp4FileType("isom", "isom", "iso2", "avc1", "mp41")
+	// mdat with largesize which is fixed in close
+	mdat := append(u32(1), append([]byte("mdat"), u64(0)...)...)
+	if _, err := w.Write(append(ftyp, mdat...)); err != nil {
+		return nil, xerrors.Errorf("Write failed: %w", err)
+	}
+	start := int64(len(ftyp))
+	return &progressiveMP4Writer{w: w, tracks: tracks, mdatStart: start, pos: start + int64(len(mdat))}, nil
+}
+
+func (w *progressiveMP4Writer) writeSample(t *mp4Track, s mp4Sample, data []byte) error {
+	s.offset = w.pos
+	s.size = uint32(len(data))
+	if _, err := w.w.Write(data); err != nil {
+		return xerrors.Errorf("Write failed: %w", err)
+	}
+	w.pos += int64(len(data))
+	t.samples = append(t.samples, s)
+	return nil
+}
+
+func (w *progressiveMP4Writer) close() error {
+	if _, err := w.w.Seek(w.mdatStart+8, io.SeekStart); err != nil {
+		return xerrors.Errorf("Seek failed: %w", err)
+	}
+	if _, err := w.w.Write(u64(uint64(w.pos - w.mdatStart))); err != nil {
+		return xerrors.Errorf("Write failed: %w", err)
+	}
+	if _, err := w.w.Seek(w.pos, io.SeekStart); err != nil {
+		return xerrors.Errorf("Seek failed: %w", err)
+	}
+	if _, err := w.w.Write(mp4Movie(w.tracks, false)); err != nil {
+		return xerrors.Errorf("Write failed: %w", err)
+	}
+	return nil
+}
+
+// mp4Fragment is the samples of a track in a fragment.
+type mp4Fragment struct {
+	track *mp4Track
+	// baseDecodeTime is the decode time of the first sample in the media timescale.
+	baseDecodeTime uint64
+	samples        []mp4Sample
+	data           []byte
+}
+
+// writeMP4Init writes the init section of fMP4.
+func writeMP4Init(w io.Writer, tracks []*mp4Track) error {
+	ftyp := mp4FileType("iso6", "iso6", "cmfc", "mp41")
+	if _, err := w.Write(append(ftyp, mp4Movie(tracks, true)...)); err != nil {
+		return xerrors.Errorf("Write failed: %w", err)
+	}
+	return nil
+}
+
+func (f *mp4Fragment) trackFragment(dataOffset uint32) []byte {
+	// data-offset | sample-duration | sample-size | sample-flags | sample-composition-time-offsets
+	runs := [][]byte{u32(uint32(len(f.samples))), u32(dataOffset)}
+	for _, s := range f.samples {
+		flags := uint32(mp4SampleFlagsNonSync)
+		if s.sync {
+			flags = mp4SampleFlagsSync
+		}
+		runs = append(runs, u32(s.duration), u32(s.size), u32(flags), u32(uint32(s.cto)))
+	}
+	return mp4Box("traf",
+		// default-base-is-moof
+		mp4FullBox("tfhd", 0, 0x020000, u32(f.track.id)),
+		mp4FullBox("tfdt", 1, 0, u64(f.baseDecodeTime)),
+		mp4FullBox("trun", 1, 0x000f01, runs...))
+}
+
+// writeMP4Fragment writes moof and mdat.
+func writeMP4Fragment(w io.Writer, sequence uint32, fragments []*mp4Fragment) error {
+	build := func(offsets []uint32) []byte {
+		children := [][]byte{mp4FullBox("mfhd", 0, 0, u32(sequence))}
+		for i, f := range fragments {
+			children = append(children, f.trackFragment(offsets[i]))
+		}
+		return mp4Box("moof", children...)
+	}
+	offsets := make([]uint32, len(fragments))
+	size := uint32(len(build(offsets))) + 8
+	var data [][]byte
+	for i, f := range fragments {
+		offsets[i] = size
+		size += uint32(len(f.data))
+		data = append(data, f.data)
+	}
+	if _, err := w.Write(append(build(offsets), mp4Box("mdat", data...)...)); err != nil {
+		return xerrors.Errorf("Write failed: %w", err)
+	}
+	return nil
+}
+
+// avcSampleEntry returns avc1 box. see ISO/IEC 14496-15 5.4.2
+func avcSampleEntry(sps, pps []byte, info *videoInfo) []byte {
+	avcC := mp4Box("avcC", u8(1), sps[1:4], u8(0xff), u8(0xe1), u16(uint16(len(sps))), sps, u8(1), u16(uint16(len(pps))), pps)
+	return visualSampleEntry("avc1", info, avcC)
+}
+
+// hevcSampleEntry returns hvc1 box. see ISO/IEC 14496-15 8.4.1
+func hevcSampleEntry(vps, sps, pps []byte, info *h265SPS) []byte {
+	nesting := 0
+	if info.temporalIDNesting {
+		nesting = 1
+	}
+	array := func(typ int, nalu []byte) []byte {
+		return append([]byte{byte(0x80 | typ)}, append(u16(1), append(u16(uint16(len(nalu))), nalu...)...)...)
+	}
+	hvcC := mp4Box("hvcC",
+		u8(1),
+		info.generalProfileTierLevel,
+		u16(0xf000),
+		u8(0xfc),
+		u8(byte(0xfc|info.chromaFormat)),
+		u8(byte(0xf8|(info.bitDepthLuma-8))),
+		u8(byte(0xf8|(info.bitDepthChroma-8))),
+		u16(0),
+		u8(byte(info.maxSubLayers<<3|nesting<<2|3)),
+		u8(3),
+		array(h265NALVPS, vps),
+		array(h265NALSPS, sps),
+		array(h265NALPPS, pps))
+	return visualSampleEntry("hvc1", &info.videoInfo, hvcC)
+}
+
+func visualSampleEntry(typ string, info *videoInfo, config []byte) []byte {
+	return mp4Box(typ,
+		zeros(6), u16(1),
+		zeros(16),
+		u16(uint16(info.width)), u16(uint16(info.height)),
+		u32(0x00480000), u32(0x00480000),
+		u32(0), u16(1),
+		zeros(32),
+		u16(0x0018), u16(0xffff),
+		config)
+}
+
+// aacSampleEntry returns mp4a box. see ISO/IEC 14496-14 5.6
+func aacSampleEntry(f *adtsFrame) []byte {
+	descriptor := func(tag byte, children ...[]byte) []byte {
+		var b []byte
+		for _, c := range children {
+			b = append(b, c...)
+		}
+		return append([]byte{tag, byte(len(b))}, b...)
+	}
+	asc := f.audioSpecificConfig()
+	// the sample rate is 16.16 fixed point. A rate which doesn't fit is 0, then AudioSpecificConfig is used. i.g. 96kHz
+	sampleRate := uint32(f.sampleRate)
+	if sampleRate > 0xffff {
+		sampleRate = 0
+	}
+	esds := mp4FullBox("esds", 0, 0,
+		descriptor(0x03, u16(0), u8(0),
+			descriptor(0x04, u8(0x40), u8(0x15), zeros(3), u32(0), u32(0),
+				descriptor(0x05, asc)),
+			descriptor(0x06, u8(0x02))))
+	return mp4Box("mp4a",
+		zeros(6), u16(1),
+		zeros(8),
+		u16(uint16(f.channels)), u16(16),
+		u16(0), u16(0),
+		u32(sampleRate<<16),
+		esds)
+}
@@ -0,0 +1,193 @@
+package hls_downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultSegmentNaming keeps the basenames of the URIs.
+const DefaultSegmentNaming = "{basename}"
+
+// pdtNamingFormat is the format of {pdt}. It has no colon to be a valid file name on any platform.
+const pdtNamingFormat = "20060102T150405.000Z"
+
+// namingPlaceholderRegexp matches a placeholder of the naming template. i.g. {basename}, {msn:08d}
+var namingPlaceholderRegexp = regexp.MustCompile(`\{(\w+)(?::([^}]*))?\}`)
+
+// namingIntFormatRegexp is the format of an integer placeholder. i.g. 08d
+var namingIntFormatRegexp = regexp.MustCompile(`^0?[0-9]*d$`)
+
+// namingPart is a literal or a placeholder of the naming template.
+type namingPart struct {
+	literal     string
+	placeholder string
+	format      string
+}
+
+// segmentNamer names the downloaded segments, keys and init sections by a template.
+// The template has the placeholders below, and "/" makes a directory.
+//
+//	{basename}  the basename of the URI. i.g. 1.ts of http://example.com/live/1.ts?token=abc
+//	{ext}       the extension of the basename. i.g. .ts
+//	{variant}   the name of the variant playlist without the extension. i.g. 720p of http://example.com/live/720p.m3u8
+//	{msn}       the media sequence number, which takes a format of integer. i.g. {msn:08d}
+//	{pdt}       EXT-X-PROGRAM-DATE-TIME in UTC. i.g. 20220102T030405.000Z, empty without the tag
+//	{hash}      the first 16 hex digits of SHA-256 of the URI
+//
+// A name is unique in the files of the recording. If the name is taken, a suffix is added. i.g. 1_2.ts
+type segmentNamer struct {
+	parts []namingPart
+	// used is the taken names.
+	used map[string]bool
+	// playlists is the basenames of the variant playlists, whose copies are named by uri2playlistName. i.g. playlist.m3u8
+	playlists []string
+}
+
+func newSegmentNamer(template string) (*segmentNamer, error) {
+	if template == "" {
+		template = DefaultSegmentNaming
+	}
+	n := &segmentNamer{used: map[string]bool{}}
+	addLiteral := func(literal string) error {
+		if strings.ContainsAny(literal, "{}") {
+			return xerrors.Errorf("invalid placeholder: %q", template)
+		}
+		if literal != "" {
+			n.parts = append(n.parts, namingPart{literal: literal})
+		}
+		return nil
+	}
+	last := 0
+	for _, m := range namingPlaceholderRegexp.FindAllStringSubmatchIndex(template, -1) {
+		if err := addLiteral(template[last:m[0]]); err != nil {
+			return nil, err
+		}
+		p := namingPart{placeholder: template[m[2]:m[3]]}
+		if m[4] >= 0 {
+			p.format = template[m[4]:m[5]]
+		}
+		switch p.placeholder {
+		case "basename", "ext", "variant", "pdt", "hash":
+			if p.format != "" {
+				return nil, xerrors.Errorf("{%s} takes no format: %q", p.placeholder, template)
+			}
+		case "msn":
+			if p.format == "" {
+				p.format = "d"
+			}
+			if !namingIntFormatRegexp.MatchString(p.format) {
+				return nil, xerrors.Errorf("invalid format of {msn}: %q", template)
+			}
+		default:
+			return nil, xerrors.Errorf("unknown placeholder {%s}: %q", p.placeholder, template)
+		}
+		n.parts = append(n.parts, p)
+		last = m[1]
+	}
+	if err := addLiteral(template[last:]); err != nil {
+		return nil, err
+	}
+	// the files of the controller are not overwritten
+	for _, name := range []string{localMediaPlaylist, localMasterPlaylist, localJournal, localManifest, localChecksums, localReport, localMetadata, "timing_info.txt"} {
+		n.used[name] = true
+	}
+	return n, nil
+}
+
+// name returns a new name of the URI in the storage.
+// seg is the segment which refers to the URI, and v is the variant of the segment. v may be nil.
+func (n *segmentNamer) name(uri string, seg *segment, v *variant) (string, error) {
+	basename, err := uri2basename(uri)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, p := range n.parts {
+		switch p.placeholder {
+		case "":
+			b.WriteString(p.literal)
+		case "basename":
+			b.WriteString(basename)
+		case "ext":
+			b.WriteString(path.Ext(basename))
+		case "variant":
+			if v != nil {
+				name, err := uri2basename(v.uri.String())
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(strings.TrimSuffix(name, path.Ext(name)))
+			}
+		case "msn":
+			fmt.Fprintf(&b, "%"+p.format, seg.no)
+		case "pdt":
+			if !seg.programDateTime.IsZero() {
+				b.WriteString(seg.programDateTime.UTC().Format(pdtNamingFormat))
+			}
+		case "hash":
+			sum := sha256.Sum256([]byte(uri))
+			b.WriteString(hex.EncodeToString(sum[:8]))
+		}
+	}
+	name := b.String()
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") || path.Clean(name) != name || path.IsAbs(name) {
+		return "", xerrors.Errorf("invalid name %q of %s", name, uri)
+	}
+
+	unique := name
+	ext := path.Ext(name)
+	for i := 2; n.taken(unique); i++ {
+		unique = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	n.used[unique] = true
+	return unique, nil
+}
+
+// taken reports whether the name is used or a copy of a variant playlist. i.g. playlist_2.m3u8
+func (n *segmentNamer) taken(name string) bool {
+	if n.used[name] {
+		return true
+	}
+	for _, basename := range n.playlists {
+		ext := path.Ext(basename)
+		prefix := strings.TrimSuffix(basename, ext) + "_"
+		if len(name) <= len(prefix)+len(ext) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		count := name[len(prefix) : len(name)-len(ext)]
+		if strings.Trim(count, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// reserve takes the name which is already in the storage. i.g. to resume the recording
+func (n *segmentNamer) reserve(name string) {
+	n.used[name] = true
+}
+
+// reservePlaylists takes the names of the copies of the variant playlists.
+func (n *segmentNamer) reservePlaylists(variants []*variant) error {
+	for _, v := range variants {
+		basename, err := uri2basename(v.uri.String())
+		if err != nil {
+			return err
+		}
+		if basename != "" && !containsString(n.playlists, basename) {
+			n.playlists = append(n.playlists, basename)
+		}
+	}
+	return nil
+}
+
+// release frees the name whose file is deleted. i.g. by the retention
+func (n *segmentNamer) release(name string) {
+	delete(n.used, name)
+}
@@ -0,0 +1,106 @@
+package hls_downloader
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestSegmentNamer(t *testing.T) {
+	u, _ := url.Parse("https://example.com/live/720p.m3u8")
+	v := &variant{uri: u}
+	seg := &segment{no: 123, programDateTime: time.Date(2022, 1, 2, 12, 4, 5, 0, time.FixedZone("JST", 9*3600))}
+
+	// the names are unique
+	n, err := newSegmentNamer("")
+	assert.Nil(t, err)
+	for _, exp := range []string{"segment.ts", "segment_2.ts", "segment_3.ts"} {
+		name, err := n.name("https://example.com/live/segment.ts?seq=123", seg, v)
+		assert.Nil(t, err)
+		assert.Equal(t, name, exp)
+	}
+	n.reserve("1.ts")
+	name, err := n.name("https://example.com/live/1.ts", seg, v)
+	assert.Nil(t, err)
+	assert.Equal(t, name, "1_2.ts")
+	// the files of the controller
+	name, err = n.name("https://example.com/live/index.m3u8", seg, v)
+	assert.Nil(t, err)
+	assert.Equal(t, name, "index_2.m3u8")
+	name, err = n.name("https://example.com/live/report.jsonl", seg, v)
+	assert.Nil(t, err)
+	assert.Equal(t, name, "report_2.jsonl")
+	// the copies of the variant playlists
+	assert.Nil(t, n.reservePlaylists([]*variant{v}))
+	name, err = n.name("https://example.com/live/720p_3.m3u8", seg, v)
+	assert.Nil(t, err)
+	assert.Equal(t, name, "720p_3_2.m3u8")
+	name, err = n.name("https://example.com/live/720p_a.m3u8", seg, v)
+	assert.Nil(t, err)
+	assert.Equal(t, name, "720p_a.m3u8")
+	// the name is used again after the file is deleted
+	n.release("segment.ts")
+	name, err = n.name("https://example.com/live/segment.ts?seq=124", seg, v)
+	assert.Nil(t, err)
+	assert.Equal(t, name, "segment.ts")
+	_, err = n.name("https://example.com/live/", seg, v)
+	assert.NotNil(t, err)
+
+	testcase := []struct {
+		template string
+		exp      string
+	}{
+		{template: "{variant}/{msn:08d}_{basename}", exp: "720p/00000123_segment.ts"},
+		{template: "{msn}{ext}", exp: "123.ts"},
+		{template: "{pdt}{ext}", exp: "20220102T030405.000Z.ts"},
+		{template: "{hash}{ext}", exp: "f754f8764715f210.ts"},
+	}
+	for _, tt := range testcase {
+		n, err := newSegmentNamer(tt.template)
+		assert.Nil(t, err)
+		name, err := n.name("https://example.com/live/segment.ts?seq=123", seg, v)
+		assert.Nil(t, err)
+		assert.Equal(t, name, tt.exp)
+	}
+
+	// invalid names
+	n, err = newSegmentNamer("../{basename}")
+	assert.Nil(t, err)
+	_, err = n.name("https://example.com/live/1.ts", seg, v)
+	assert.NotNil(t, err)
+	n, err = newSegmentNamer("{pdt}")
+	assert.Nil(t, err)
+	_, err = n.name("https://example.com/live/1.ts", &segment{no: 1}, v)
+	assert.NotNil(t, err)
+
+	for _, template := range []string{"{unknown}", "{msn:s}", "{basename:08d}", "{msn", "a}"} {
+		_, err := newSegmentNamer(template)
+		assert.NotNil(t, err, template)
+	}
+}
+
+func TestPlaylistModify(t *testing.T) {
+	u, _ := url.Parse("http://example.com/live/v1/playlist.m3u8?token=x")
+	p := &playlist{segments: []*segment{
+		{no: 1, uri: "segment.ts?seq=123"},
+		{no: 2, uri: "segment.ts?seq=124"},
+		{no: 3, uri: "../v2/3.ts"},
+		{no: 4, uri: "https://cdn.example.com/4.ts"},
+	}}
+	assert.Nil(t, p.modify(u))
+	// the segments which differ only by the query are different URIs
+	assert.Equal(t, p.segments[0].uri, "http://example.com/live/v1/segment.ts?seq=123")
+	assert.Equal(t, p.segments[1].uri, "http://example.com/live/v1/segment.ts?seq=124")
+	assert.Equal(t, p.segments[2].uri, "http://example.com/live/v2/3.ts")
+	assert.Equal(t, p.segments[3].uri, "https://cdn.example.com/4.ts")
+
+	n, err := newSegmentNamer("")
+	assert.Nil(t, err)
+	for i, exp := range []string{"segment.ts", "segment_2.ts"} {
+		name, err := n.name(p.segments[i].uri, p.segments[i], nil)
+		assert.Nil(t, err)
+		assert.Equal(t, name, exp)
+	}
+}
@@ -2,9 +2,11 @@ package hls_downloader
 
 import (
 	"bufio"
+	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/xerrors"
@@ -18,45 +20,281 @@ type playlist struct {
 	payload        string
 }
 
+// segmentKey is EXT-X-KEY. see RFC8216 4.3.2.4
+type segmentKey struct {
+	method            string
+	uri               string
+	iv                string
+	keyFormat         string
+	keyFormatVersions string
+}
+
+func newSegmentKey(attrs *attributeList) (*segmentKey, error) {
+	method, err := attrs.enumeratedString("METHOD", "NONE", "AES-128", "SAMPLE-AES")
+	if err != nil {
+		return nil, err
+	}
+	k := &segmentKey{method: method}
+	if method != "NONE" {
+		if k.uri, err = attrs.quotedString("URI"); err != nil {
+			return nil, err
+		}
+	}
+	if attrs.has("IV") {
+		if _, err := attrs.hexadecimalSequence("IV"); err != nil {
+			return nil, err
+		}
+		k.iv = attrs.get("IV").value
+	}
+	if attrs.has("KEYFORMAT") {
+		if k.keyFormat, err = attrs.quotedString("KEYFORMAT"); err != nil {
+			return nil, err
+		}
+	}
+	if attrs.has("KEYFORMATVERSIONS") {
+		if k.keyFormatVersions, err = attrs.quotedString("KEYFORMATVERSIONS"); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// initSection is EXT-X-MAP. see RFC8216 4.3.2.5
+type initSection struct {
+	uri       string
+	byteRange string
+}
+
+func newInitSection(attrs *attributeList) (*initSection, error) {
+	uri, err := attrs.quotedString("URI")
+	if err != nil {
+		return nil, err
+	}
+	m := &initSection{uri: uri}
+	if attrs.has("BYTERANGE") {
+		if m.byteRange, err = attrs.quotedString("BYTERANGE"); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func resolveURI(base *url.URL, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", xerrors.Errorf("url.Parse failed: %w", err)
+	}
+	return base.ResolveReference(u).String(), nil
+}
+
 func (p *playlist) modify(playlistURI *url.URL) error {
 	for _, s := range p.segments {
-		segmentURI, err := url.Parse(s.uri)
-		if err != nil {
-			return xerrors.Errorf("url.Parse failed: %w", err)
+		var err error
+		if s.key != nil && s.key.uri != "" {
+			if s.key.uri, err = resolveURI(playlistURI, s.key.uri); err != nil {
+				return err
+			}
 		}
-		if !segmentURI.IsAbs() {
-			// RelativeURI -> AbsoluteURL
-			absSegmentURI := *playlistURI
-			slice := strings.Split(absSegmentURI.Path, "/")
-			slice[len(slice)-1] = segmentURI.Path
-			absSegmentURI.Path = strings.Join(slice, "/")
-			s.uri = absSegmentURI.String()
+		if s.initSection != nil {
+			if s.initSection.uri, err = resolveURI(playlistURI, s.initSection.uri); err != nil {
+				return err
+			}
+		}
+		if s.uri, err = resolveURI(playlistURI, s.uri); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+type variant struct {
+	uri        *url.URL
+	bandwidth  int
+	resolution string
+	codecs     string
+	pathwayID  string
+	// groups is the AUDIO, VIDEO, SUBTITLES and CLOSED-CAPTIONS attributes by the name.
+	groups map[string]*attribute
+}
+
+// renditionTypes is the TYPEs of EXT-X-MEDIA, which are also the attributes of EXT-X-STREAM-INF referring to the groups.
+var renditionTypes = []string{"AUDIO", "VIDEO", "SUBTITLES", "CLOSED-CAPTIONS"}
+
+func newVariant(uri *url.URL, attrs *attributeList) (*variant, error) {
+	v := &variant{uri: uri, pathwayID: defaultPathwayID, groups: map[string]*attribute{}}
+	if attrs == nil {
+		return v, nil
+	}
+	for _, typ := range renditionTypes {
+		if a := attrs.get(typ); a != nil {
+			v.groups[typ] = a
+		}
+	}
+	if attrs.has("BANDWIDTH") {
+		bandwidth, err := attrs.decimalInteger("BANDWIDTH")
+		if err != nil {
+			return nil, err
+		}
+		v.bandwidth = int(bandwidth)
+	}
+	if attrs.has("RESOLUTION") {
+		if _, _, err := attrs.decimalResolution("RESOLUTION"); err != nil {
+			return nil, err
+		}
+		v.resolution = attrs.get("RESOLUTION").value
+	}
+	if attrs.has("CODECS") {
+		codecs, err := attrs.quotedString("CODECS")
+		if err != nil {
+			return nil, err
+		}
+		v.codecs = codecs
+	}
+	if attrs.has("PATHWAY-ID") {
+		pathwayID, err := attrs.quotedString("PATHWAY-ID")
+		if err != nil {
+			return nil, err
+		}
+		v.pathwayID = pathwayID
+	}
+	return v, nil
+}
+
+// key identifies the variant regardless of its URI and pathway.
+func (v *variant) key() string {
+	return fmt.Sprintf("%d/%s/%s", v.bandwidth, v.resolution, v.codecs)
+}
+
+// rendition is an EXT-X-MEDIA of the master playlist.
+type rendition struct {
+	typ     string
+	groupID string
+	// uri is empty if the rendition is carried in the variant stream. i.g. muxed audio, closed captions
+	uri string
+	// attrs is the attribute-list as it is written in the master playlist.
+	attrs string
+}
+
+func newRendition(attrs *attributeList, value string) (*rendition, error) {
+	typ, err := attrs.enumeratedString("TYPE", renditionTypes...)
+	if err != nil {
+		return nil, err
+	}
+	groupID, err := attrs.quotedString("GROUP-ID")
+	if err != nil {
+		return nil, err
+	}
+	r := &rendition{typ: typ, groupID: groupID, attrs: value}
+	if attrs.has("URI") {
+		if r.uri, err = attrs.quotedString("URI"); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+type masterPlaylist struct {
+	variants   []*variant
+	renditions []*rendition
+	steering   *contentSteering
+}
+
+// resolve makes the relative URIs in the master playlist absolute.
+func (m *masterPlaylist) resolve(masterURI *url.URL) {
+	for _, v := range m.variants {
+		v.uri = masterURI.ResolveReference(v.uri)
+	}
+	if m.steering != nil {
+		m.steering.serverURI = masterURI.ResolveReference(m.steering.serverURI)
+	}
+}
+
+// pathways returns PATHWAY-IDs in order of appearance.
+func (m *masterPlaylist) pathways() []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, v := range m.variants {
+		if !seen[v.pathwayID] {
+			seen[v.pathwayID] = true
+			ids = append(ids, v.pathwayID)
+		}
+	}
+	return ids
+}
+
+// lookup returns the variant of the pathway which has the key.
+// If there is no such variant, the last variant of the pathway is returned.
+func (m *masterPlaylist) lookup(pathwayID, key string) *variant {
+	var found *variant
+	for _, v := range m.variants {
+		if v.pathwayID != pathwayID {
+			continue
+		}
+		found = v
+		if v.key() == key {
+			return v
+		}
+	}
+	return found
+}
+
 type playlistParser struct {
 	logger *zap.Logger
 }
 
-func (p *playlistParser) parse1st(sc *bufio.Scanner) (*url.URL, error) {
-	var uri *url.URL
+func (p *playlistParser) parse1st(sc *bufio.Scanner) (*masterPlaylist, error) {
+	master := &masterPlaylist{}
+	var (
+		attrs  *attributeList
+		lineNo int
+	)
 	for sc.Scan() {
-		var err error
+		lineNo++
 		line := sc.Text()
 		if strings.HasPrefix(line, "#") {
+			name, value := splitTag(line)
+			var err error
+			switch name {
+			case "#EXT-X-STREAM-INF":
+				attrs, err = parseAttributeList(value, lineNo, valueColumn(name))
+			case "#EXT-X-MEDIA":
+				var l *attributeList
+				l, err = parseAttributeList(value, lineNo, valueColumn(name))
+				if err == nil {
+					var r *rendition
+					if r, err = newRendition(l, value); err == nil {
+						master.renditions = append(master.renditions, r)
+					}
+				}
+			case "#EXT-X-CONTENT-STEERING":
+				var l *attributeList
+				l, err = parseAttributeList(value, lineNo, valueColumn(name))
+				if err == nil {
+					master.steering, err = newContentSteering(l)
+				}
+			}
+			if err != nil {
+				return nil, xerrors.Errorf("invalid playlist: %w", err)
+			}
+			continue
+		} else if line == "" {
 			continue
 		}
-		uri, err = url.Parse(line)
+		uri, err := url.Parse(line)
 		if err != nil {
-			return nil, xerrors.Errorf("url.Parse failed: +%w", err)
+			return nil, xerrors.Errorf("invalid playlist: %w", newParseError(lineNo, 1, "invalid URI: %v", err))
 		}
+		v, err := newVariant(uri, attrs)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid playlist: %w", err)
+		}
+		master.variants = append(master.variants, v)
+		attrs = nil
 	}
-	if uri == nil {
+	if len(master.variants) == 0 {
 		return nil, xerrors.New("playlist uri is not found")
 	}
-	return uri, nil
+	return master, nil
 }
 
 func (p *playlistParser) parse2nd(sc *bufio.Scanner) (*playlist, error) {
@@ -65,68 +303,103 @@ func (p *playlistParser) parse2nd(sc *bufio.Scanner) (*playlist, error) {
 		targetDuration  int
 		no              int
 		segmentDuration float64
+		title           string
+		discontinuity   bool
+		gap             bool
+		programDateTime time.Time
+		key             *segmentKey
+		init            *initSection
 		end             bool
 		segments        []*segment
 	)
 	segments = make([]*segment, 0, 10)
 
+	var lineNo int
 	for sc.Scan() {
+		lineNo++
 		line := sc.Text()
 		p.logger.Info("", zap.String("line", line))
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			// segment
+			s := &segment{
+				duration:        segmentDuration,
+				uri:             line,
+				no:              no,
+				title:           title,
+				discontinuity:   discontinuity,
+				gap:             gap,
+				programDateTime: programDateTime,
+				key:             key,
+				initSection:     init,
+			}
+			segments = append(segments, s)
+			no++
+			discontinuity = false
+			gap = false
+			programDateTime = time.Time{}
+			continue
+		}
+
+		name, value := splitTag(line)
+		column := valueColumn(name)
 		var err error
 		// FIXME: EXT-X-MEDIA-SEQUENCE 等を受信したかどうかの状態を管理する
-		if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE") {
-			strs := strings.Split(line, ":")
-			if len(strs) == 2 {
-				mediaSequence, err = strconv.Atoi(strs[1])
-				if err != nil {
-					return nil, xerrors.Errorf("invalid playlist, %v :%+w", line, err)
-				}
-				no = mediaSequence
-			} else {
-				return nil, xerrors.Errorf("invalid playlist, %v", line)
+		switch name {
+		case "#EXT-X-MEDIA-SEQUENCE":
+			mediaSequence, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid playlist: %w", newParseError(lineNo, column, "invalid decimal-integer %q", value))
 			}
-		} else if strings.HasPrefix(line, "#EXT-X-TARGETDURATION") {
-			strs := strings.Split(line, ":")
-			if len(strs) == 2 {
-				targetDuration, err = strconv.Atoi(strs[1])
-				if err != nil {
-					return nil, xerrors.Errorf("invalid playlist, %v :%+w", line, err)
-				}
-			} else {
-				return nil, xerrors.Errorf("invalid playlist, %v", line)
+			no = mediaSequence
+		case "#EXT-X-TARGETDURATION":
+			targetDuration, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid playlist: %w", newParseError(lineNo, column, "invalid decimal-integer %q", value))
 			}
-		} else if strings.HasPrefix(line, "#EXTINF") {
-			strs := strings.Split(line, ":")
-			if len(strs) == 2 {
-				strs2 := strings.Split(strs[1], ",")
-				if len(strs2) == 2 {
-					segmentDuration, err = strconv.ParseFloat(strs2[0], 64)
-					if err != nil {
-						return nil, xerrors.Errorf("invalid playlist, %v :%+w", line, err)
-					}
-					// TODO save a title = strs2[1]
-				} else {
-					return nil, xerrors.Errorf("invalid playlist, %v", line)
-				}
-			} else {
-				return nil, xerrors.Errorf("invalid playlist, %v", line)
+		case "#EXTINF":
+			strs := strings.SplitN(value, ",", 2)
+			if len(strs) != 2 {
+				return nil, xerrors.Errorf("invalid playlist: %w", newParseError(lineNo, column+len(value), "',' is expected after the duration"))
 			}
+			segmentDuration, err = strconv.ParseFloat(strs[0], 64)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid playlist: %w", newParseError(lineNo, column, "invalid duration %q", strs[0]))
+			}
+			title = strs[1]
 			// FIXME wait segment
-		} else if strings.HasPrefix(line, "#EXT-X-ENDLIST") {
-			break
-		} else if !strings.HasPrefix(line, "#") {
-			// segment
-			s := &segment{
-				duration: segmentDuration,
-				uri:      line,
-				no:       no,
+		case "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case "#EXT-X-GAP":
+			gap = true
+		case "#EXT-X-PROGRAM-DATE-TIME":
+			programDateTime, err = time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid playlist: %w", newParseError(lineNo, column, "invalid date-time %q", value))
 			}
-			segments = append(segments, s)
-			no++
-		} else {
+		case "#EXT-X-KEY", "#EXT-X-MAP":
+			attrs, err := parseAttributeList(value, lineNo, column)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid playlist: %w", err)
+			}
+			if name == "#EXT-X-KEY" {
+				key, err = newSegmentKey(attrs)
+			} else {
+				init, err = newInitSection(attrs)
+			}
+			if err != nil {
+				return nil, xerrors.Errorf("invalid playlist: %w", err)
+			}
+		case "#EXT-X-ENDLIST":
+			end = true
+		default:
 			// do nothing
 		}
+		if end {
+			break
+		}
 	}
 	if len(segments) == 0 {
 		return nil, xerrors.New("no segment")
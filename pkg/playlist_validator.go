@@ -0,0 +1,526 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Violation is a conformance violation of RFC8216.
+type Violation struct {
+	URI      string `json:"uri"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	// Rule is the section of RFC8216. i.g. 4.3.3.1
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type playlistValidation struct {
+	violations     []Violation
+	master         bool
+	variants       []string
+	mediaSequence  int
+	targetDuration int
+	// segments is media sequence -> segment URI
+	segments map[int]string
+	end      bool
+}
+
+func (v *playlistValidation) add(line int, severity, rule, format string, args ...interface{}) {
+	v.violations = append(v.violations, Violation{
+		Line:     line,
+		Severity: severity,
+		Rule:     rule,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// addError adds the error as a violation. The position is taken from a ParseError.
+func (v *playlistValidation) addError(line int, rule string, err error) bool {
+	if err == nil {
+		return false
+	}
+	violation := Violation{Line: line, Severity: SeverityError, Rule: rule, Message: err.Error()}
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		violation.Line, violation.Column, violation.Message = pe.Line, pe.Column, pe.Msg
+	}
+	v.violations = append(v.violations, violation)
+	return true
+}
+
+// masterTags appear only in a master playlist. see RFC8216 4.3.4
+var masterTags = map[string]bool{
+	"#EXT-X-MEDIA":              true,
+	"#EXT-X-STREAM-INF":         true,
+	"#EXT-X-I-FRAME-STREAM-INF": true,
+	"#EXT-X-SESSION-DATA":       true,
+	"#EXT-X-SESSION-KEY":        true,
+	"#EXT-X-CONTENT-STEERING":   true,
+}
+
+// mediaTags appear only in a media playlist. see RFC8216 4.3.2, 4.3.3
+var mediaTags = map[string]bool{
+	"#EXTINF":                       true,
+	"#EXT-X-BYTERANGE":              true,
+	"#EXT-X-DISCONTINUITY":          true,
+	"#EXT-X-GAP":                    true,
+	"#EXT-X-KEY":                    true,
+	"#EXT-X-MAP":                    true,
+	"#EXT-X-PROGRAM-DATE-TIME":      true,
+	"#EXT-X-DATERANGE":              true,
+	"#EXT-X-TARGETDURATION":         true,
+	"#EXT-X-MEDIA-SEQUENCE":         true,
+	"#EXT-X-DISCONTINUITY-SEQUENCE": true,
+	"#EXT-X-ENDLIST":                true,
+	"#EXT-X-PLAYLIST-TYPE":          true,
+	"#EXT-X-I-FRAMES-ONLY":          true,
+}
+
+// attributeTags have an attribute-list as the value.
+var attributeTags = map[string]bool{
+	"#EXT-X-KEY":                true,
+	"#EXT-X-MAP":                true,
+	"#EXT-X-DATERANGE":          true,
+	"#EXT-X-MEDIA":              true,
+	"#EXT-X-STREAM-INF":         true,
+	"#EXT-X-I-FRAME-STREAM-INF": true,
+	"#EXT-X-SESSION-DATA":       true,
+	"#EXT-X-SESSION-KEY":        true,
+	"#EXT-X-START":              true,
+	"#EXT-X-CONTENT-STEERING":   true,
+}
+
+// validate checks the conformance of a master or media playlist to RFC8216.
+func (p *playlistParser) validate(sc *bufio.Scanner) *playlistValidation {
+	v := &playlistValidation{segments: map[int]string{}}
+	var (
+		lineNo          int
+		version         int
+		versionLine     int
+		requiredVersion = 1
+		requiredBy      string
+		masterTag       string
+		mediaTag        string
+		extinf          = -1.0
+		extinfLine      int
+		streamInf       bool
+		iframesOnly     bool
+		mediaSequence   bool
+		targetDuration  bool
+		no              int
+		maxDuration     float64
+		maxDurationLine int
+	)
+	require := func(ver int, feature string) {
+		if ver > requiredVersion {
+			requiredVersion = ver
+			requiredBy = feature
+		}
+	}
+
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimRight(sc.Text(), "\r")
+		if lineNo == 1 {
+			if line == "#EXTM3U" {
+				continue
+			}
+			v.add(lineNo, SeverityError, "4.3.1.1", "the first line must be #EXTM3U")
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			// URI
+			if streamInf {
+				v.variants = append(v.variants, line)
+				streamInf = false
+			} else if masterTag != "" {
+				v.add(lineNo, SeverityError, "4.3.4.2", "URI must follow EXT-X-STREAM-INF")
+			} else {
+				if extinf < 0 {
+					v.add(lineNo, SeverityError, "4.3.2.1", "EXTINF is required for each media segment")
+				} else if extinf > maxDuration {
+					maxDuration = extinf
+					maxDurationLine = extinfLine
+				}
+				v.segments[v.mediaSequence+no] = line
+				no++
+				extinf = -1
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, "#EXT") {
+			// comment
+			continue
+		}
+
+		name, value := splitTag(line)
+		if masterTags[name] && masterTag == "" {
+			masterTag = name
+		}
+		if mediaTags[name] && mediaTag == "" {
+			mediaTag = name
+		}
+		attrs := &attributeList{line: lineNo, column: valueColumn(name)}
+		if attributeTags[name] {
+			var err error
+			attrs, err = parseAttributeList(value, lineNo, valueColumn(name))
+			if v.addError(lineNo, "4.2", err) {
+				continue
+			}
+		}
+
+		switch name {
+		case "#EXTM3U":
+			v.add(lineNo, SeverityError, "4.3.1.1", "EXTM3U must appear only in the first line")
+		case "#EXT-X-VERSION":
+			if versionLine != 0 {
+				v.add(lineNo, SeverityError, "4.3.1.2", "EXT-X-VERSION must not appear more than once")
+			}
+			ver, err := strconv.Atoi(value)
+			if err != nil {
+				v.addError(lineNo, "4.3.1.2", newParseError(lineNo, valueColumn(name), "invalid EXT-X-VERSION %q", value))
+			}
+			version, versionLine = ver, lineNo
+		case "#EXTINF":
+			strs := strings.SplitN(value, ",", 2)
+			d, err := strconv.ParseFloat(strs[0], 64)
+			if err != nil || d < 0 {
+				v.addError(lineNo, "4.3.2.1", newParseError(lineNo, valueColumn(name), "invalid EXTINF duration %q", strs[0]))
+				d = 0
+			}
+			if len(strs) != 2 {
+				v.addError(lineNo, "4.3.2.1", newParseError(lineNo, valueColumn(name)+len(value), "',' is expected after the duration"))
+			}
+			if d != math.Trunc(d) {
+				require(3, "floating-point EXTINF duration")
+			}
+			extinf, extinfLine = d, lineNo
+		case "#EXT-X-BYTERANGE":
+			require(4, "EXT-X-BYTERANGE")
+		case "#EXT-X-KEY":
+			method, err := attrs.enumeratedString("METHOD", "NONE", "AES-128", "SAMPLE-AES")
+			v.addError(lineNo, "4.3.2.4", err)
+			if method != "NONE" {
+				_, err := attrs.quotedString("URI")
+				v.addError(lineNo, "4.3.2.4", err)
+			}
+			if attrs.has("IV") {
+				_, err := attrs.hexadecimalSequence("IV")
+				v.addError(lineNo, "4.3.2.4", err)
+				require(2, "IV attribute of EXT-X-KEY")
+			}
+			if attrs.has("KEYFORMAT") {
+				_, err := attrs.quotedString("KEYFORMAT")
+				v.addError(lineNo, "4.3.2.4", err)
+				require(5, "KEYFORMAT attribute of EXT-X-KEY")
+			}
+			if attrs.has("KEYFORMATVERSIONS") {
+				_, err := attrs.quotedString("KEYFORMATVERSIONS")
+				v.addError(lineNo, "4.3.2.4", err)
+				require(5, "KEYFORMATVERSIONS attribute of EXT-X-KEY")
+			}
+		case "#EXT-X-MAP":
+			_, err := attrs.quotedString("URI")
+			v.addError(lineNo, "4.3.2.5", err)
+			if attrs.has("BYTERANGE") {
+				_, err := attrs.quotedString("BYTERANGE")
+				v.addError(lineNo, "4.3.2.5", err)
+			}
+			if iframesOnly {
+				require(5, "EXT-X-MAP with EXT-X-I-FRAMES-ONLY")
+			} else {
+				require(6, "EXT-X-MAP without EXT-X-I-FRAMES-ONLY")
+			}
+		case "#EXT-X-TARGETDURATION":
+			if targetDuration {
+				v.add(lineNo, SeverityError, "4.3.3.1", "EXT-X-TARGETDURATION must not appear more than once")
+			}
+			targetDuration = true
+			d, err := strconv.Atoi(value)
+			if err != nil || d < 0 {
+				v.addError(lineNo, "4.3.3.1", newParseError(lineNo, valueColumn(name), "invalid EXT-X-TARGETDURATION %q", value))
+			}
+			v.targetDuration = d
+		case "#EXT-X-MEDIA-SEQUENCE":
+			if mediaSequence {
+				v.add(lineNo, SeverityError, "4.3.3.2", "EXT-X-MEDIA-SEQUENCE must not appear more than once")
+			}
+			if no > 0 {
+				v.add(lineNo, SeverityError, "4.3.3.2", "EXT-X-MEDIA-SEQUENCE must appear before the first media segment")
+			}
+			mediaSequence = true
+			seq, err := strconv.Atoi(value)
+			if err != nil || seq < 0 {
+				v.addError(lineNo, "4.3.3.2", newParseError(lineNo, valueColumn(name), "invalid EXT-X-MEDIA-SEQUENCE %q", value))
+			}
+			v.mediaSequence = seq
+		case "#EXT-X-ENDLIST":
+			v.end = true
+		case "#EXT-X-I-FRAMES-ONLY":
+			iframesOnly = true
+			require(4, "EXT-X-I-FRAMES-ONLY")
+		case "#EXT-X-MEDIA":
+			typ, err := attrs.enumeratedString("TYPE", "AUDIO", "VIDEO", "SUBTITLES", "CLOSED-CAPTIONS")
+			v.addError(lineNo, "4.3.4.1", err)
+			for _, a := range []string{"GROUP-ID", "NAME"} {
+				_, err := attrs.quotedString(a)
+				v.addError(lineNo, "4.3.4.1", err)
+			}
+			if typ == "CLOSED-CAPTIONS" {
+				if attrs.has("URI") {
+					v.add(lineNo, SeverityError, "4.3.4.1", "URI must not be present for CLOSED-CAPTIONS")
+				}
+				instreamID, err := attrs.quotedString("INSTREAM-ID")
+				v.addError(lineNo, "4.3.4.1", err)
+				if strings.HasPrefix(instreamID, "SERVICE") {
+					require(7, "SERVICE value of INSTREAM-ID")
+				}
+			}
+		case "#EXT-X-STREAM-INF":
+			_, err := attrs.decimalInteger("BANDWIDTH")
+			v.addError(lineNo, "4.3.4.2", err)
+			if attrs.has("AVERAGE-BANDWIDTH") {
+				_, err := attrs.decimalInteger("AVERAGE-BANDWIDTH")
+				v.addError(lineNo, "4.3.4.2", err)
+			}
+			if attrs.has("CODECS") {
+				_, err := attrs.quotedString("CODECS")
+				v.addError(lineNo, "4.3.4.2", err)
+			} else {
+				v.add(lineNo, SeverityWarning, "4.3.4.2", "CODECS should be present")
+			}
+			if attrs.has("RESOLUTION") {
+				_, _, err := attrs.decimalResolution("RESOLUTION")
+				v.addError(lineNo, "4.3.4.2", err)
+			}
+			if attrs.has("FRAME-RATE") {
+				_, err := attrs.decimalFloatingPoint("FRAME-RATE")
+				v.addError(lineNo, "4.3.4.2", err)
+			}
+			streamInf = true
+		case "#EXT-X-I-FRAME-STREAM-INF":
+			_, err := attrs.decimalInteger("BANDWIDTH")
+			v.addError(lineNo, "4.3.4.3", err)
+			_, err = attrs.quotedString("URI")
+			v.addError(lineNo, "4.3.4.3", err)
+		}
+	}
+	if lineNo == 0 {
+		v.add(0, SeverityError, "4.3.1.1", "empty playlist")
+		return v
+	}
+
+	if masterTag != "" && mediaTag != "" {
+		v.add(0, SeverityError, "4.1", "master playlist tag %s and media playlist tag %s must not appear in the same playlist", masterTag, mediaTag)
+	}
+	v.master = masterTag != ""
+	if !v.master {
+		if !targetDuration {
+			v.add(0, SeverityError, "4.3.3.1", "EXT-X-TARGETDURATION is required")
+		} else if int(math.Round(maxDuration)) > v.targetDuration {
+			v.add(maxDurationLine, SeverityError, "4.3.3.1",
+				"EXTINF duration %v rounded to the nearest integer exceeds EXT-X-TARGETDURATION %d", maxDuration, v.targetDuration)
+		}
+		if streamInf {
+			v.add(lineNo, SeverityError, "4.3.4.2", "URI must follow EXT-X-STREAM-INF")
+		}
+	}
+	if version == 0 {
+		version = 1
+	}
+	if requiredVersion > version {
+		v.add(versionLine, SeverityError, "7", "%s requires EXT-X-VERSION %d or higher, but the version is %d", requiredBy, requiredVersion, version)
+	}
+	return v
+}
+
+// checkReload checks the reloaded media playlist against the previous one. see RFC8216 6.2.2
+func checkReload(prev, next *playlistValidation) []Violation {
+	var vs []Violation
+	if next.mediaSequence < prev.mediaSequence {
+		vs = append(vs, Violation{
+			Severity: SeverityError,
+			Rule:     "6.2.2",
+			Message:  fmt.Sprintf("EXT-X-MEDIA-SEQUENCE decreased from %d to %d", prev.mediaSequence, next.mediaSequence),
+		})
+	}
+	seqs := make([]int, 0, len(next.segments))
+	for seq := range next.segments {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		uri := next.segments[seq]
+		if prevURI, ok := prev.segments[seq]; ok && prevURI != uri {
+			vs = append(vs, Violation{
+				Severity: SeverityError,
+				Rule:     "6.2.2",
+				Message:  fmt.Sprintf("media sequence %d changed from %s to %s", seq, prevURI, uri),
+			})
+		}
+	}
+	return vs
+}
+
+// Validate checks the conformance of the playlist to RFC8216.
+// src is an URI or a local file path. The variants of a master playlist are also validated.
+// A media playlist fetched from an URI is reloaded up to reloads times to check the media sequence.
+func (app *App) Validate(ctx context.Context, src string, reloads int) ([]Violation, error) {
+	tr, err := newTransport(app.Config.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	jar, err := newCookieJar(app.Config.CookieFile)
+	if err != nil {
+		return nil, err
+	}
+	cli := app.Config.newClient(tr, jar, app.Config.PlaylistDownloadTimeout)
+	th := newThrottle(app.Config.Throttle)
+	th.limit(cli)
+	parser := playlistParser{logger: app.Logger}
+
+	validate := func(src string) (*playlistValidation, error) {
+		r, err := openPlaylist(cli, src)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = r.Close() }()
+		v := parser.validate(bufio.NewScanner(r))
+		for i := range v.violations {
+			v.violations[i].URI = src
+		}
+		return v, nil
+	}
+
+	// the reloads of the media playlists are limited
+	reload := func(src string) (*playlistValidation, error) {
+		th.waitPlaylist()
+		return validate(src)
+	}
+
+	v, err := validate(src)
+	if err != nil {
+		return nil, err
+	}
+	violations := v.violations
+	if !v.master {
+		violations = append(violations, app.validateReloads(ctx, src, v, reloads, reload)...)
+		return violations, nil
+	}
+
+	seen := map[string]bool{}
+	for _, variantURI := range v.variants {
+		u, err := resolvePlaylistURI(src, variantURI)
+		if err != nil {
+			return nil, err
+		}
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		mv, err := validate(u)
+		if err != nil {
+			violations = append(violations, Violation{URI: u, Severity: SeverityError, Rule: "4.3.4.2", Message: err.Error()})
+			continue
+		}
+		violations = append(violations, mv.violations...)
+		violations = append(violations, app.validateReloads(ctx, u, mv, reloads, reload)...)
+	}
+	return violations, nil
+}
+
+// validateReloads reloads the live media playlist until EXT-X-ENDLIST.
+func (app *App) validateReloads(ctx context.Context, src string, prev *playlistValidation, reloads int,
+	validate func(string) (*playlistValidation, error)) []Violation {
+	var violations []Violation
+	if !isRemote(src) || prev.end {
+		return nil
+	}
+	for i := 0; i < reloads; i++ {
+		select {
+		case <-ctx.Done():
+			return violations
+		case <-time.After(time.Second * time.Duration(prev.targetDuration)):
+		}
+		next, err := validate(src)
+		if err != nil {
+			app.Logger.Warn("reload failed", zap.String("uri", src), zap.Error(err))
+			continue
+		}
+		for _, v := range checkReload(prev, next) {
+			v.URI = src
+			violations = append(violations, v)
+		}
+		prev = next
+		if prev.end {
+			// the playlist is not live anymore
+			break
+		}
+	}
+	return violations
+}
+
+func isRemote(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// openPlaylist opens the playlist of an URI or a local file path.
+func openPlaylist(cli *client, src string) (io.ReadCloser, error) {
+	if !isRemote(src) {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, xerrors.Errorf("os.Open failed: %w", err)
+		}
+		return f, nil
+	}
+	resp, err := cli.get(src)
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return nil, xerrors.Errorf("cli.get failed: %w", err)
+	}
+	return resp.Body, nil
+}
+
+// resolvePlaylistURI resolves the URI in the playlist of src.
+func resolvePlaylistURI(src, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", xerrors.Errorf("url.Parse failed: %w", err)
+	}
+	if !isRemote(src) {
+		if u.IsAbs() {
+			return uri, nil
+		}
+		return filepath.Join(filepath.Dir(src), filepath.FromSlash(u.Path)), nil
+	}
+	base, err := url.Parse(src)
+	if err != nil {
+		return "", xerrors.Errorf("url.Parse failed: %w", err)
+	}
+	return base.ResolveReference(u).String(), nil
+}
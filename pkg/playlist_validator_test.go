@@ -0,0 +1,139 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func TestValidate(t *testing.T) {
+	testcase := []struct {
+		name  string
+		in    string
+		rules []string
+	}{
+		{
+			name: "valid media playlist",
+			in: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:10
+#EXTINF:5.5,
+a.ts
+#EXT-X-PROGRAM-DATE-TIME:2010-02-19T14:54:23.031+08:00
+#EXTINF:6.0,title
+b.ts
+`,
+		},
+		{
+			name: "no EXTM3U and no TARGETDURATION",
+			in: `#EXTINF:6,
+a.ts
+`,
+			rules: []string{"4.3.1.1", "4.3.3.1"},
+		},
+		{
+			name: "EXTINF exceeds TARGETDURATION",
+			in: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXTINF:6.6,
+a.ts
+`,
+			rules: []string{"4.3.3.1"},
+		},
+		{
+			name: "version is too low",
+			in: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:6,
+a.m4s
+`,
+			rules: []string{"7"},
+		},
+		{
+			name: "invalid attribute-list",
+			in: `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS="avc1.4d401f
+low.m3u8
+`,
+			rules: []string{"4.2", "4.3.4.2"},
+		},
+		{
+			name: "master playlist without CODECS",
+			in: `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000
+low.m3u8
+`,
+			rules: []string{"4.3.4.2"},
+		},
+	}
+
+	parser := playlistParser{logger: zap.NewNop()}
+	for _, tt := range testcase {
+		v := parser.validate(bufio.NewScanner(strings.NewReader(tt.in)))
+		rules := []string{}
+		for _, violation := range v.violations {
+			rules = append(rules, violation.Rule)
+		}
+		if tt.rules == nil {
+			tt.rules = []string{}
+		}
+		assert.Equal(t, rules, tt.rules, tt.name)
+	}
+}
+
+func TestCheckReload(t *testing.T) {
+	prev := &playlistValidation{mediaSequence: 10, segments: map[int]string{10: "a.ts", 11: "b.ts"}}
+
+	next := &playlistValidation{mediaSequence: 11, segments: map[int]string{11: "b.ts", 12: "c.ts"}}
+	assert.Equal(t, len(checkReload(prev, next)), 0)
+
+	next = &playlistValidation{mediaSequence: 9, segments: map[int]string{9: "z.ts", 10: "a.ts", 11: "x.ts"}}
+	violations := checkReload(prev, next)
+	assert.Equal(t, len(violations), 2)
+	assert.Equal(t, violations[0].Message, "EXT-X-MEDIA-SEQUENCE decreased from 10 to 9")
+	assert.Equal(t, violations[1].Message, "media sequence 11 changed from b.ts to x.ts")
+}
+
+func TestValidateReloads(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXTINF:0,\n%d.ts\n", requests, requests)
+		if requests >= 2 {
+			fmt.Fprintln(w, "#EXT-X-ENDLIST")
+		}
+	}))
+	defer ts.Close()
+
+	app, _ := NewApp(&Config{}, zap.NewNop())
+	_, err := app.Validate(context.Background(), ts.URL+"/live.m3u8", 3)
+	assert.Nil(t, err)
+	// the reloads stop at EXT-X-ENDLIST
+	assert.Equal(t, requests, 2)
+}
+
+func TestOpenPlaylistError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	// the error responses are closed, or they hold the only connection
+	cli := (&Config{}).newClient(&http.Transport{MaxConnsPerHost: 1}, nil, time.Second)
+	for i := 0; i < 3; i++ {
+		_, err := openPlaylist(cli, ts.URL)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "404")
+	}
+}
@@ -0,0 +1,219 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// localMediaPlaylist refers to the downloaded segments.
+	localMediaPlaylist = "index.m3u8"
+	// localMasterPlaylist refers to localMediaPlaylist.
+	localMasterPlaylist = "master.m3u8"
+)
+
+const programDateTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// playlistWriter writes a local media playlist which refers to the downloaded files.
+// The URIs of segments, keys and init sections are the relative paths in the output directory.
+type playlistWriter struct {
+	storage        Storage
+	name           string
+	targetDuration int
+	segments       []*segment
+	end            bool
+	// sliding is true if old segments are removed, then the playlist is not EVENT. see segmentRetention
+	sliding bool
+	// discontinuitySequence is the number of discontinuities in the removed segments.
+	discontinuitySequence int
+}
+
+func newPlaylistWriter(outputDir, name string) *playlistWriter {
+	return &playlistWriter{storage: NewLocalStorage(outputDir), name: name}
+}
+
+// add adds the downloaded segment in order of the media sequence.
+func (w *playlistWriter) add(seg *segment) {
+	i := sort.Search(len(w.segments), func(i int) bool { return w.segments[i].no >= seg.no })
+	if i < len(w.segments) && w.segments[i].no == seg.no {
+		return
+	}
+	w.segments = append(w.segments, nil)
+	copy(w.segments[i+1:], w.segments[i:])
+	w.segments[i] = seg
+}
+
+// remove removes the first n segments and returns them.
+func (w *playlistWriter) remove(n int) []*segment {
+	if n <= 0 {
+		return nil
+	}
+	// count the discontinuities before the removed segments and the new first segment
+	for i := 1; i <= n && i < len(w.segments); i++ {
+		if s, prev := w.segments[i], w.segments[i-1]; s.discontinuity || s.no != prev.no+1 {
+			w.discontinuitySequence++
+		}
+	}
+	removed := append([]*segment{}, w.segments[:n]...)
+	w.segments = w.segments[n:]
+	return removed
+}
+
+// version returns the compatibility version. see RFC8216 7
+func (w *playlistWriter) version() int {
+	version := 3
+	for _, s := range w.segments {
+		if s.initSection != nil && version < 6 {
+			version = 6
+		}
+		if s.key != nil && (s.key.keyFormat != "" || s.key.keyFormatVersions != "") && version < 5 {
+			version = 5
+		}
+	}
+	return version
+}
+
+func serializeKey(k *segmentKey) string {
+	if k == nil {
+		return "#EXT-X-KEY:METHOD=NONE"
+	}
+	attrs := []string{"METHOD=" + k.method}
+	if k.uri != "" {
+		attrs = append(attrs, fmt.Sprintf("URI=%q", k.uri))
+	}
+	if k.iv != "" {
+		attrs = append(attrs, "IV="+k.iv)
+	}
+	if k.keyFormat != "" {
+		attrs = append(attrs, fmt.Sprintf("KEYFORMAT=%q", k.keyFormat))
+	}
+	if k.keyFormatVersions != "" {
+		attrs = append(attrs, fmt.Sprintf("KEYFORMATVERSIONS=%q", k.keyFormatVersions))
+	}
+	return "#EXT-X-KEY:" + strings.Join(attrs, ",")
+}
+
+func serializeInitSection(m *initSection) string {
+	s := fmt.Sprintf("#EXT-X-MAP:URI=%q", m.uri)
+	if m.byteRange != "" {
+		s += fmt.Sprintf(",BYTERANGE=%q", m.byteRange)
+	}
+	return s
+}
+
+func sameKey(a, b *segmentKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func sameInitSection(a, b *initSection) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (w *playlistWriter) serialize(out io.Writer) error {
+	bw := bufio.NewWriter(out)
+	targetDuration := w.targetDuration
+	for _, s := range w.segments {
+		if d := int(math.Round(s.duration)); d > targetDuration {
+			targetDuration = d
+		}
+	}
+	fmt.Fprintln(bw, "#EXTM3U")
+	fmt.Fprintf(bw, "#EXT-X-VERSION:%d\n", w.version())
+	fmt.Fprintf(bw, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	if len(w.segments) > 0 {
+		fmt.Fprintf(bw, "#EXT-X-MEDIA-SEQUENCE:%d\n", w.segments[0].no)
+	}
+	if w.discontinuitySequence > 0 {
+		fmt.Fprintf(bw, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", w.discontinuitySequence)
+	}
+	if !w.end && !w.sliding {
+		fmt.Fprintln(bw, "#EXT-X-PLAYLIST-TYPE:EVENT")
+	}
+
+	var prev *segment
+	for _, s := range w.segments {
+		if prev != nil && (s.discontinuity || s.no != prev.no+1) {
+			// a missing segment is also a discontinuity
+			fmt.Fprintln(bw, "#EXT-X-DISCONTINUITY")
+		}
+		if (prev == nil && s.key != nil) || (prev != nil && !sameKey(prev.key, s.key)) {
+			fmt.Fprintln(bw, serializeKey(s.key))
+		}
+		if s.initSection != nil && (prev == nil || !sameInitSection(prev.initSection, s.initSection)) {
+			fmt.Fprintln(bw, serializeInitSection(s.initSection))
+		}
+		if !s.programDateTime.IsZero() {
+			fmt.Fprintf(bw, "#EXT-X-PROGRAM-DATE-TIME:%s\n", s.programDateTime.Format(programDateTimeFormat))
+		}
+		if s.gap {
+			// the segment is failed to download
+			fmt.Fprintln(bw, "#EXT-X-GAP")
+		}
+		fmt.Fprintf(bw, "#EXTINF:%.3f,%s\n", s.duration, s.title)
+		fmt.Fprintln(bw, s.uri)
+		prev = s
+	}
+	if w.end {
+		fmt.Fprintln(bw, "#EXT-X-ENDLIST")
+	}
+	return bw.Flush()
+}
+
+// write writes the playlist to the storage.
+func (w *playlistWriter) write() error {
+	return putFile(w.storage, w.name, w.serialize)
+}
+
+// writeMasterPlaylist writes a master playlist which refers to the local media playlist of the variant.
+// The renditions of the variant which are carried in the variant stream are also written with their groups.
+// The renditions of their own media playlists are not recorded, so they are omitted.
+func writeMasterPlaylist(s Storage, v *variant, renditions []*rendition, mediaPlaylist string) error {
+	return putFile(s, localMasterPlaylist, func(out io.Writer) error {
+		attrs := []string{fmt.Sprintf("BANDWIDTH=%d", v.bandwidth)}
+		if v.resolution != "" {
+			attrs = append(attrs, "RESOLUTION="+v.resolution)
+		}
+		if v.codecs != "" {
+			attrs = append(attrs, fmt.Sprintf("CODECS=%q", v.codecs))
+		}
+		var media []string
+		for _, typ := range renditionTypes {
+			a, ok := v.groups[typ]
+			if !ok {
+				continue
+			}
+			if !a.quoted {
+				// CLOSED-CAPTIONS=NONE
+				attrs = append(attrs, typ+"="+a.value)
+				continue
+			}
+			n := len(media)
+			for _, r := range renditions {
+				if r.typ == typ && r.groupID == a.value && r.uri == "" {
+					media = append(media, "#EXT-X-MEDIA:"+r.attrs)
+				}
+			}
+			// a group must have a rendition
+			if len(media) > n {
+				attrs = append(attrs, fmt.Sprintf("%s=%q", typ, a.value))
+			}
+		}
+		bw := bufio.NewWriter(out)
+		fmt.Fprintln(bw, "#EXTM3U")
+		for _, m := range media {
+			fmt.Fprintln(bw, m)
+		}
+		fmt.Fprintf(bw, "#EXT-X-STREAM-INF:%s\n%s\n", strings.Join(attrs, ","), mediaPlaylist)
+		return bw.Flush()
+	})
+}
@@ -0,0 +1,103 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func TestPlaylistWriterSerialize(t *testing.T) {
+	key := &segmentKey{method: "AES-128", uri: "key.bin", iv: "0x01"}
+	init := &initSection{uri: "init.mp4"}
+	pdt := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	w := newPlaylistWriter("", localMediaPlaylist)
+	w.targetDuration = 6
+	w.add(&segment{no: 11, duration: 6, uri: "b.m4s", key: &segmentKey{method: "AES-128", uri: "key.bin", iv: "0x01"}, initSection: init})
+	w.add(&segment{no: 10, duration: 5.5, uri: "a.m4s", key: key, initSection: init, programDateTime: pdt})
+	w.add(&segment{no: 13, duration: 6, uri: "d.m4s", initSection: init})
+	w.add(&segment{no: 14, duration: 6.4, uri: "e.m4s", initSection: &initSection{uri: "init2.mp4"}, discontinuity: true})
+	// duplicated
+	w.add(&segment{no: 10, duration: 5.5, uri: "a.m4s"})
+
+	var buf bytes.Buffer
+	assert.Nil(t, w.serialize(&buf))
+	assert.Equal(t, buf.String(), `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-PLAYLIST-TYPE:EVENT
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x01
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-PROGRAM-DATE-TIME:2022-07-01T12:00:00.000Z
+#EXTINF:5.500,
+a.m4s
+#EXTINF:6.000,
+b.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:6.000,
+d.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init2.mp4"
+#EXTINF:6.400,
+e.m4s
+`)
+
+	w.end = true
+	buf.Reset()
+	assert.Nil(t, w.serialize(&buf))
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("e.m4s\n#EXT-X-ENDLIST\n")))
+}
+
+func TestWriteMasterPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	v := &variant{bandwidth: 1280000, resolution: "1280x720", codecs: "avc1.4d401f,mp4a.40.2"}
+	assert.Nil(t, writeMasterPlaylist(NewLocalStorage(dir), v, nil, localMediaPlaylist))
+
+	b, err := os.ReadFile(filepath.Join(dir, localMasterPlaylist))
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2"
+index.m3u8
+`)
+
+	// the renditions in the variant stream are kept, and the renditions of their own playlists are omitted
+	parser := playlistParser{logger: zap.NewNop()}
+	master, err := parser.parse1st(bufio.NewScanner(strings.NewReader(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="main",DEFAULT=YES,LANGUAGE="en"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="commentary",LANGUAGE="en",URI="commentary.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="ac3",NAME="main",DEFAULT=YES
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="English",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aac",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=640000,CLOSED-CAPTIONS=NONE
+360p.m3u8
+`)))
+	assert.Nil(t, err)
+	assert.Equal(t, len(master.renditions), 5)
+	assert.Nil(t, writeMasterPlaylist(NewLocalStorage(dir), master.variants[0], master.renditions, localMediaPlaylist))
+	b, err = os.ReadFile(filepath.Join(dir, localMasterPlaylist))
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="main",DEFAULT=YES,LANGUAGE="en"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="English",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aac",CLOSED-CAPTIONS="cc"
+index.m3u8
+`)
+	assert.Nil(t, writeMasterPlaylist(NewLocalStorage(dir), master.variants[1], master.renditions, localMediaPlaylist))
+	b, err = os.ReadFile(filepath.Join(dir, localMasterPlaylist))
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=640000,CLOSED-CAPTIONS=NONE
+index.m3u8
+`)
+}
@@ -0,0 +1,49 @@
+package hls_downloader
+
+import (
+	"go.uber.org/zap"
+)
+
+// backups returns the variants of the pathway which have the same key.
+// The first one is the primary stream and the rest are backup streams.
+// see RFC8216 6.2.3. Providing Redundant Streams
+func (m *masterPlaylist) backups(pathwayID, key string) []*variant {
+	var vs []*variant
+	for _, v := range m.variants {
+		if v.pathwayID == pathwayID && v.key() == key {
+			vs = append(vs, v)
+		}
+	}
+	if len(vs) == 0 {
+		if v := m.lookup(pathwayID, key); v != nil {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+// failover is called when fetches on the variant fail repeatedly.
+// It switches to the next backup stream of the pathway, and switches the pathway when all backup streams are used.
+func (ps *pathwaySelector) failover(failed *variant, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	current := ps.currentVariant()
+	if failed != current {
+		// already switched
+		return
+	}
+	vs := ps.master.backups(ps.current, ps.key)
+	if ps.backup+1 < len(vs) {
+		ps.backup++
+		ps.logger.Warn("switch to backup stream",
+			zap.Stringer("from", failed.uri), zap.Stringer("to", vs[ps.backup].uri), zap.Error(err))
+		return
+	}
+	ps.failLocked(failed.pathwayID, err)
+	if ps.currentVariant() == failed && len(vs) > 1 {
+		// there is no other pathway, back to the primary stream
+		ps.backup = 0
+		ps.logger.Warn("switch to primary stream",
+			zap.Stringer("from", failed.uri), zap.Stringer("to", vs[0].uri), zap.Error(err))
+	}
+}
@@ -0,0 +1,144 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+const redundantMasterPlaylist = `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=640000,RESOLUTION=640x360
+low/playlist.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720
+https://primary.example.com/720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=640000,RESOLUTION=640x360
+https://backup.example.com/360p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720
+https://backup.example.com/720p.m3u8
+`
+
+func TestRedundantStreamFailover(t *testing.T) {
+	parser := playlistParser{logger: zap.NewNop()}
+	master, err := parser.parse1st(bufio.NewScanner(strings.NewReader(redundantMasterPlaylist)))
+	assert.Nil(t, err)
+	base, _ := url.Parse("https://primary.example.com/master.m3u8")
+	master.resolve(base)
+
+	backups := master.backups(defaultPathwayID, master.variants[1].key())
+	assert.Equal(t, len(backups), 2)
+
+	ps := newPathwaySelector(master, master.variants[3], zap.NewNop())
+	primary := ps.variant()
+	assert.Equal(t, primary.uri.String(), "https://primary.example.com/720p.m3u8")
+	assert.True(t, ps.alternative())
+	assert.Equal(t, ps.sources(), 2)
+
+	ps.failover(primary, fmt.Errorf("timeout"))
+	backup := ps.variant()
+	assert.Equal(t, backup.uri.String(), "https://backup.example.com/720p.m3u8")
+
+	// a failure of the old variant is ignored
+	ps.failover(primary, fmt.Errorf("timeout"))
+	assert.Equal(t, ps.variant(), backup)
+
+	// all backup streams are failed, back to the primary stream
+	ps.failover(backup, fmt.Errorf("timeout"))
+	assert.Equal(t, ps.variant(), primary)
+}
+
+func TestRunAllSourcesFailed(t *testing.T) {
+	var fetches int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/master.m3u8" {
+			_, _ = fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\n/primary.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\n/backup.m3u8\n")
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	sc := newStreamingController(&Config{URI: ts.URL + "/master.m3u8", OutputDir: t.TempDir()}, zap.NewNop())
+	sc.retryInterval = time.Millisecond
+	err := sc.Run(context.Background())
+	assert.NotNil(t, err)
+	// every source has failed sourceErrMax times
+	assert.Equal(t, int(atomic.LoadInt32(&fetches)), 2*sourceErrMax)
+}
+
+func TestErrorResponsesClosed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	// the error responses are closed, or they hold the only connection
+	cli := (&Config{}).newClient(&http.Transport{MaxConnsPerHost: 1}, nil, time.Second)
+	sc := newStreamingController(&Config{URI: ts.URL + "/master.m3u8"}, zap.NewNop())
+	u, _ := url.Parse(ts.URL + "/steering.json")
+	master := &masterPlaylist{variants: []*variant{{uri: u, pathwayID: defaultPathwayID}}}
+	sp := &steeringPoller{cli: cli, uri: u, selector: newPathwaySelector(master, master.variants[0], zap.NewNop()), logger: zap.NewNop()}
+	for i := 0; i < 3; i++ {
+		err := sc.loadMaster(context.Background(), cli, io.Discard, "")
+		assert.Contains(t, fmt.Sprint(err), "503")
+		_, err = sc.downloadResource(cli, ts.URL+"/key.bin", &segment{}, nil)
+		assert.Contains(t, fmt.Sprint(err), "503")
+		_, err = sp.fetch()
+		assert.Contains(t, fmt.Sprint(err), "503")
+	}
+}
+
+func TestRunBackupSequenceGap(t *testing.T) {
+	var primaryFetches int32
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			_, _ = fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\n/p/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\n/b/index.m3u8\n")
+		case "/p/index.m3u8":
+			if atomic.AddInt32(&primaryFetches, 1) > 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:1,\n1.ts\n#EXTINF:1,\n2.ts\n")
+		case "/b/index.m3u8":
+			// the backup stream is ahead of the primary stream
+			_, _ = fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:1,\n5.ts\n#EXTINF:1,\n6.ts\n")
+		case "/b/6.ts":
+			close(done)
+		}
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	sc := newStreamingController(&Config{URI: ts.URL + "/master.m3u8", OutputDir: dir}, zap.NewNop())
+	sc.retryInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		// wait for the download result
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	assert.Nil(t, sc.Run(ctx))
+
+	state, err := readJournal(NewLocalStorage(dir), zap.NewNop())
+	assert.Nil(t, err)
+	var nos []int
+	for _, s := range state.segments {
+		nos = append(nos, s.no)
+		assert.Equal(t, s.discontinuity, s.no == 5)
+	}
+	assert.Equal(t, nos, []int{1, 2, 5, 6})
+}
@@ -0,0 +1,581 @@
+package hls_downloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+const (
+	OutputFormatTS  = "ts"
+	OutputFormatMP4 = "mp4"
+	// OutputFormatFMP4 is fragmented MP4 which has a fragment per segment.
+	OutputFormatFMP4 = "fmp4"
+)
+
+// RemuxOptions enables remuxing the recorded MPEG-TS segments into a MP4 file.
+type RemuxOptions struct {
+	// Output is the path of the MP4 file. The default is recording.mp4 in the output directory.
+	Output string
+	// Fragmented writes fragmented MP4 instead of progressive MP4.
+	Fragmented bool
+}
+
+// RemuxReport is the result of remuxing.
+type RemuxReport struct {
+	Output   string           `json:"output"`
+	Segments int              `json:"segments"`
+	Tracks   []string         `json:"tracks"`
+	Duration float64          `json:"duration"`
+	Skipped  []SkippedSegment `json:"skipped"`
+}
+
+const (
+	defaultRemuxOutput = "recording.mp4"
+	tsTimescale        = 90000
+	// tsTimestampJump is treated as a discontinuity of timestamps. 10 sec
+	tsTimestampJump = 10 * tsTimescale
+	aacFrameSamples = 1024
+)
+
+// errParameterSetChanged is the change of SPS, PPS or VPS in a track, which needs another sample entry.
+var errParameterSetChanged = xerrors.New("the change of the parameter sets is not supported")
+
+type remuxSample struct {
+	mp4Sample
+	// dts is in the media timescale from the first sample.
+	dts  int64
+	data []byte
+}
+
+// remuxTrack converts PES packets of an elementary stream into samples.
+type remuxTrack struct {
+	codec string
+	mp4   *mp4Track
+	// parameter sets
+	vps, sps, pps []byte
+
+	// continuous timestamp in 90kHz
+	lastRaw       int64
+	current       int64
+	discontinuity bool
+	firstDTS      int64
+	firstPTS      int64
+	started       bool
+
+	pending  *remuxSample
+	samples  []*remuxSample
+	duration int64
+	// baseDecodeTime is the decode time of samples in the media timescale.
+	baseDecodeTime int64
+}
+
+// timestamp converts a 33 bits timestamp into the continuous timestamp.
+// A wrap around is unwrapped and a jump is removed.
+func (t *remuxTrack) timestamp(raw int64) int64 {
+	if !t.started {
+		t.started = true
+		t.lastRaw = raw
+		t.current = raw
+		return raw
+	}
+	delta := raw - t.lastRaw
+	if delta < -(1 << 32) {
+		delta += 1 << 33
+	} else if delta > 1<<32 {
+		delta -= 1 << 33
+	}
+	t.lastRaw = raw
+	if t.discontinuity || delta < -tsTimestampJump || delta > tsTimestampJump {
+		// continue from the end of the last sample
+		t.discontinuity = false
+		t.current = t.firstDTS
+		if t.pending != nil {
+			t.current += (t.pending.dts + t.duration) * tsTimescale / int64(t.mp4.timescale)
+		}
+		return t.current
+	}
+	t.current += delta
+	return t.current
+}
+
+// push adds a sample. The duration of the previous sample is determined by the decode time.
+func (t *remuxTrack) push(dts int64, cto int32, sync bool, data []byte) {
+	if t.pending != nil {
+		d := dts - t.pending.dts
+		if d <= 0 {
+			d = t.duration
+		}
+		t.duration = d
+		t.pending.duration = uint32(d)
+		t.samples = append(t.samples, t.pending)
+	}
+	t.pending = &remuxSample{mp4Sample: mp4Sample{cto: cto, sync: sync}, dts: dts, data: data}
+}
+
+// setParameterSet sets SPS, PPS or VPS. It fails if the sample entry is created from another one.
+func (t *remuxTrack) setParameterSet(p *[]byte, nalu []byte) error {
+	if t.mp4.sampleEntry != nil && !bytes.Equal(*p, nalu) {
+		return errParameterSetChanged
+	}
+	*p = nalu
+	return nil
+}
+
+// finish determines the duration of the last sample.
+func (t *remuxTrack) finish() {
+	if t.pending == nil {
+		return
+	}
+	t.pending.duration = uint32(t.duration)
+	t.samples = append(t.samples, t.pending)
+	t.pending = nil
+}
+
+// remuxer converts PES packets into samples of the tracks.
+type remuxer struct {
+	tracks map[int]*remuxTrack
+	order  []*remuxTrack
+	logger *zap.Logger
+}
+
+func newRemuxer(logger *zap.Logger) *remuxer {
+	return &remuxer{tracks: map[int]*remuxTrack{}, logger: logger}
+}
+
+// remuxState is the state of the tracks before a segment.
+type remuxState struct {
+	tracks []remuxTrack
+	mp4    []mp4Track
+}
+
+// save returns the state to restore it when the segment is skipped.
+// It is called after the samples of the previous segment are flushed.
+func (r *remuxer) save() *remuxState {
+	s := &remuxState{}
+	for _, t := range r.order {
+		s.tracks = append(s.tracks, *t)
+		s.mp4 = append(s.mp4, *t.mp4)
+	}
+	return s
+}
+
+// restore discards the samples and the tracks of the skipped segment.
+func (r *remuxer) restore(s *remuxState) {
+	for i := range s.tracks {
+		*r.order[i] = s.tracks[i]
+		*r.order[i].mp4 = s.mp4[i]
+	}
+	for _, t := range r.order[len(s.tracks):] {
+		for pid, v := range r.tracks {
+			if v == t {
+				delete(r.tracks, pid)
+			}
+		}
+	}
+	r.order = r.order[:len(s.tracks)]
+}
+
+// discontinuity resets the timestamps at EXT-X-DISCONTINUITY.
+func (r *remuxer) discontinuity() {
+	for _, t := range r.tracks {
+		t.discontinuity = true
+	}
+}
+
+func (r *remuxer) track(pes *pesPacket) *remuxTrack {
+	if t, ok := r.tracks[pes.pid]; ok {
+		return t
+	}
+	t := &remuxTrack{mp4: &mp4Track{id: uint32(len(r.order) + 1)}}
+	switch pes.streamType {
+	case streamTypeH264:
+		t.codec = "h264"
+		t.mp4.handler = "vide"
+		t.mp4.timescale = tsTimescale
+	case streamTypeH265:
+		t.codec = "h265"
+		t.mp4.handler = "vide"
+		t.mp4.timescale = tsTimescale
+	case streamTypeAAC:
+		t.codec = "aac"
+		t.mp4.handler = "soun"
+	default:
+		r.logger.Warn("unsupported stream is ignored", zap.Int("pid", pes.pid), zap.Uint8("streamType", pes.streamType))
+		t = nil
+	}
+	r.tracks[pes.pid] = t
+	if t != nil {
+		r.order = append(r.order, t)
+	}
+	return t
+}
+
+func (r *remuxer) onPES(pes *pesPacket) error {
+	t := r.track(pes)
+	if t == nil || pes.pts < 0 {
+		return nil
+	}
+	if t.codec == "aac" {
+		return r.onAudio(t, pes)
+	}
+	return r.onVideo(t, pes)
+}
+
+func (r *remuxer) onVideo(t *remuxTrack, pes *pesPacket) error {
+	var data []byte
+	sync := false
+	for _, nalu := range splitNALUnits(pes.data) {
+		if len(nalu) < 2 {
+			continue
+		}
+		if t.codec == "h264" {
+			switch h264NALType(nalu) {
+			case h264NALAUD:
+				continue
+			case h264NALSPS:
+				if err := t.setParameterSet(&t.sps, nalu); err != nil {
+					return err
+				}
+			case h264NALPPS:
+				if err := t.setParameterSet(&t.pps, nalu); err != nil {
+					return err
+				}
+			case h264NALIDR:
+				sync = true
+			}
+		} else {
+			switch typ := h265NALType(nalu); {
+			case typ == h265NALAUD:
+				continue
+			case typ == h265NALVPS:
+				if err := t.setParameterSet(&t.vps, nalu); err != nil {
+					return err
+				}
+			case typ == h265NALSPS:
+				if err := t.setParameterSet(&t.sps, nalu); err != nil {
+					return err
+				}
+			case typ == h265NALPPS:
+				if err := t.setParameterSet(&t.pps, nalu); err != nil {
+					return err
+				}
+			case typ >= h265NALBLAWLP && typ <= h265NALCRANUT:
+				sync = true
+			}
+		}
+		data = append(data, u32(uint32(len(nalu)))...)
+		data = append(data, nalu...)
+	}
+	if t.mp4.sampleEntry == nil {
+		if !sync {
+			// wait for the first random access point
+			return nil
+		}
+		if err := t.sampleEntry(); err != nil {
+			return err
+		}
+		if t.mp4.sampleEntry == nil {
+			return nil
+		}
+	}
+	cto := pes.pts - pes.dts
+	if cto < -(1 << 32) {
+		// PTS wraps around
+		cto += 1 << 33
+	}
+	first := !t.started
+	dts := t.timestamp(pes.dts)
+	if first {
+		t.firstDTS = dts
+		t.firstPTS = dts + cto
+	}
+	t.push(dts-t.firstDTS, int32(cto), sync, data)
+	return nil
+}
+
+// sampleEntry creates the sample entry from the parameter sets.
+func (t *remuxTrack) sampleEntry() error {
+	if t.sps == nil || t.pps == nil || (t.codec == "h265" && t.vps == nil) {
+		return nil
+	}
+	if t.codec == "h264" {
+		info, err := parseH264SPS(t.sps)
+		if err != nil {
+			return err
+		}
+		t.mp4.width, t.mp4.height = info.width, info.height
+		t.mp4.sampleEntry = avcSampleEntry(t.sps, t.pps, info)
+		return nil
+	}
+	info, err := parseH265SPS(t.sps)
+	if err != nil {
+		return err
+	}
+	t.mp4.width, t.mp4.height = info.width, info.height
+	t.mp4.sampleEntry = hevcSampleEntry(t.vps, t.sps, t.pps, info)
+	return nil
+}
+
+func (r *remuxer) onAudio(t *remuxTrack, pes *pesPacket) error {
+	frames, err := parseADTS(pes.data)
+	if err != nil {
+		r.logger.Warn("invalid ADTS", zap.Int("pid", pes.pid), zap.Error(err))
+	}
+	if len(frames) == 0 {
+		return nil
+	}
+	if t.mp4.sampleEntry == nil {
+		t.mp4.timescale = uint32(frames[0].sampleRate)
+		t.mp4.sampleEntry = aacSampleEntry(frames[0])
+		t.duration = aacFrameSamples
+	}
+	first := !t.started
+	pts := t.timestamp(pes.pts)
+	if first {
+		t.firstDTS = pts
+		t.firstPTS = pts
+	}
+	dts := (pts - t.firstDTS) * int64(t.mp4.timescale) / tsTimescale
+	if t.pending != nil {
+		// ignore the rounding error of the timestamp
+		if expected := t.pending.dts + aacFrameSamples; dts > expected-aacFrameSamples/2 && dts < expected+aacFrameSamples/2 {
+			dts = expected
+		}
+	}
+	for i, f := range frames {
+		t.push(dts+int64(i*aacFrameSamples), 0, true, f.data)
+	}
+	return nil
+}
+
+// mp4Tracks returns the tracks which have the sample entry and sets the start time to align them.
+func (r *remuxer) mp4Tracks() []*mp4Track {
+	var tracks []*mp4Track
+	var first int64 = -1
+	for _, t := range r.order {
+		if t.mp4.sampleEntry != nil && (first < 0 || t.firstPTS < first) {
+			first = t.firstPTS
+		}
+	}
+	for _, t := range r.order {
+		if t.mp4.sampleEntry == nil {
+			continue
+		}
+		t.mp4.id = uint32(len(tracks) + 1)
+		t.mp4.startTime = (t.firstPTS - first) * mp4MovieTimescale / tsTimescale
+		tracks = append(tracks, t.mp4)
+	}
+	return tracks
+}
+
+// remuxOutput writes the samples of the tracks.
+type remuxOutput interface {
+	// flush writes the completed samples at the end of a segment.
+	flush(r *remuxer) error
+	close(r *remuxer) error
+}
+
+type progressiveRemuxOutput struct {
+	f *os.File
+	w *progressiveMP4Writer
+}
+
+func (o *progressiveRemuxOutput) flush(r *remuxer) error {
+	if o.w == nil {
+		w, err := newProgressiveMP4Writer(o.f, nil)
+		if err != nil {
+			return err
+		}
+		o.w = w
+	}
+	for _, t := range r.order {
+		for _, s := range t.samples {
+			if err := o.w.writeSample(t.mp4, s.mp4Sample, s.data); err != nil {
+				return err
+			}
+		}
+		t.samples = nil
+	}
+	return nil
+}
+
+func (o *progressiveRemuxOutput) close(r *remuxer) error {
+	if err := o.flush(r); err != nil {
+		return err
+	}
+	o.w.tracks = r.mp4Tracks()
+	return o.w.close()
+}
+
+type fragmentedRemuxOutput struct {
+	f        *os.File
+	tracks   []*mp4Track
+	sequence uint32
+}
+
+func (o *fragmentedRemuxOutput) flush(r *remuxer) error {
+	if o.tracks == nil {
+		o.tracks = r.mp4Tracks()
+		if len(o.tracks) == 0 {
+			return nil
+		}
+		if err := writeMP4Init(o.f, o.tracks); err != nil {
+			return err
+		}
+		first := int64(-1)
+		for _, t := range r.order {
+			if t.started && (first < 0 || t.firstDTS < first) {
+				first = t.firstDTS
+			}
+		}
+		for _, t := range r.order {
+			// align the tracks by the decode time
+			t.baseDecodeTime = (t.firstDTS - first) * int64(t.mp4.timescale) / tsTimescale
+		}
+	}
+	var fragments []*mp4Fragment
+	for _, t := range r.order {
+		if len(t.samples) == 0 {
+			continue
+		}
+		if !o.has(t.mp4) {
+			r.logger.Warn("track which starts after the first segment is ignored", zap.String("codec", t.codec))
+			t.samples = nil
+			continue
+		}
+		f := &mp4Fragment{track: t.mp4, baseDecodeTime: uint64(t.baseDecodeTime)}
+		for _, s := range t.samples {
+			s.size = uint32(len(s.data))
+			f.samples = append(f.samples, s.mp4Sample)
+			f.data = append(f.data, s.data...)
+			t.baseDecodeTime += int64(s.duration)
+			// only for the duration of the report. the sample table of the init section is empty.
+			t.mp4.samples = append(t.mp4.samples, mp4Sample{duration: s.duration})
+		}
+		t.samples = nil
+		fragments = append(fragments, f)
+	}
+	if len(fragments) == 0 {
+		return nil
+	}
+	o.sequence++
+	return writeMP4Fragment(o.f, o.sequence, fragments)
+}
+
+func (o *fragmentedRemuxOutput) has(t *mp4Track) bool {
+	for _, v := range o.tracks {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *fragmentedRemuxOutput) close(r *remuxer) error {
+	return o.flush(r)
+}
+
+// Remux converts the recorded MPEG-TS segments in the output directory into a MP4 file
+// in order of the media sequence. H.264, H.265 and AAC are supported.
+// Segments which are not downloaded or can't be read are skipped and reported.
+// A segment whose SPS, PPS or VPS differs from the first ones is also skipped, since a track has a sample entry.
+func (app *App) Remux(opt *RemuxOptions) (*RemuxReport, error) {
+	dir := app.Config.OutputDir
+	p, err := loadLocalPlaylist(dir)
+	if err != nil {
+		return nil, err
+	}
+	output := opt.Output
+	if output == "" {
+		output = filepath.Join(dir, defaultRemuxOutput)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return nil, xerrors.Errorf("os.Create failed: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var out remuxOutput = &progressiveRemuxOutput{f: f}
+	if opt.Fragmented {
+		out = &fragmentedRemuxOutput{f: f}
+	}
+	r := newRemuxer(app.Logger)
+	demuxer := newTSDemuxer(r.onPES)
+	report := &RemuxReport{Output: output, Tracks: []string{}, Skipped: []SkippedSegment{}}
+	for _, s := range p.segments {
+		reason := ""
+		path := filepath.Join(dir, filepath.FromSlash(s.uri))
+		if s.gap {
+			reason = "not downloaded"
+		} else if s.key != nil && s.key.method != "NONE" {
+			reason = "encrypted segment is not supported"
+		} else if s.initSection != nil {
+			reason = "fMP4 segment is not supported"
+		}
+		var data []byte
+		if reason == "" {
+			data, err = os.ReadFile(path)
+			if err != nil {
+				reason = err.Error()
+			}
+		}
+		if reason == "" {
+			// write the samples of the previous segment.
+			// the samples of the last segment are written with the last sample of the tracks.
+			if err := out.flush(r); err != nil {
+				return nil, err
+			}
+			if s.discontinuity {
+				r.discontinuity()
+			}
+			state := r.save()
+			err = demuxer.feed(data)
+			if err == nil {
+				err = demuxer.flush()
+			}
+			if err != nil {
+				reason = err.Error()
+				// discard the samples of the segment
+				r.restore(state)
+				demuxer = newTSDemuxer(r.onPES)
+			}
+		}
+		if reason != "" {
+			report.Skipped = append(report.Skipped, SkippedSegment{No: s.no, URI: s.uri, Reason: reason})
+			continue
+		}
+		report.Segments++
+	}
+	for _, t := range r.order {
+		t.finish()
+	}
+	if len(r.mp4Tracks()) == 0 {
+		return nil, xerrors.New("no supported stream is found")
+	}
+	if err := out.close(r); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, xerrors.Errorf("Close failed: %w", err)
+	}
+	for _, t := range r.mp4Tracks() {
+		for _, rt := range r.order {
+			if rt.mp4 == t {
+				report.Tracks = append(report.Tracks, rt.codec)
+			}
+		}
+		if d := float64(t.startTime)/mp4MovieTimescale + float64(t.duration())/float64(t.timescale); d > report.Duration {
+			report.Duration = d
+		}
+	}
+	app.Logger.Info("remuxed",
+		zap.String("output", report.Output),
+		zap.Strings("tracks", report.Tracks),
+		zap.Int("segments", report.Segments),
+		zap.Int("skipped", len(report.Skipped)))
+	return report, nil
+}
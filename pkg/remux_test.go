@@ -0,0 +1,333 @@
+package hls_downloader
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+type testBitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *testBitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>i&1) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+func (w *testBitWriter) ue(v uint32) {
+	n := 0
+	for (v+1)>>n > 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v+1, n+1)
+}
+
+// testH264SPS returns a baseline profile SPS.
+func testH264SPS(width, height int) []byte {
+	w := &testBitWriter{}
+	w.bits(0x67, 8)
+	w.bits(66, 8)
+	w.bits(0xc0, 8)
+	w.bits(30, 8)
+	w.ue(0)
+	// log2_max_frame_num_minus4, pic_order_cnt_type, max_num_ref_frames
+	w.ue(0)
+	w.ue(2)
+	w.ue(1)
+	w.bits(0, 1)
+	w.ue(uint32((width+15)/16 - 1))
+	w.ue(uint32((height+15)/16 - 1))
+	// frame_mbs_only_flag, direct_8x8_inference_flag
+	w.bits(1, 1)
+	w.bits(1, 1)
+	if crop := (16 - height%16) % 16; crop > 0 {
+		w.bits(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(uint32(crop / 2))
+	} else {
+		w.bits(0, 1)
+	}
+	// vui_parameters_present_flag, rbsp_stop_one_bit
+	w.bits(0, 1)
+	w.bits(1, 1)
+	return w.b
+}
+
+// testADTS returns an AAC-LC 48kHz stereo frame.
+func testADTS(data []byte) []byte {
+	l := 7 + len(data)
+	header := []byte{0xff, 0xf1, 1<<6 | 3<<2, 2<<6 | byte(l>>11), byte(l >> 3), byte(l<<5) | 0x1f, 0xfc}
+	return append(header, data...)
+}
+
+func TestParseH264SPS(t *testing.T) {
+	info, err := parseH264SPS(testH264SPS(1280, 720))
+	assert.Nil(t, err)
+	assert.Equal(t, *info, videoInfo{width: 1280, height: 720})
+	info, err = parseH264SPS(testH264SPS(1920, 1080))
+	assert.Nil(t, err)
+	assert.Equal(t, *info, videoInfo{width: 1920, height: 1080})
+
+	_, err = parseH264SPS([]byte{0x67, 66})
+	assert.True(t, err != nil)
+}
+
+func TestParseH265SPS(t *testing.T) {
+	w := &testBitWriter{}
+	w.bits(0x4201, 16)
+	// sps_video_parameter_set_id, sps_max_sub_layers_minus1, sps_temporal_id_nesting_flag
+	w.bits(0, 4)
+	w.bits(0, 3)
+	w.bits(1, 1)
+	// Main profile, level 4.1
+	w.bits(1, 8)
+	w.bits(0x60000000, 32)
+	w.bits(0x9000, 16)
+	w.bits(0, 32)
+	w.bits(123, 8)
+	w.ue(0)
+	w.ue(1)
+	w.ue(1920)
+	w.ue(1088)
+	// conformance window
+	w.bits(1, 1)
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(4)
+	w.ue(0)
+	w.ue(0)
+	w.bits(1, 1)
+
+	sps, err := parseH265SPS(w.b)
+	assert.Nil(t, err)
+	assert.Equal(t, sps.videoInfo, videoInfo{width: 1920, height: 1080})
+	assert.Equal(t, sps.generalProfileTierLevel, []byte{1, 0x60, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 123})
+	assert.Equal(t, sps.chromaFormat, 1)
+	assert.Equal(t, sps.bitDepthLuma, 8)
+	assert.Equal(t, sps.maxSubLayers, 1)
+	assert.True(t, sps.temporalIDNesting)
+}
+
+func TestParseADTS(t *testing.T) {
+	frames, err := parseADTS(append(testADTS([]byte("a")), testADTS([]byte("bc"))...))
+	assert.Nil(t, err)
+	assert.Equal(t, len(frames), 2)
+	assert.Equal(t, frames[0].sampleRate, 48000)
+	assert.Equal(t, frames[0].channels, 2)
+	assert.Equal(t, frames[0].objectType, 2)
+	assert.Equal(t, frames[1].data, []byte("bc"))
+	// AAC-LC, 48kHz, 2ch
+	assert.Equal(t, frames[0].audioSpecificConfig(), []byte{0x11, 0x90})
+
+	_, err = parseADTS([]byte{0xff, 0xf1, 0})
+	assert.True(t, err != nil)
+}
+
+const testFrameDuration = 3840
+
+// testTSSegment returns a segment which has video frames of 3840/90000 sec and two AAC frames for each video frame.
+func testTSSegment(start int64, frames int) []byte {
+	m := newTestTSMuxer(map[int]byte{testVideoPID: streamTypeH264, testAudioPID: streamTypeAAC})
+	return m.segment(start, frames)
+}
+
+// segment returns the next segment. The continuity counters continue from the previous segment.
+func (m *testTSMuxer) segment(start int64, frames int) []byte {
+	m.out = nil
+	m.tables()
+	for i := 0; i < frames; i++ {
+		dts := (start + int64(i*testFrameDuration)) % (1 << 33)
+		video := []byte{0, 0, 0, 1, 0x09, 0xf0}
+		if i == 0 {
+			video = append(video, 0, 0, 0, 1)
+			sps := m.sps
+			if sps == nil {
+				sps = testH264SPS(320, 240)
+			}
+			video = append(video, sps...)
+			video = append(video, 0, 0, 0, 1, 0x68, 0xce, 0x38, 0x80)
+			video = append(video, 0, 0, 1, 0x65, 0x88, 0x80, byte(i))
+		} else {
+			video = append(video, 0, 0, 1, 0x41, 0x9a, byte(i))
+		}
+		m.pes(testVideoPID, (dts+testFrameDuration)%(1<<33), dts, video)
+		m.pes(testAudioPID, dts, dts, append(testADTS([]byte{byte(2 * i)}), testADTS([]byte{byte(2*i + 1)})...))
+	}
+	return m.out
+}
+
+// testFindBox returns the payload of the box in the path.
+func testFindBox(b []byte, path ...string) []byte {
+	boxes := testFindBoxes(b, path[0])
+	if len(boxes) == 0 {
+		return nil
+	}
+	if len(path) == 1 {
+		return boxes[0]
+	}
+	return testFindBox(boxes[0], path[1:]...)
+}
+
+// testFindBoxes returns the payloads of the boxes of the type.
+func testFindBoxes(b []byte, typ string) [][]byte {
+	var boxes [][]byte
+	for len(b) >= 8 {
+		size, header := int(binary.BigEndian.Uint32(b)), 8
+		if size == 1 {
+			size, header = int(binary.BigEndian.Uint64(b[8:])), 16
+		}
+		if string(b[4:8]) == typ {
+			boxes = append(boxes, b[header:size])
+		}
+		b = b[size:]
+	}
+	return boxes
+}
+
+func testRemuxDir(t *testing.T) string {
+	dir := t.TempDir()
+	w := newPlaylistWriter(dir, localMediaPlaylist)
+	w.add(&segment{no: 1, duration: 0.17, uri: "1.ts"})
+	w.add(&segment{no: 2, duration: 0.17, uri: "2.ts", discontinuity: true})
+	w.add(&segment{no: 3, duration: 0.17, uri: "3.ts"})
+	w.add(&segment{no: 4, duration: 0.17, uri: "4.ts", gap: true})
+	w.end = true
+	assert.Nil(t, w.write())
+	// the timestamps are reset at the discontinuity and wrap around in 3.ts
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "1.ts"), testTSSegment(900000, 4), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "2.ts"), testTSSegment(1<<33-2*testFrameDuration, 4), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "3.ts"), testTSSegment(2*testFrameDuration, 4), 0644))
+	return dir
+}
+
+func TestRemux(t *testing.T) {
+	dir := testRemuxDir(t)
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	report, err := app.Remux(&RemuxOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Output, filepath.Join(dir, "recording.mp4"))
+	assert.Equal(t, report.Segments, 3)
+	assert.Equal(t, report.Tracks, []string{"h264", "aac"})
+	assert.Equal(t, report.Skipped, []SkippedSegment{{No: 4, URI: "4.ts", Reason: "not downloaded"}})
+
+	b, err := os.ReadFile(report.Output)
+	assert.Nil(t, err)
+	assert.Equal(t, string(testFindBox(b, "ftyp")[:4]), "isom")
+	traks := testFindBoxes(testFindBox(b, "moov"), "trak")
+	assert.Equal(t, len(traks), 2)
+
+	video := testFindBox(traks[0], "mdia", "minf", "stbl")
+	assert.Equal(t, string(testFindBox(video, "stsd")[12:16]), "avc1")
+	assert.Equal(t, testFindBox(video, "stts")[4:], []byte{0, 0, 0, 1, 0, 0, 0, 12, 0, 0, 0x0f, 0})
+	assert.Equal(t, testFindBox(video, "ctts")[4:], []byte{0, 0, 0, 1, 0, 0, 0, 12, 0, 0, 0x0f, 0})
+	assert.Equal(t, testFindBox(video, "stss")[4:], []byte{0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 5, 0, 0, 0, 9})
+	// the video starts after the audio by the composition offset
+	elst := testFindBox(traks[0], "edts", "elst")
+	assert.Equal(t, binary.BigEndian.Uint32(elst[4:]), uint32(2))
+	assert.Equal(t, binary.BigEndian.Uint64(elst[8:]), uint64(42))
+	assert.Equal(t, binary.BigEndian.Uint64(elst[36:]), uint64(testFrameDuration))
+	// width and height of tkhd
+	tkhd := testFindBox(traks[0], "tkhd")
+	assert.Equal(t, tkhd[len(tkhd)-8:], []byte{1, 0x40, 0, 0, 0, 0xf0, 0, 0})
+
+	// the first sample starts with SPS without AUD
+	stco := testFindBox(video, "stco")
+	offset := binary.BigEndian.Uint32(stco[8:])
+	assert.Equal(t, b[offset+4], byte(0x67))
+
+	audio := testFindBox(traks[1], "mdia", "minf", "stbl")
+	assert.Equal(t, string(testFindBox(audio, "stsd")[12:16]), "mp4a")
+	assert.Equal(t, testFindBox(audio, "stts")[4:], []byte{0, 0, 0, 1, 0, 0, 0, 24, 0, 0, 4, 0})
+	stsz := testFindBox(audio, "stsz")
+	assert.Equal(t, binary.BigEndian.Uint32(stsz[8:]), uint32(24))
+	assert.Equal(t, binary.BigEndian.Uint32(stsz[12:]), uint32(1))
+	mdhd := testFindBox(traks[1], "mdia", "mdhd")
+	assert.Equal(t, binary.BigEndian.Uint32(mdhd[20:]), uint32(48000))
+	assert.Equal(t, binary.BigEndian.Uint64(mdhd[24:]), uint64(24*1024))
+}
+
+func TestRemuxFragmented(t *testing.T) {
+	dir := testRemuxDir(t)
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	output := filepath.Join(dir, "out.mp4")
+	report, err := app.Remux(&RemuxOptions{Output: output, Fragmented: true})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Segments, 3)
+
+	b, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	assert.Equal(t, string(testFindBox(b, "ftyp")[:4]), "iso6")
+	assert.True(t, testFindBox(b, "moov", "mvex") != nil)
+	moofs := testFindBoxes(b, "moof")
+	assert.Equal(t, len(moofs), 3)
+	assert.Equal(t, len(testFindBoxes(b, "mdat")), 3)
+
+	trafs := testFindBoxes(moofs[1], "traf")
+	assert.Equal(t, len(trafs), 2)
+	// the last video sample of a segment waits for the next decode time
+	trun := testFindBox(trafs[0], "trun")
+	assert.Equal(t, binary.BigEndian.Uint32(trun[4:]), uint32(4))
+	tfdt := testFindBox(trafs[0], "tfdt")
+	assert.Equal(t, binary.BigEndian.Uint64(tfdt[4:]), uint64(3*testFrameDuration))
+	tfdt = testFindBox(trafs[1], "tfdt")
+	assert.Equal(t, binary.BigEndian.Uint64(tfdt[4:]), uint64(7*1024))
+}
+
+func TestRemuxParameterSetChanged(t *testing.T) {
+	dir := testRemuxDir(t)
+	m := newTestTSMuxer(map[int]byte{testVideoPID: streamTypeH264, testAudioPID: streamTypeAAC})
+	m.sps = testH264SPS(640, 480)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "2.ts"), m.segment(1<<33-2*testFrameDuration, 4), 0644))
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	report, err := app.Remux(&RemuxOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Segments, 2)
+	assert.Equal(t, report.Skipped[0], SkippedSegment{No: 2, URI: "2.ts", Reason: errParameterSetChanged.Error()})
+
+	// the samples of the skipped segment are discarded
+	b, err := os.ReadFile(report.Output)
+	assert.Nil(t, err)
+	traks := testFindBoxes(testFindBox(b, "moov"), "trak")
+	stsz := testFindBox(traks[1], "mdia", "minf", "stbl", "stsz")
+	assert.Equal(t, binary.BigEndian.Uint32(stsz[8:]), uint32(16))
+}
+
+func TestAACSampleEntry(t *testing.T) {
+	for _, tt := range []struct {
+		sampleRate int
+		field      uint32
+	}{
+		{sampleRate: 48000, field: 48000 << 16},
+		// 96kHz doesn't fit in 16.16 fixed point
+		{sampleRate: 96000, field: 0},
+	} {
+		entry := aacSampleEntry(&adtsFrame{objectType: 2, sampleRate: tt.sampleRate, channels: 2})
+		assert.Equal(t, binary.BigEndian.Uint32(entry[32:]), tt.field)
+	}
+}
+
+func TestRemuxNoStream(t *testing.T) {
+	dir := t.TempDir()
+	w := newPlaylistWriter(dir, localMediaPlaylist)
+	w.add(&segment{no: 1, duration: 6, uri: "1.ts", gap: true})
+	w.end = true
+	assert.Nil(t, w.write())
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	_, err := app.Remux(&RemuxOptions{})
+	assert.True(t, err != nil)
+}
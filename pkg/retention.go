@@ -0,0 +1,116 @@
+package hls_downloader
+
+import (
+	"time"
+)
+
+// RetentionOptions keeps only the last segments in the output directory like a DVR ring buffer.
+// The local media playlist becomes a sliding window playlist.
+type RetentionOptions struct {
+	// Duration is the maximum total duration of the segments. 0 is unlimited. i.g. 30 * time.Minute
+	Duration time.Duration
+	// Bytes is the maximum total size of the segment files. 0 is unlimited.
+	Bytes int64
+}
+
+// segmentRetention removes the oldest segments from the local media playlist and deletes their files.
+// Only the segments in the playlist are removed, so the files being written are never deleted.
+type segmentRetention struct {
+	opt     *RetentionOptions
+	storage Storage
+	// sizes are the file sizes of the segments in the playlist.
+	sizes map[int]int64
+}
+
+func newSegmentRetention(opt *RetentionOptions, storage Storage) *segmentRetention {
+	return &segmentRetention{opt: opt, storage: storage, sizes: map[int]int64{}}
+}
+
+func (r *segmentRetention) size(seg *segment) int64 {
+	size, ok := r.sizes[seg.no]
+	if !ok {
+		if !seg.gap {
+			size, _ = storageObjectSize(r.storage, seg.uri)
+		}
+		r.sizes[seg.no] = size
+	}
+	return size
+}
+
+// evict removes the oldest segments from the playlist until the rest are within the limits.
+// The last segment is always kept. It returns the removed segments.
+func (r *segmentRetention) evict(w *playlistWriter) []*segment {
+	var duration time.Duration
+	var bytes int64
+	for _, s := range w.segments {
+		duration += time.Duration(s.duration * float64(time.Second))
+		bytes += r.size(s)
+	}
+	n := 0
+	for ; n < len(w.segments)-1; n++ {
+		if (r.opt.Duration <= 0 || duration <= r.opt.Duration) && (r.opt.Bytes <= 0 || bytes <= r.opt.Bytes) {
+			break
+		}
+		s := w.segments[n]
+		duration -= time.Duration(s.duration * float64(time.Second))
+		bytes -= r.size(s)
+	}
+	removed := w.remove(n)
+	for _, s := range removed {
+		delete(r.sizes, s.no)
+	}
+	return removed
+}
+
+// remove deletes the files of the removed segments.
+// Keys and init sections are deleted unless the segments in use refer to them.
+// It returns the deleted URIs of keys and init sections.
+func (r *segmentRetention) remove(removed []*segment, inUse []*segment) ([]string, error) {
+	used := map[string]bool{}
+	for _, s := range inUse {
+		if s.key != nil {
+			used[s.key.uri] = true
+		}
+		if s.initSection != nil {
+			used[s.initSection.uri] = true
+		}
+	}
+	var resources []string
+	var errs []error
+	deleteFile := func(uri string) {
+		if err := r.storage.Delete(uri); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, s := range removed {
+		if !s.gap {
+			deleteFile(s.uri)
+		}
+		for _, uri := range []string{segmentKeyURI(s), segmentInitURI(s)} {
+			if uri != "" && !used[uri] {
+				// deleted once
+				used[uri] = true
+				deleteFile(uri)
+				resources = append(resources, uri)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return resources, errs[0]
+	}
+	return resources, nil
+}
+
+func segmentKeyURI(s *segment) string {
+	if s.key == nil {
+		return ""
+	}
+	return s.key.uri
+}
+
+func segmentInitURI(s *segment) string {
+	if s.initSection == nil {
+		return ""
+	}
+	return s.initSection.uri
+}
@@ -0,0 +1,120 @@
+package hls_downloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func testRetentionDir(t *testing.T, names ...string) string {
+	dir := t.TempDir()
+	for _, name := range names {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), make([]byte, 100), 0644))
+	}
+	return dir
+}
+
+func testExists(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	return err == nil
+}
+
+func TestSegmentRetention(t *testing.T) {
+	dir := testRetentionDir(t, "key1", "key2", "1.ts", "2.ts", "4.ts", "5.ts")
+	key1, key2 := &segmentKey{method: "AES-128", uri: "key1"}, &segmentKey{method: "AES-128", uri: "key2"}
+	w := newPlaylistWriter(dir, localMediaPlaylist)
+	w.sliding = true
+	w.add(&segment{no: 1, duration: 6, uri: "1.ts", key: key1})
+	w.add(&segment{no: 2, duration: 6, uri: "2.ts", key: key1})
+	w.add(&segment{no: 3, duration: 6, uri: "3.ts", gap: true})
+	w.add(&segment{no: 4, duration: 6, uri: "4.ts", key: key2, discontinuity: true})
+	w.add(&segment{no: 5, duration: 6, uri: "5.ts", key: key2})
+
+	// 18 sec
+	r := newSegmentRetention(&RetentionOptions{Duration: 18 * time.Second}, NewLocalStorage(dir))
+	removed := r.evict(w)
+	assert.Equal(t, len(removed), 2)
+	assert.Equal(t, w.segments[0].no, 3)
+	resources, err := r.remove(removed, w.segments)
+	assert.Nil(t, err)
+	assert.Equal(t, resources, []string{"key1"})
+	assert.False(t, testExists(dir, "1.ts"))
+	assert.False(t, testExists(dir, "key1"))
+	assert.True(t, testExists(dir, "4.ts"))
+
+	// 200 bytes. the gap segment has no file
+	r.opt = &RetentionOptions{Bytes: 200}
+	assert.Equal(t, len(r.evict(w)), 0)
+	r.opt.Bytes = 199
+	removed = r.evict(w)
+	assert.Equal(t, len(removed), 2)
+	assert.Equal(t, w.discontinuitySequence, 1)
+	// key2 is used by a pending segment
+	resources, err = r.remove(removed, append(w.segments, &segment{no: 6, uri: "6.ts", key: key2}))
+	assert.Nil(t, err)
+	assert.Equal(t, len(resources), 0)
+	assert.True(t, testExists(dir, "key2"))
+
+	// the last segment is always kept
+	r.opt.Bytes = 1
+	assert.Equal(t, len(r.evict(w)), 0)
+
+	var buf bytes.Buffer
+	assert.Nil(t, w.serialize(&buf))
+	assert.Equal(t, buf.String(), `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:5
+#EXT-X-DISCONTINUITY-SEQUENCE:1
+#EXT-X-KEY:METHOD=AES-128,URI="key2"
+#EXTINF:6.000,
+5.ts
+`)
+}
+
+func TestAddLocalSegment(t *testing.T) {
+	dir := testRetentionDir(t, "init.mp4", "1.m4s", "2.m4s", "3.m4s")
+	sc := newStreamingController(&Config{OutputDir: dir}, zap.NewNop())
+	sc.writer = newPlaylistWriter(dir, localMediaPlaylist)
+	sc.writer.sliding = true
+	sc.retention = newSegmentRetention(&RetentionOptions{Duration: 12 * time.Second}, NewLocalStorage(dir))
+	sc.journal = resumeRecordingJournal(NewLocalStorage(dir))
+	sc.manifest = newRecordingManifest(NewLocalStorage(dir), "http://example.com/master.m3u8")
+	var err error
+	sc.namer, err = newSegmentNamer("")
+	assert.Nil(t, err)
+	sc.resources["http://example.com/init.mp4"] = "init.mp4"
+	sc.namer.reserve("init.mp4")
+	init := &initSection{uri: "init.mp4"}
+	for no := 1; no <= 3; no++ {
+		sc.namer.reserve(strconv.Itoa(no) + ".m4s")
+		assert.Nil(t, sc.addLocalSegment(&segment{no: no, duration: 6, uri: strconv.Itoa(no) + ".m4s", initSection: init}))
+	}
+	assert.False(t, testExists(dir, "1.m4s"))
+	assert.True(t, testExists(dir, "2.m4s"))
+	// the name of the deleted file can be used again
+	assert.False(t, sc.namer.taken("1.m4s"))
+	assert.True(t, sc.namer.taken("2.m4s"))
+	assert.True(t, sc.namer.taken("init.mp4"))
+	// the init section is still used
+	assert.True(t, testExists(dir, "init.mp4"))
+	assert.Equal(t, len(sc.resources), 1)
+
+	b, err := os.ReadFile(filepath.Join(dir, localMediaPlaylist))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(b), "#EXT-X-MEDIA-SEQUENCE:2\n"))
+	assert.False(t, strings.Contains(string(b), "EVENT"))
+
+	// the journal has the sliding playlist
+	state, err := readJournal(NewLocalStorage(dir), zap.NewNop())
+	assert.Nil(t, err)
+	assert.Equal(t, len(state.segments), 2)
+	assert.Equal(t, state.segments[0].no, 2)
+}
@@ -0,0 +1,395 @@
+package hls_downloader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// S3Options configures a S3 compatible storage.
+type S3Options struct {
+	// Endpoint is the URL of the service. i.g. https://s3.ap-northeast-1.amazonaws.com, http://localhost:9000
+	Endpoint string
+	// Region is the region of the bucket. The default is us-east-1.
+	Region string
+	Bucket string
+	// Prefix is prepended to the names of the files. i.g. recordings/channel1/
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Client is the HTTP client. The default is http.DefaultClient.
+	Client *http.Client
+}
+
+// S3Storage stores the files in a bucket of S3 or a S3 compatible service like MinIO.
+// The requests are path-style and signed by AWS Signature Version 4.
+type S3Storage struct {
+	opt      S3Options
+	endpoint *url.URL
+	// now is the time of signing. i.g. for tests
+	now func() time.Time
+	// partSize is the size of a part of a multipart upload.
+	partSize int
+}
+
+func NewS3Storage(opt *S3Options) (*S3Storage, error) {
+	endpoint, err := url.Parse(opt.Endpoint)
+	if err != nil {
+		return nil, xerrors.Errorf("url.Parse failed: %w", err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, xerrors.Errorf("invalid endpoint %q", opt.Endpoint)
+	}
+	if opt.Bucket == "" {
+		return nil, xerrors.New("bucket is empty")
+	}
+	s := &S3Storage{opt: *opt, endpoint: endpoint, now: time.Now, partSize: s3PartSize}
+	if s.opt.Region == "" {
+		s.opt.Region = "us-east-1"
+	}
+	if s.opt.Client == nil {
+		s.opt.Client = http.DefaultClient
+	}
+	return s, nil
+}
+
+// request sends a signed request. key is the key of the object, or "" for the bucket.
+func (s *S3Storage) request(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.opt.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = awsURIEncode(u.Path, false)
+	u.RawQuery = awsCanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, xerrors.Errorf("http.NewRequest failed: %w", err)
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.opt.AccessKey, s.opt.SecretKey, s.opt.Region, "s3", s.now())
+	resp, err := s.opt.Client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("Do failed: %w", err)
+	}
+	return resp, nil
+}
+
+// s3Error returns an error of the response, and closes the body.
+func s3Error(resp *http.Response, key string) error {
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		return xerrors.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return xerrors.Errorf("%s: status %s, %s", key, resp.Status, string(b))
+}
+
+// s3PartSize is the size of a part of a multipart upload.
+const s3PartSize = 8 << 20
+
+// s3OK returns whether the status is 2xx.
+func s3OK(resp *http.Response) bool {
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// s3Writer uploads a file. A PUT request needs the length, so a small file is buffered in memory and put by Close.
+// A file larger than a part is uploaded by a multipart upload, so at most a part is buffered.
+type s3Writer struct {
+	buf bytes.Buffer
+	s   *S3Storage
+	key string
+	// uploadID is the multipart upload started by the first part.
+	uploadID string
+	etags    []string
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, _ := w.buf.Write(p)
+	for w.buf.Len() >= w.s.partSize {
+		if err := w.uploadPart(w.buf.Next(w.s.partSize)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// uploadPart uploads a part. The multipart upload is started by the first part.
+func (w *s3Writer) uploadPart(b []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.s.request(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		if !s3OK(resp) {
+			return s3Error(resp, w.key)
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return xerrors.Errorf("xml.Decode failed: %w", err)
+		}
+		w.uploadID = result.UploadID
+	}
+	query := url.Values{"partNumber": {strconv.Itoa(len(w.etags) + 1)}, "uploadId": {w.uploadID}}
+	resp, err := w.s.request(http.MethodPut, w.key, query, b)
+	if err != nil {
+		return err
+	}
+	if !s3OK(resp) {
+		return s3Error(resp, w.key)
+	}
+	_ = resp.Body.Close()
+	w.etags = append(w.etags, resp.Header.Get("ETag"))
+	return nil
+}
+
+// s3CompleteMultipartUpload is the request of CompleteMultipartUpload.
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// Close uploads the file, or the last part and completes the multipart upload.
+func (w *s3Writer) Close() error {
+	if w.uploadID == "" {
+		resp, err := w.s.request(http.MethodPut, w.key, nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		if !s3OK(resp) {
+			return s3Error(resp, w.key)
+		}
+		_ = resp.Body.Close()
+		return nil
+	}
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Bytes()); err != nil {
+			_ = w.Abort()
+			return err
+		}
+	}
+	complete := s3CompleteMultipartUpload{}
+	for i, etag := range w.etags {
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return xerrors.Errorf("xml.Marshal failed: %w", err)
+	}
+	resp, err := w.s.request(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, body)
+	if err != nil {
+		_ = w.Abort()
+		return err
+	}
+	if !s3OK(resp) {
+		_ = w.Abort()
+		return s3Error(resp, w.key)
+	}
+	// an error may be returned with 200 after the upload started
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		_ = w.Abort()
+		return xerrors.Errorf("io.ReadAll failed: %w", err)
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		_ = w.Abort()
+		return xerrors.Errorf("%s: %s", w.key, string(b))
+	}
+	return nil
+}
+
+// Abort discards the buffer and the uploaded parts.
+func (w *s3Writer) Abort() error {
+	w.buf.Reset()
+	if w.uploadID == "" {
+		return nil
+	}
+	resp, err := w.s.request(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil)
+	w.uploadID = ""
+	if err != nil {
+		return err
+	}
+	if !s3OK(resp) && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp, w.key)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Put(name string) (StorageWriter, error) {
+	return &s3Writer{s: s, key: s.opt.Prefix + name}, nil
+}
+
+func (s *S3Storage) Get(name string) (io.ReadCloser, error) {
+	key := s.opt.Prefix + name
+	resp, err := s.request(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !s3OK(resp) {
+		return nil, s3Error(resp, key)
+	}
+	return resp.Body, nil
+}
+
+// s3ListResult is the response of ListObjectsV2.
+type s3ListResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Storage) List(prefix string) ([]StorageObject, error) {
+	objects := []StorageObject{}
+	query := url.Values{"list-type": {"2"}, "prefix": {s.opt.Prefix + prefix}}
+	for {
+		resp, err := s.request(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s3Error(resp, s.opt.Bucket)
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, xerrors.Errorf("xml.Decode failed: %w", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, StorageObject{Name: strings.TrimPrefix(c.Key, s.opt.Prefix), Size: c.Size})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	return objects, nil
+}
+
+func (s *S3Storage) Delete(name string) error {
+	key := s.opt.Prefix + name
+	resp, err := s.request(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	if !s3OK(resp) && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp, key)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// awsURIEncode encodes except the unreserved characters. The slashes are kept in a path.
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	// sorted by the encoded name, then by the value
+	sort.Slice(keys, func(i, j int) bool { return awsURIEncode(keys[i], true) < awsURIEncode(keys[j], true) })
+	var params []string
+	for _, k := range keys {
+		vs := append([]string{}, query[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			params = append(params, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 adds the headers of AWS Signature Version 4 to the request.
+// All the headers of the request and host are signed.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
@@ -1,13 +1,14 @@
 package hls_downloader
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"time"
 
+	"go.uber.org/zap"
 	"golang.org/x/xerrors"
 )
 
@@ -24,7 +25,13 @@ type segmentDownloader struct {
 	delegate  segmentDownloaderDelegate
 	inputChan <-chan segment
 	cli       *client
-	outputDir string
+	storage   Storage
+	// processors inspect each downloaded segment. i.g. tsAnalyzer
+	processors []segmentProcessor
+	report     *jsonLinesWriter
+	manifest   *recordingManifest
+	checksums  *checksumFile
+	logger     *zap.Logger
 }
 
 func newSegmentDownloader(sc segmentDownloaderDelegate, segChan <-chan segment, tr http.RoundTripper, to time.Duration, outputDir, token string) *segmentDownloader {
@@ -36,15 +43,19 @@ func newSegmentDownloader(sc segmentDownloaderDelegate, segChan <-chan segment,
 				Transport: tr,
 				Timeout:   to,
 			},
-			token: token,
+			auth: tokenAuth(token),
 		},
-		outputDir: outputDir,
+		storage: NewLocalStorage(outputDir),
+		logger:  zap.NewNop(),
 	}
 }
 
 var (
 	ErrSegmentDownloadTimeout      = xerrors.New("segment download timeout")
 	ErrSegmentDownloadClientFactor = xerrors.New("segment download client factor")
+	ErrSegmentDownloadServerFactor = xerrors.New("segment download server factor")
+	// ErrSegmentTruncated is the error that the size of a segment differs from Content-Length.
+	ErrSegmentTruncated = xerrors.New("segment truncated")
 )
 
 // Run run the segmentDownloader
@@ -62,59 +73,154 @@ func (d *segmentDownloader) Run() {
 			// exit if inputChan is closed
 			return
 		}
-		resp, err := d.cli.get(seg.uri)
+		start := time.Now()
+		dl := &segmentDownload{uri: seg.uri}
+		resp, retries, err := d.cli.fetch(seg.uri)
+		dl.retries = retries
+		if resp != nil {
+			dl.status = resp.StatusCode
+		}
 		if err != nil {
+			var body []byte
+			if resp != nil {
+				if resp.StatusCode >= 500 && resp.StatusCode <= 599 {
+					body, _ = io.ReadAll(resp.Body)
+				}
+				_ = resp.Body.Close()
+			}
 			var urlErr *url.Error
 			if errors.As(err, &urlErr) {
 				if urlErr.Timeout() {
-					d.delegate.onDownload(seg.no, ErrSegmentDownloadTimeout)
+					d.done(&seg, dl, start, ErrSegmentDownloadTimeout)
 					consecutiveErrCount++
 					continue
 				}
+				d.done(&seg, dl, start, xerrors.Errorf("get failed %v : %w", urlErr, ErrSegmentDownloadServerFactor))
+				consecutiveErrCount++
+				continue
 			} else if resp != nil {
 				if resp.StatusCode == 401 || resp.StatusCode == 403 {
-					d.delegate.onDownload(seg.no, xerrors.Errorf("get failed %v", resp.Status))
+					d.done(&seg, dl, start, xerrors.Errorf("get failed %v", resp.Status))
 					return
 				} else if ((resp.StatusCode >= 404) && (resp.StatusCode <= 499)) || resp.StatusCode == 400 || resp.StatusCode == 402 {
-					d.delegate.onDownload(seg.no, xerrors.Errorf("statusCode: %s : %w", resp.Status, ErrSegmentDownloadClientFactor))
+					d.done(&seg, dl, start, xerrors.Errorf("statusCode: %s : %w", resp.Status, ErrSegmentDownloadClientFactor))
 					consecutiveErrCount++
 					continue
 				} else if (resp.StatusCode >= 500) && (resp.StatusCode <= 599) {
-					b, _ := io.ReadAll(resp.Body)
-					d.delegate.onDownload(seg.no, xerrors.Errorf("get failed %v, %v", resp.Status, string(b)))
-					return
+					d.done(&seg, dl, start, xerrors.Errorf("get failed %v, %v : %w", resp.Status, string(body), ErrSegmentDownloadServerFactor))
+					consecutiveErrCount++
+					continue
 				}
 			}
-			d.delegate.onDownload(seg.no, xerrors.Errorf("get failed +%w", err))
+			d.done(&seg, dl, start, xerrors.Errorf("get failed +%w", err))
 			return
 		}
 
-		basename, err := uri2SegmentPath(seg.uri, d.outputDir)
-		if err != nil {
-			d.delegate.onDownload(seg.no, xerrors.Errorf("uri2basename failed, seg.uri:%v, +%w", seg.uri, err))
-			consecutiveErrCount++
-		}
-		f, err := os.Create(basename)
-		if err != nil {
-			d.delegate.onDownload(seg.no, xerrors.Errorf("os.Create failed, seg.uri:%v, +%w", seg.uri, err))
-			consecutiveErrCount++
-		}
-		defer func() { _ = f.Close() }()
-		_, err = io.Copy(f, resp.Body)
+		data, err := d.save(&seg, resp, dl)
+		_ = resp.Body.Close()
 		if err != nil {
-			d.delegate.onDownload(seg.no, xerrors.Errorf("os.Copy failed, seg.uri:%v, +%w", seg.uri, err))
+			d.done(&seg, dl, start, err)
 			consecutiveErrCount++
+			continue
 		}
 		// success
 		consecutiveErrCount = 0
-		d.delegate.onDownload(seg.no, nil)
+		d.process(&seg, data)
+		d.done(&seg, dl, start, nil)
+	}
+}
+
+// done records the download in the manifest and reports the result to the delegate.
+func (d *segmentDownloader) done(seg *segment, dl *segmentDownload, start time.Time, err error) {
+	if d.manifest != nil {
+		dl.latency = time.Since(start)
+		dl.err = err
+		d.manifest.download(seg.no, dl)
+	}
+	d.delegate.onDownload(seg.no, err)
+}
+
+// save writes the body of the segment into the storage. It returns the data if there are processors.
+// The segment is discarded unless its size matches Content-Length and its digest matches
+// Content-MD5, ETag or Digest given by the origin.
+// The size and the checksum are set to dl, and the checksum is written to SHA256SUMS.
+func (d *segmentDownloader) save(seg *segment, resp *http.Response, dl *segmentDownload) ([]byte, error) {
+	name, err := seg.storageName()
+	if err != nil {
+		return nil, xerrors.Errorf("storageName failed, seg.uri:%v, +%w", seg.uri, err)
+	}
+	f, err := d.storage.Put(name)
+	if err != nil {
+		return nil, xerrors.Errorf("storage.Put failed, seg.uri:%v, +%w", seg.uri, err)
+	}
+	var buf bytes.Buffer
+	checksum := newChecksumWriter(contentDigests(resp.Header))
+	var w io.Writer = io.MultiWriter(f, checksum)
+	if len(d.processors) > 0 {
+		w = io.MultiWriter(f, checksum, &buf)
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		_ = f.Abort()
+		return nil, xerrors.Errorf("io.Copy failed, seg.uri:%v, +%w", seg.uri, err)
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		_ = f.Abort()
+		return nil, xerrors.Errorf("seg.uri:%v, %d of %d bytes : %w", seg.uri, n, resp.ContentLength, ErrSegmentTruncated)
+	}
+	if err := checksum.verify(); err != nil {
+		_ = f.Abort()
+		return nil, xerrors.Errorf("seg.uri:%v, %w", seg.uri, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, xerrors.Errorf("Close failed, seg.uri:%v, +%w", seg.uri, err)
+	}
+	dl.size = n
+	dl.sha256 = checksum.sha256()
+	if d.checksums != nil {
+		if err := d.checksums.write(dl.sha256, name); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// process runs the processors and writes the report of the segment.
+func (d *segmentDownloader) process(seg *segment, data []byte) {
+	if len(d.processors) == 0 {
+		return
+	}
+	report := &SegmentReport{No: seg.no, URI: seg.uri}
+	for _, p := range d.processors {
+		if err := p.process(seg, data, report); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+	if d.report == nil {
+		return
+	}
+	if err := d.report.write(report); err != nil {
+		d.logger.Error("report write failed", zap.Int("no", seg.no), zap.Error(err))
 	}
 }
 
-func uri2SegmentPath(uri, outputDir string) (string, error) {
-	basename, err := uri2basename(uri)
+// segmentName returns the default name of a segment, a key or an init section in the storage.
+// i.g. http://example.com/live/1.ts -> 1.ts
+func segmentName(uri string) (string, error) {
+	name, err := uri2basename(uri)
 	if err != nil {
 		return "", err
 	}
-	return outputDir + "/" + basename, nil
+	if name == "" {
+		return "", xerrors.Errorf("no basename in %s", uri)
+	}
+	return name, nil
+}
+
+// storageName returns the name of the segment in the storage.
+func (seg *segment) storageName() (string, error) {
+	if seg.local != nil {
+		return seg.local.uri, nil
+	}
+	return segmentName(seg.uri)
 }
@@ -3,9 +3,12 @@ package hls_downloader
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -174,3 +177,65 @@ func TestSegmentDownloerError(t *testing.T) {
 		}
 	}
 }
+
+func testSegmentResponse(body string, contentLength int64, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{Body: io.NopCloser(strings.NewReader(body)), ContentLength: contentLength, Header: header}
+}
+
+func TestSegmentDownloaderSave(t *testing.T) {
+	s := NewMemoryStorage()
+	d := newSegmentDownloader(nil, nil, nil, 0, "", "")
+	d.storage = s
+	d.checksums = resumeChecksumFile(s)
+	seg := &segment{no: 1, uri: "http://example.com/live/1.ts"}
+
+	dl := &segmentDownload{}
+	_, err := d.save(seg, testSegmentResponse("a_ts_file", 100, nil), dl)
+	assert.True(t, errors.Is(err, ErrSegmentTruncated))
+	_, err = s.Get("1.ts")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	// unknown length
+	_, err = d.save(seg, testSegmentResponse("a_ts_file", -1, nil), dl)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Delete("1.ts"))
+
+	_, err = d.save(seg, testSegmentResponse("a_ts_file", 9, nil), dl)
+	assert.Nil(t, err)
+	_, err = s.Get("1.ts")
+	assert.Nil(t, err)
+	assert.Equal(t, dl.size, int64(9))
+	sums, names, err := readChecksums(s)
+	assert.Nil(t, err)
+	assert.Equal(t, names, []string{"1.ts"})
+	assert.Equal(t, sums["1.ts"], dl.sha256)
+
+	// the digests given by the origin
+	seg = &segment{no: 2, uri: "http://example.com/live/2.ts"}
+	for _, h := range []http.Header{
+		{"Content-Md5": {"ruU35sjTYzpDyJPRShuo7w=="}},
+		{"Etag": {`"aee537e6c8d3633a43c893d14a1ba8ef"`}},
+		{"Digest": {"SHA-256=8r643oLn9+zvKanwqOw3J9fev1pZ/A88pEHbBk99MDM=,MD5=ruU35sjTYzpDyJPRShuo7w=="}},
+		// a weak ETag and a multipart ETag are not digests
+		{"Etag": {`W/"795f3202b17cb6bc3d4b771d8c6c9eaf"`}},
+		{"Etag": {`"795f3202b17cb6bc3d4b771d8c6c9eaf-2"`}},
+	} {
+		_, err = d.save(seg, testSegmentResponse("a_ts_file", 9, h), dl)
+		assert.Nil(t, err, h)
+	}
+	assert.Nil(t, s.Delete("2.ts"))
+	for _, h := range []http.Header{
+		{"Content-Md5": {"eV8yArF8trw9S3cdjGyerw=="}},
+		{"Etag": {`"795f3202b17cb6bc3d4b771d8c6c9eaf"`}},
+		{"Digest": {"SHA-256=2SmKENGwc1g33EvYXaxkGw887yekfl1TpU8vP1svz/o="}},
+		{"Digest": {"SHA-256=8r643oLn9+zvKanwqOw3J9fev1pZ/A88pEHbBk99MDM=", "MD5=eV8yArF8trw9S3cdjGyerw=="}},
+	} {
+		_, err = d.save(seg, testSegmentResponse("a_ts_file", 9, h), dl)
+		assert.True(t, errors.Is(err, ErrChecksumMismatch), h)
+		_, err = s.Get("2.ts")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+	}
+}
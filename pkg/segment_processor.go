@@ -0,0 +1,94 @@
+package hls_downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// localReport is the recording report which has a line of SegmentReport for each downloaded segment.
+const localReport = "report.jsonl"
+
+// segmentProcessor inspects a downloaded segment in the segmentDownloader.
+// The result is written into the report of the segment.
+type segmentProcessor interface {
+	process(seg *segment, data []byte, report *SegmentReport) error
+}
+
+// SegmentReport is a line of the recording report.
+type SegmentReport struct {
+	No       int            `json:"no"`
+	URI      string         `json:"uri"`
+	TS       *TSAnalysis    `json:"ts,omitempty"`
+	Duration *DurationCheck `json:"duration,omitempty"`
+	Errors   []string       `json:"errors,omitempty"`
+}
+
+// jsonLinesWriter appends values to a file in the storage as JSON lines. i.g. report.jsonl
+// A storage which is not a StorageAppender rewrites the whole file for each line. i.g. S3Storage
+type jsonLinesWriter struct {
+	mu      sync.Mutex
+	storage Storage
+	name    string
+	// content is the file rewritten for each line if the storage can't append. nil until it is read.
+	content []byte
+}
+
+func newJSONLinesWriter(s Storage, name string) *jsonLinesWriter {
+	return &jsonLinesWriter{storage: s, name: name}
+}
+
+// newRecordingReport starts a new report.jsonl in the storage. The report of the previous recording is removed.
+func newRecordingReport(s Storage) (*jsonLinesWriter, error) {
+	r := resumeRecordingReport(s)
+	if err := r.reset(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// resumeRecordingReport continues report.jsonl.
+func resumeRecordingReport(s Storage) *jsonLinesWriter {
+	return newJSONLinesWriter(s, localReport)
+}
+
+func (r *jsonLinesWriter) write(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return xerrors.Errorf("json.Marshal failed: %w", err)
+	}
+	return r.writeLine(string(b))
+}
+
+// writeLine appends a line which is not JSON. i.g. SHA256SUMS
+func (r *jsonLinesWriter) writeLine(line string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a, ok := r.storage.(StorageAppender); ok {
+		return a.Append(r.name, []byte(line+"\n"))
+	}
+	if r.content == nil {
+		b, err := readFile(r.storage, r.name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		r.content = append([]byte{}, b...)
+	}
+	r.content = append(r.content, line+"\n"...)
+	return putFile(r.storage, r.name, func(w io.Writer) error {
+		_, err := w.Write(r.content)
+		return err
+	})
+}
+
+// reset removes the file. i.g. the report of the previous recording
+func (r *jsonLinesWriter) reset() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.content = nil
+	return r.storage.Delete(r.name)
+}
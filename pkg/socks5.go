@@ -0,0 +1,186 @@
+package hls_downloader
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// see RFC1928 SOCKS Protocol Version 5 and RFC1929 Username/Password Authentication for SOCKS V5
+const (
+	socks5Version          = 0x05
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+	socks5CmdConnect       = 0x01
+	socks5AddrIPv4         = 0x01
+	socks5AddrDomain       = 0x03
+	socks5AddrIPv6         = 0x04
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Dialer connects to the addresses through a SOCKS5 proxy.
+type socks5Dialer struct {
+	proxy    string
+	user     string
+	password string
+	// remoteDNS sends the host names to the proxy. i.g. socks5h://
+	remoteDNS bool
+	dial      dialContextFunc
+}
+
+func newSOCKS5Dialer(u *url.URL, dial dialContextFunc) *socks5Dialer {
+	d := &socks5Dialer{proxy: u.Host, remoteDNS: u.Scheme == "socks5h", dial: dial}
+	if u.Port() == "" {
+		d.proxy = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	if u.User != nil {
+		d.user = u.User.Username()
+		d.password, _ = u.User.Password()
+	}
+	return d
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, xerrors.Errorf("net.SplitHostPort failed: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid port %q", portStr)
+	}
+	if !d.remoteDNS && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, xerrors.Errorf("LookupIPAddr failed: %w", err)
+		}
+		if len(ips) == 0 {
+			return nil, xerrors.Errorf("no address of %s", host)
+		}
+		host = ips[0].IP.String()
+	}
+
+	conn, err := d.dial(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := d.handshake(conn, host, port); err != nil {
+		_ = conn.Close()
+		return nil, xerrors.Errorf("socks5 %s: %w", d.proxy, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, host string, port int) error {
+	methods := []byte{socks5AuthNone}
+	if d.user != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return xerrors.Errorf("Write failed: %w", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return xerrors.Errorf("io.ReadFull failed: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return xerrors.Errorf("unexpected version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if d.user == "" {
+			return xerrors.New("password authentication is required")
+		}
+		if len(d.user) > 255 || len(d.password) > 255 {
+			return xerrors.New("too long user or password")
+		}
+		b := []byte{0x01, byte(len(d.user))}
+		b = append(b, d.user...)
+		b = append(b, byte(len(d.password)))
+		b = append(b, d.password...)
+		if _, err := conn.Write(b); err != nil {
+			return xerrors.Errorf("Write failed: %w", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return xerrors.Errorf("io.ReadFull failed: %w", err)
+		}
+		if reply[1] != 0x00 {
+			return xerrors.New("authentication failed")
+		}
+	case socks5AuthNoAcceptable:
+		return xerrors.New("no acceptable authentication method")
+	default:
+		return xerrors.Errorf("unexpected authentication method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return xerrors.Errorf("too long host %s", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return xerrors.Errorf("Write failed: %w", err)
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return xerrors.Errorf("io.ReadFull failed: %w", err)
+	}
+	if head[1] != 0x00 {
+		if msg, ok := socks5Replies[head[1]]; ok {
+			return xerrors.New(msg)
+		}
+		return xerrors.Errorf("reply %d", head[1])
+	}
+	var n int
+	switch head[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return xerrors.Errorf("io.ReadFull failed: %w", err)
+		}
+		n = int(l[0])
+	default:
+		return xerrors.Errorf("unexpected address type %d", head[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, n+2)); err != nil {
+		return xerrors.Errorf("io.ReadFull failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package hls_downloader
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// Storage stores the recorded files.
+// The names are slash separated paths relative to the root of the storage. i.g. index.m3u8, 1.ts
+type Storage interface {
+	// Put returns a writer of the file. The file appears when the writer is closed, and is discarded by Abort.
+	Put(name string) (StorageWriter, error)
+	// Get opens the file. The error wraps fs.ErrNotExist if the file is not found.
+	Get(name string) (io.ReadCloser, error)
+	// List returns the files whose names start with the prefix in order of the name.
+	List(prefix string) ([]StorageObject, error)
+	// Delete deletes the file. It is not an error that the file is not found.
+	Delete(name string) error
+}
+
+// StorageWriter is a streaming writer of a file in a Storage.
+type StorageWriter interface {
+	io.WriteCloser
+	// Abort discards the written data.
+	Abort() error
+}
+
+// StorageAppender is a Storage which appends to a file in place. i.g. journal.jsonl
+type StorageAppender interface {
+	// Append appends b to the file. The file is created if it is not found.
+	Append(name string, b []byte) error
+}
+
+// StorageObject is a file in a Storage.
+type StorageObject struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// putFile writes a file in the storage. The file is discarded if write fails.
+func putFile(s Storage, name string, write func(io.Writer) error) error {
+	w, err := s.Put(name)
+	if err != nil {
+		return err
+	}
+	if err := write(w); err != nil {
+		_ = w.Abort()
+		return xerrors.Errorf("write %s failed: %w", name, err)
+	}
+	return w.Close()
+}
+
+// readFile reads the file in the storage.
+func readFile(s Storage, name string) ([]byte, error) {
+	r, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, xerrors.Errorf("io.ReadAll failed: %w", err)
+	}
+	return b, nil
+}
+
+// storageObjectSize returns the size of the file in the storage.
+func storageObjectSize(s Storage, name string) (int64, error) {
+	objects, err := s.List(name)
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range objects {
+		if o.Name == name {
+			return o.Size, nil
+		}
+	}
+	return 0, xerrors.Errorf("%s: %w", name, fs.ErrNotExist)
+}
+
+// localTempPattern is the pattern of the temporary files which are renamed to the files when they are closed.
+const localTempPattern = ".*.part"
+
+// LocalStorage stores the files in a directory.
+// A file is written into a temporary file, synced and renamed, so a partial file never appears
+// even if the process dies. The temporary files left by a crash are removed by RemovePartialFiles.
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+type localStorageWriter struct {
+	*os.File
+	path string
+}
+
+func (w *localStorageWriter) Close() error {
+	if err := w.File.Sync(); err != nil {
+		_ = w.File.Close()
+		_ = os.Remove(w.Name())
+		return xerrors.Errorf("Sync failed: %w", err)
+	}
+	if err := w.File.Close(); err != nil {
+		_ = os.Remove(w.Name())
+		return xerrors.Errorf("Close failed: %w", err)
+	}
+	if err := os.Rename(w.Name(), w.path); err != nil {
+		_ = os.Remove(w.Name())
+		return xerrors.Errorf("os.Rename failed: %w", err)
+	}
+	return syncDir(filepath.Dir(w.path))
+}
+
+// syncDir makes a rename in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return xerrors.Errorf("os.Open failed: %w", err)
+	}
+	defer func() { _ = d.Close() }()
+	if err := d.Sync(); err != nil {
+		return xerrors.Errorf("Sync failed: %w", err)
+	}
+	return nil
+}
+
+func (w *localStorageWriter) Abort() error {
+	_ = w.File.Close()
+	if err := os.Remove(w.Name()); err != nil {
+		return xerrors.Errorf("os.Remove failed: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Put(name string) (StorageWriter, error) {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, xerrors.Errorf("os.MkdirAll failed: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+localTempPattern)
+	if err != nil {
+		return nil, xerrors.Errorf("os.CreateTemp failed: %w", err)
+	}
+	return &localStorageWriter{File: f, path: path}, nil
+}
+
+func (s *LocalStorage) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, xerrors.Errorf("os.Open failed: %w", err)
+	}
+	return f, nil
+}
+
+func (s *LocalStorage) List(prefix string) ([]StorageObject, error) {
+	objects := []StorageObject{}
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if matched, _ := filepath.Match(localTempPattern, d.Name()); matched {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, StorageObject{Name: name, Size: fi.Size()})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, xerrors.Errorf("filepath.WalkDir failed: %w", err)
+	}
+	return objects, nil
+}
+
+// RemovePartialFiles removes the temporary files which are left by a crash, and returns their names.
+func (s *LocalStorage) RemovePartialFiles() ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if matched, _ := filepath.Match(localTempPattern, d.Name()); !matched || d.IsDir() {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return removed, xerrors.Errorf("filepath.WalkDir failed: %w", err)
+	}
+	return removed, nil
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("os.Remove failed: %w", err)
+	}
+	return nil
+}
+
+// Append appends b to the file without a temporary file, since a partial line is truncated when it is read.
+func (s *LocalStorage) Append(name string, b []byte) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return xerrors.Errorf("os.MkdirAll failed: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return xerrors.Errorf("os.OpenFile failed: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("Write failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("Close failed: %w", err)
+	}
+	return nil
+}
+
+// MemoryStorage stores the files in memory. i.g. for tests
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: map[string][]byte{}}
+}
+
+type memoryStorageWriter struct {
+	bytes.Buffer
+	commit func([]byte)
+}
+
+func (w *memoryStorageWriter) Close() error {
+	w.commit(w.Bytes())
+	return nil
+}
+
+func (w *memoryStorageWriter) Abort() error {
+	return nil
+}
+
+func (s *MemoryStorage) Put(name string) (StorageWriter, error) {
+	return &memoryStorageWriter{commit: func(b []byte) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.files[name] = b
+	}}, nil
+}
+
+func (s *MemoryStorage) Get(name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.files[name]
+	if !ok {
+		return nil, xerrors.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *MemoryStorage) List(prefix string) ([]StorageObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects := []StorageObject{}
+	for name, b := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, StorageObject{Name: name, Size: int64(len(b))})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (s *MemoryStorage) Append(name string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = append(s.files[name], b...)
+	return nil
+}
+
+func (s *MemoryStorage) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
@@ -0,0 +1,341 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// MonitorConfig enables the monitor mode of the streamingController.
+// In the monitor mode, playlists are polled and alerts are emitted instead of recording.
+type MonitorConfig struct {
+	// WebhookURL receives alerts as JSON by POST. Empty disables the webhook.
+	WebhookURL string
+	// SampleSegments downloads every n-th new segment. 0 disables sampling.
+	SampleSegments int
+	// LatencyThreshold is the response time of playlists and segments to alert latency spikes.
+	LatencyThreshold time.Duration
+	// StallFactor alerts a stall when the media sequence doesn't advance for StallFactor * target duration.
+	StallFactor float64
+}
+
+const (
+	AlertStall              = "stall"
+	AlertSequenceRegression = "sequence_regression"
+	AlertTargetDuration     = "target_duration"
+	AlertHTTPError          = "http_error"
+	AlertLatency            = "latency"
+)
+
+// Alert is emitted in the monitor mode.
+type Alert struct {
+	Time          time.Time `json:"time"`
+	Kind          string    `json:"kind"`
+	URI           string    `json:"uri"`
+	Message       string    `json:"message"`
+	MediaSequence int       `json:"media_sequence,omitempty"`
+	LatencyMsec   int64     `json:"latency_msec,omitempty"`
+	// Suppressed is the count of the alerts of the same kind and URI which are not posted since the last post.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+const (
+	webhookTimeout = 5 * time.Second
+	// webhookQueueSize is the count of the alerts waiting for the webhook. An alert is dropped when the queue is full.
+	webhookQueueSize = 64
+	// webhookRepeatInterval is the minimum interval to post the alerts of the same kind and URI. i.g. HTTP errors of every poll
+	webhookRepeatInterval = time.Minute
+)
+
+// streamMonitor checks playlists and segments and emits alerts.
+type streamMonitor struct {
+	config       *MonitorConfig
+	logger       *zap.Logger
+	webhook      *http.Client
+	lastSequence int
+	lastAdvance  time.Time
+	stalled      bool
+	checkedNo    int
+	newSegments  int
+	// queue is the alerts to post, which is nil without the webhook.
+	queue chan Alert
+	done  chan struct{}
+	// posted is the last post by the kind and the URI of the alerts.
+	posted map[string]*webhookPost
+}
+
+type webhookPost struct {
+	time       time.Time
+	suppressed int
+}
+
+func newStreamMonitor(c *MonitorConfig, l *zap.Logger) *streamMonitor {
+	m := &streamMonitor{
+		config:       c,
+		logger:       l,
+		webhook:      &http.Client{Timeout: webhookTimeout},
+		lastSequence: -1,
+		checkedNo:    -1,
+		posted:       map[string]*webhookPost{},
+	}
+	if c.WebhookURL != "" {
+		m.queue = make(chan Alert, webhookQueueSize)
+		m.done = make(chan struct{})
+		go m.postQueue()
+	}
+	return m
+}
+
+// close stops the webhook. The queued alerts are posted for up to webhookTimeout.
+func (m *streamMonitor) close() {
+	if m.queue == nil {
+		return
+	}
+	close(m.queue)
+	select {
+	case <-m.done:
+	case <-time.After(webhookTimeout):
+		m.logger.Warn("webhook doesn't finish, queued alerts are dropped", zap.String("url", m.config.WebhookURL))
+	}
+}
+
+// checkPlaylist checks the reloaded media playlist.
+func (m *streamMonitor) checkPlaylist(uri string, p *playlist, now time.Time) []Alert {
+	var alerts []Alert
+	last := p.segments[len(p.segments)-1].no
+	if m.lastSequence >= 0 && p.sequence < m.lastSequence {
+		alerts = append(alerts, Alert{
+			Time:          now,
+			Kind:          AlertSequenceRegression,
+			URI:           uri,
+			Message:       fmt.Sprintf("EXT-X-MEDIA-SEQUENCE decreased from %d to %d", m.lastSequence, p.sequence),
+			MediaSequence: p.sequence,
+		})
+	}
+	m.lastSequence = p.sequence
+
+	if last > m.checkedNo {
+		m.lastAdvance = now
+		m.stalled = false
+	} else if !m.stalled && !p.end {
+		limit := time.Duration(m.config.StallFactor * float64(time.Second) * float64(p.targetDuration))
+		if now.Sub(m.lastAdvance) > limit {
+			m.stalled = true
+			alerts = append(alerts, Alert{
+				Time:          now,
+				Kind:          AlertStall,
+				URI:           uri,
+				Message:       fmt.Sprintf("media sequence doesn't advance for %v", now.Sub(m.lastAdvance)),
+				MediaSequence: last,
+			})
+		}
+	}
+
+	for _, s := range p.segments {
+		if s.no <= m.checkedNo {
+			continue
+		}
+		if int(math.Round(s.duration)) > p.targetDuration {
+			alerts = append(alerts, Alert{
+				Time:          now,
+				Kind:          AlertTargetDuration,
+				URI:           s.uri,
+				Message:       fmt.Sprintf("EXTINF %v exceeds EXT-X-TARGETDURATION %d", s.duration, p.targetDuration),
+				MediaSequence: s.no,
+			})
+		}
+	}
+	return alerts
+}
+
+// checkResponse checks the result of a request.
+func (m *streamMonitor) checkResponse(uri string, no int, latency time.Duration, err error, now time.Time) []Alert {
+	if err != nil {
+		return []Alert{{
+			Time:          now,
+			Kind:          AlertHTTPError,
+			URI:           uri,
+			Message:       err.Error(),
+			MediaSequence: no,
+			LatencyMsec:   latency.Milliseconds(),
+		}}
+	}
+	if m.config.LatencyThreshold > 0 && latency > m.config.LatencyThreshold {
+		return []Alert{{
+			Time:          now,
+			Kind:          AlertLatency,
+			URI:           uri,
+			Message:       fmt.Sprintf("response time %v exceeds %v", latency, m.config.LatencyThreshold),
+			MediaSequence: no,
+			LatencyMsec:   latency.Milliseconds(),
+		}}
+	}
+	return nil
+}
+
+// emit writes alerts to the log and queues them for the webhook, so a slow webhook doesn't delay the polls.
+func (m *streamMonitor) emit(alerts []Alert) {
+	for _, a := range alerts {
+		m.logger.Warn("alert",
+			zap.String("kind", a.Kind),
+			zap.String("uri", a.URI),
+			zap.String("message", a.Message),
+			zap.Int("mediaSequence", a.MediaSequence),
+			zap.Int64("latencyMsec", a.LatencyMsec))
+		if m.queue == nil || !m.repeatable(&a) {
+			continue
+		}
+		select {
+		case m.queue <- a:
+		default:
+			m.logger.Error("webhook queue is full, alert dropped", zap.String("url", m.config.WebhookURL), zap.String("kind", a.Kind))
+		}
+	}
+}
+
+// repeatable reports whether the alert is posted. The alerts of the same kind and URI are posted once in webhookRepeatInterval,
+// and the next post has the count of the suppressed ones.
+func (m *streamMonitor) repeatable(a *Alert) bool {
+	key := a.Kind + " " + a.URI
+	if p, ok := m.posted[key]; ok {
+		if a.Time.Sub(p.time) < webhookRepeatInterval {
+			p.suppressed++
+			return false
+		}
+		a.Suppressed = p.suppressed
+	}
+	// forget the old posts without suppressed alerts. i.g. HTTP errors of segments
+	for k, p := range m.posted {
+		if p.suppressed == 0 && a.Time.Sub(p.time) >= webhookRepeatInterval {
+			delete(m.posted, k)
+		}
+	}
+	m.posted[key] = &webhookPost{time: a.Time}
+	return true
+}
+
+func (m *streamMonitor) postQueue() {
+	defer close(m.done)
+	for a := range m.queue {
+		if err := m.post(a); err != nil {
+			m.logger.Error("webhook failed", zap.String("url", m.config.WebhookURL), zap.Error(err))
+		}
+	}
+}
+
+func (m *streamMonitor) post(a Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return xerrors.Errorf("json.Marshal failed: %w", err)
+	}
+	resp, err := m.webhook.Post(m.config.WebhookURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return xerrors.Errorf("webhook.Post failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return xerrors.Errorf("status code %v", resp.Status)
+	}
+	return nil
+}
+
+// fetch requests the uri and measures the response time including the body.
+func fetch(cli *client, uri string, w io.Writer) (time.Duration, error) {
+	start := time.Now()
+	resp, err := cli.get(uri)
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return time.Since(start), err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return time.Since(start), xerrors.Errorf("io.Copy failed: %w", err)
+	}
+	return time.Since(start), nil
+}
+
+// Monitor polls the playlist and emits alerts until ctx is canceled.
+func (sc *streamingController) Monitor(ctx context.Context) error {
+	tr, err := newTransport(sc.config.HTTP)
+	if err != nil {
+		return err
+	}
+	jar, err := newCookieJar(sc.config.CookieFile)
+	if err != nil {
+		return err
+	}
+	cli := sc.config.newClient(tr, jar, sc.config.PlaylistDownloadTimeout)
+	segmentCli := sc.config.newClient(tr, jar, sc.config.SegmentDownloadTimeout)
+	sc.throttle = newThrottle(sc.config.Throttle)
+	sc.throttle.limit(cli)
+	sc.throttle.limit(segmentCli)
+	monitor := newStreamMonitor(sc.config.Monitor, sc.logger)
+	defer monitor.close()
+	parser := playlistParser{logger: sc.logger}
+
+	if err := sc.loadMaster(ctx, cli, io.Discard, ""); err != nil {
+		return err
+	}
+
+	var interval time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+
+		uri := sc.selector.variant().uri
+		var buf bytes.Buffer
+		sc.throttle.waitPlaylist()
+		latency, err := fetch(cli, uri.String(), &buf)
+		now := time.Now()
+		monitor.emit(monitor.checkResponse(uri.String(), 0, latency, err, now))
+		if interval == 0 {
+			interval = sourceRetryInterval
+		}
+		if err != nil {
+			continue
+		}
+		p, err := parser.parse2nd(bufio.NewScanner(&buf))
+		if err != nil {
+			sc.logger.Warn("invalid playlist", zap.Stringer("uri", uri), zap.Error(err))
+			continue
+		}
+		if err := p.modify(uri); err != nil {
+			return err
+		}
+		monitor.emit(monitor.checkPlaylist(uri.String(), p, now))
+
+		for _, s := range p.segments {
+			if s.no <= monitor.checkedNo {
+				continue
+			}
+			monitor.checkedNo = s.no
+			monitor.newSegments++
+			if sc.config.Monitor.SampleSegments <= 0 || monitor.newSegments%sc.config.Monitor.SampleSegments != 0 {
+				continue
+			}
+			latency, err := fetch(segmentCli, s.uri, io.Discard)
+			monitor.emit(monitor.checkResponse(s.uri, s.no, latency, err, time.Now()))
+		}
+
+		// see RFC8216 6.3.4. Reloading the Media Playlist File
+		interval = time.Second * time.Duration(p.targetDuration) / 2
+		if interval <= 0 {
+			interval = time.Second
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package hls_downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func alertKinds(alerts []Alert) []string {
+	kinds := []string{}
+	for _, a := range alerts {
+		kinds = append(kinds, a.Kind)
+	}
+	return kinds
+}
+
+func TestStreamMonitorCheckPlaylist(t *testing.T) {
+	m := newStreamMonitor(&MonitorConfig{StallFactor: 2}, zap.NewNop())
+	now := time.Now()
+	newPlaylist := func(sequence int, durations ...float64) *playlist {
+		p := &playlist{sequence: sequence, targetDuration: 6}
+		for i, d := range durations {
+			p.segments = append(p.segments, &segment{duration: d, uri: fmt.Sprintf("%d.ts", sequence+i), no: sequence + i})
+		}
+		return p
+	}
+	check := func(p *playlist) []string {
+		alerts := m.checkPlaylist("playlist.m3u8", p, now)
+		m.checkedNo = p.segments[len(p.segments)-1].no
+		return alertKinds(alerts)
+	}
+
+	assert.Equal(t, check(newPlaylist(10, 6, 6)), []string{})
+	assert.Equal(t, check(newPlaylist(11, 6, 7)), []string{AlertTargetDuration})
+
+	// no change for 12 seconds is not a stall yet
+	now = now.Add(12 * time.Second)
+	assert.Equal(t, check(newPlaylist(11, 6, 7)), []string{})
+	now = now.Add(time.Second)
+	assert.Equal(t, check(newPlaylist(11, 6, 7)), []string{AlertStall})
+	// a stall is alerted once
+	assert.Equal(t, check(newPlaylist(11, 6, 7)), []string{})
+
+	assert.Equal(t, check(newPlaylist(9, 6, 6, 6, 6)), []string{AlertSequenceRegression})
+}
+
+func TestStreamMonitorWebhook(t *testing.T) {
+	alerts := make(chan Alert, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		err := json.NewDecoder(r.Body).Decode(&a)
+		assert.Nil(t, err)
+		alerts <- a
+	}))
+	defer ts.Close()
+
+	m := newStreamMonitor(&MonitorConfig{WebhookURL: ts.URL, LatencyThreshold: time.Second}, zap.NewNop())
+	now := time.Now()
+	assert.Equal(t, len(m.checkResponse("a.ts", 1, time.Millisecond, nil, now)), 0)
+	m.emit(m.checkResponse("a.ts", 1, 2*time.Second, nil, now))
+	m.emit(m.checkResponse("b.ts", 2, time.Millisecond, fmt.Errorf("status code 404 Not Found"), now))
+	// the repeated alerts are posted once in the interval
+	m.emit(m.checkResponse("b.ts", 2, time.Millisecond, fmt.Errorf("status code 404 Not Found"), now.Add(time.Second)))
+	m.emit(m.checkResponse("b.ts", 2, time.Millisecond, fmt.Errorf("status code 404 Not Found"), now.Add(2*time.Second)))
+	m.emit(m.checkResponse("b.ts", 2, time.Millisecond, fmt.Errorf("status code 404 Not Found"), now.Add(webhookRepeatInterval)))
+	m.close()
+
+	a := <-alerts
+	assert.Equal(t, a.Kind, AlertLatency)
+	assert.Equal(t, a.LatencyMsec, int64(2000))
+	a = <-alerts
+	assert.Equal(t, a.Kind, AlertHTTPError)
+	assert.Equal(t, a.MediaSequence, 2)
+	assert.Equal(t, a.Suppressed, 0)
+	a = <-alerts
+	assert.Equal(t, a.Kind, AlertHTTPError)
+	assert.Equal(t, a.Suppressed, 2)
+	assert.Equal(t, len(alerts), 0)
+}
+
+func TestStreamMonitorSlowWebhook(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	m := newStreamMonitor(&MonitorConfig{WebhookURL: ts.URL}, zap.NewNop())
+	now := time.Now()
+	start := time.Now()
+	// the polls are not blocked by the webhook, and the alerts over the queue are dropped
+	for i := 0; i < webhookQueueSize+2; i++ {
+		m.emit(m.checkResponse(fmt.Sprintf("%d.ts", i), i, 0, fmt.Errorf("status code 404 Not Found"), now))
+	}
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestFetchError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	// the error responses are closed, or they hold the only connection
+	cli := (&Config{}).newClient(&http.Transport{MaxConnsPerHost: 1}, nil, time.Second)
+	for i := 0; i < 3; i++ {
+		_, err := fetch(cli, ts.URL, io.Discard)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "503")
+	}
+}
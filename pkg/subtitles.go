@@ -0,0 +1,215 @@
+package hls_downloader
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// SubtitleOptions enables merging the recorded WebVTT segments of a subtitle rendition.
+type SubtitleOptions struct {
+	// Output is the path of the merged file. The default is subtitles.vtt or subtitles.<Language>.vtt in the output directory.
+	Output string
+	// Language is the language of the rendition, which names the default output. i.g. en
+	// A recording has a rendition, so the renditions of the other languages are recorded into other output directories.
+	Language string
+	// SRT writes also a SubRip file whose extension is .srt.
+	SRT bool
+}
+
+// SubtitleReport is the result of merging subtitles.
+type SubtitleReport struct {
+	Outputs  []string `json:"outputs"`
+	Segments int      `json:"segments"`
+	Cues     int      `json:"cues"`
+	// Duplicates is the number of cues which are repeated across segments.
+	Duplicates int              `json:"duplicates"`
+	Skipped    []SkippedSegment `json:"skipped"`
+}
+
+const defaultSubtitleOutput = "subtitles.vtt"
+
+// subtitleTimeline maps the cue times of each segment onto a single timeline by X-TIMESTAMP-MAP.
+// The timeline is the cue time of the first segment, and continues by EXTINF after a discontinuity.
+type subtitleTimeline struct {
+	// position is the start of the current segment, and next is the start of the next segment.
+	position time.Duration
+	next     time.Duration
+	// reset is true at the first segment and after a discontinuity.
+	reset bool
+	// anchor is the position where the MPEG-2 time is origin.
+	anchor time.Duration
+	origin int64
+	last   int64
+}
+
+func newSubtitleTimeline() *subtitleTimeline {
+	return &subtitleTimeline{reset: true}
+}
+
+// segment moves the timeline to the segment.
+func (t *subtitleTimeline) segment(seg *segment) {
+	t.position = t.next
+	t.next += time.Duration(seg.duration * float64(time.Second))
+	if seg.discontinuity {
+		t.reset = true
+	}
+}
+
+// offset returns the offset which is added to the cue times of the current segment.
+func (t *subtitleTimeline) offset(m *webvttTimestampMap) time.Duration {
+	// without X-TIMESTAMP-MAP, the cue time is the MPEG-2 time 0
+	var mpegts int64
+	var local time.Duration
+	if m != nil {
+		mpegts, local = m.mpegts, m.local
+	}
+	if t.reset {
+		t.reset = false
+		t.anchor = t.position
+		t.last = mpegts
+		t.origin = mpegts - int64(local)*tsTimescale/int64(time.Second)
+	} else {
+		// 33 bits wrap around
+		d := (mpegts - t.last) & (1<<33 - 1)
+		if d >= 1<<32 {
+			d -= 1 << 33
+		}
+		t.last += d
+	}
+	base := t.last - int64(local)*tsTimescale/int64(time.Second)
+	return t.anchor + time.Duration((base-t.origin)*int64(time.Second)/tsTimescale)
+}
+
+// dedupSubtitleCues sorts the cues and merges the cues which have the same text and settings and overlap.
+// A cue which spans segments is repeated in each segment. It returns the number of the merged cues.
+func dedupSubtitleCues(cues []*webvttCue) ([]*webvttCue, int) {
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].start < cues[j].start })
+	active := map[string]*webvttCue{}
+	var merged []*webvttCue
+	duplicates := 0
+	for _, c := range cues {
+		key := c.settings + "\x00" + c.text
+		if a, ok := active[key]; ok && c.start <= a.end {
+			if c.end > a.end {
+				a.end = c.end
+			}
+			duplicates++
+			continue
+		}
+		active[key] = c
+		merged = append(merged, c)
+	}
+	return merged, duplicates
+}
+
+// MergeSubtitles merges the WebVTT segments in the output directory into a WebVTT file.
+// Record a subtitle rendition by passing the URI of its media playlist. A call merges the rendition of a language.
+func (app *App) MergeSubtitles(opt *SubtitleOptions) (*SubtitleReport, error) {
+	dir := app.Config.OutputDir
+	p, err := loadLocalPlaylist(dir)
+	if err != nil {
+		return nil, err
+	}
+	output := opt.Output
+	if output == "" {
+		output = defaultSubtitleOutput
+		if opt.Language != "" {
+			output = "subtitles." + opt.Language + ".vtt"
+		}
+		output = filepath.Join(dir, output)
+	}
+
+	report := &SubtitleReport{Outputs: []string{}, Skipped: []SkippedSegment{}}
+	t := newSubtitleTimeline()
+	var blocks []string
+	var cues []*webvttCue
+	for _, s := range p.segments {
+		t.segment(s)
+		reason := ""
+		var f *webvttFile
+		if s.gap {
+			reason = "not downloaded"
+		} else if s.key != nil && s.key.method != "NONE" {
+			reason = "encrypted segment is not supported"
+		} else if s.initSection != nil {
+			reason = "fMP4 segment is not supported"
+		} else if b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(s.uri))); err != nil {
+			reason = err.Error()
+		} else if f, err = parseWebVTT(b); err != nil {
+			reason = err.Error()
+		}
+		if reason != "" {
+			report.Skipped = append(report.Skipped, SkippedSegment{No: s.no, URI: s.uri, Reason: reason})
+			continue
+		}
+
+		report.Segments++
+		offset := t.offset(f.timestampMap)
+		for _, c := range f.cues {
+			c.start += offset
+			c.end += offset
+			cues = append(cues, c)
+		}
+		for _, b := range f.blocks {
+			if !containsString(blocks, b) {
+				blocks = append(blocks, b)
+			}
+		}
+	}
+	if report.Segments == 0 {
+		return nil, xerrors.New("no WebVTT segment is found")
+	}
+	cues, report.Duplicates = dedupSubtitleCues(cues)
+	report.Cues = len(cues)
+	// the cue identifiers are unique in each segment, but not across the segments. i.g. 1, 2, ... in every segment
+	ids := map[string]bool{}
+	for _, c := range cues {
+		if ids[c.id] {
+			c.id = ""
+		}
+		ids[c.id] = true
+	}
+
+	if err := writeSubtitleFile(output, func(w io.Writer) error { return writeWebVTT(w, blocks, cues) }); err != nil {
+		return nil, err
+	}
+	report.Outputs = append(report.Outputs, output)
+	if opt.SRT {
+		srt := strings.TrimSuffix(output, filepath.Ext(output)) + ".srt"
+		if err := writeSubtitleFile(srt, func(w io.Writer) error { return writeSRT(w, cues) }); err != nil {
+			return nil, err
+		}
+		report.Outputs = append(report.Outputs, srt)
+	}
+	return report, nil
+}
+
+func writeSubtitleFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return xerrors.Errorf("os.Create failed: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("Close failed: %w", err)
+	}
+	return nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
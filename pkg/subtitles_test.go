@@ -0,0 +1,107 @@
+package hls_downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+	"go.uber.org/zap"
+)
+
+func TestParseWebVTT(t *testing.T) {
+	f, err := parseWebVTT([]byte("\ufeffWEBVTT - title\r\nX-TIMESTAMP-MAP=LOCAL:00:00:01.500,MPEGTS:900000\r\n\r\n" +
+		"NOTE comment\r\n\r\nSTYLE\r\n::cue { color: red }\r\n\r\n" +
+		"id1\r\n01:02.000 --> 01:01:02.500 align:start line:0\r\nline1\r\nline2\r\n\r\n\r\n" +
+		"00:00:03.000 --> 00:00:04.000\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, *f.timestampMap, webvttTimestampMap{mpegts: 900000, local: 1500 * time.Millisecond})
+	assert.Equal(t, f.blocks, []string{"STYLE\n::cue { color: red }"})
+	assert.Equal(t, len(f.cues), 2)
+	assert.Equal(t, *f.cues[0], webvttCue{id: "id1", start: 62 * time.Second, end: time.Hour + 62500*time.Millisecond, settings: "align:start line:0", text: "line1\nline2"})
+	assert.Equal(t, *f.cues[1], webvttCue{start: 3 * time.Second, end: 4 * time.Second})
+
+	_, err = parseWebVTT([]byte("WEBVTTX\n"))
+	assert.NotNil(t, err)
+	_, err = parseWebVTT([]byte("WEBVTT\n\n00:00.000 --> 00:60.000\n"))
+	assert.NotNil(t, err)
+	_, err = parseWebVTT([]byte("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:x,LOCAL:00:00.000\n"))
+	assert.NotNil(t, err)
+}
+
+func TestSubtitleTimeline(t *testing.T) {
+	tl := newSubtitleTimeline()
+	tl.segment(&segment{duration: 6})
+	assert.Equal(t, tl.offset(&webvttTimestampMap{mpegts: 1<<33 - 90000}), time.Duration(0))
+	// wrap around
+	tl.segment(&segment{duration: 6})
+	assert.Equal(t, tl.offset(&webvttTimestampMap{mpegts: 90000}), 2*time.Second)
+	// the cue time of LOCAL is the MPEG-2 time
+	tl.segment(&segment{duration: 6})
+	assert.Equal(t, tl.offset(&webvttTimestampMap{mpegts: 180000, local: 3 * time.Second}), 0*time.Second)
+	// continued by EXTINF after a discontinuity
+	tl.segment(&segment{duration: 6, discontinuity: true})
+	assert.Equal(t, tl.offset(nil), 18*time.Second)
+}
+
+func testSubtitleDir(t *testing.T) string {
+	dir := t.TempDir()
+	w := newPlaylistWriter(dir, localMediaPlaylist)
+	w.add(&segment{no: 1, duration: 4, uri: "1.vtt"})
+	w.add(&segment{no: 2, duration: 4, uri: "2.vtt"})
+	w.add(&segment{no: 3, duration: 4, uri: "3.vtt", discontinuity: true})
+	w.add(&segment{no: 4, duration: 4, uri: "4.vtt", gap: true})
+	w.add(&segment{no: 5, duration: 4, uri: "5.vtt"})
+	w.end = true
+	assert.Nil(t, w.write())
+	files := map[string]string{
+		"1.vtt": "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\nSTYLE\n::cue { color: red }\n\n" +
+			"00:00:01.000 --> 00:00:03.000\nhello\n\n00:00:03.500 --> 00:00:04.000 align:start\nspan\n",
+		// the cue spanning segments is repeated
+		"2.vtt": "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:1260000,LOCAL:00:00:04.000\n\nSTYLE\n::cue { color: red }\n\n" +
+			"00:00:03.500 --> 00:00:05.000 align:start\nspan\n\nc3\n00:00:06.000 --> 00:00:07.000\n<v Bob>world &amp; <b.loud>you</b></v>\n",
+		// the identifier is also used in the other segment
+		"3.vtt": "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n\nc3\n00:00:01.000 --> 00:00:02.000\nafter\n",
+		"5.vtt": "not WebVTT",
+	}
+	for name, body := range files {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(body), 0644))
+	}
+	return dir
+}
+
+func TestMergeSubtitles(t *testing.T) {
+	dir := testSubtitleDir(t)
+	app, _ := NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	report, err := app.MergeSubtitles(&SubtitleOptions{Language: "en", SRT: true})
+	assert.Nil(t, err)
+	vtt, srt := filepath.Join(dir, "subtitles.en.vtt"), filepath.Join(dir, "subtitles.en.srt")
+	assert.Equal(t, report.Outputs, []string{vtt, srt})
+	assert.Equal(t, report.Segments, 3)
+	assert.Equal(t, report.Cues, 4)
+	assert.Equal(t, report.Duplicates, 1)
+	assert.Equal(t, len(report.Skipped), 2)
+	assert.Equal(t, report.Skipped[0], SkippedSegment{No: 4, URI: "4.vtt", Reason: "not downloaded"})
+	assert.Equal(t, report.Skipped[1].No, 5)
+
+	b, err := os.ReadFile(vtt)
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), "WEBVTT\n\nSTYLE\n::cue { color: red }\n\n"+
+		"00:00:01.000 --> 00:00:03.000\nhello\n\n"+
+		"00:00:03.500 --> 00:00:05.000 align:start\nspan\n\n"+
+		"c3\n00:00:06.000 --> 00:00:07.000\n<v Bob>world &amp; <b.loud>you</b></v>\n\n"+
+		"00:00:09.000 --> 00:00:10.000\nafter\n")
+	b, err = os.ReadFile(srt)
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), "1\n00:00:01,000 --> 00:00:03,000\nhello\n\n"+
+		"2\n00:00:03,500 --> 00:00:05,000\nspan\n\n"+
+		"3\n00:00:06,000 --> 00:00:07,000\nworld & <b>you</b>\n\n"+
+		"4\n00:00:09,000 --> 00:00:10,000\nafter\n")
+
+	// without WebVTT segments
+	dir = testRemuxDir(t)
+	app, _ = NewApp(&Config{OutputDir: dir}, zap.NewNop())
+	_, err = app.MergeSubtitles(&SubtitleOptions{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,186 @@
+package hls_downloader
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// ThrottleOptions limits the bandwidth and the playlist reloads of a recording.
+type ThrottleOptions struct {
+	// BytesPerSecond caps the bandwidth of the recording. 0 is unlimited.
+	BytesPerSecond float64
+	// Global caps the bandwidth shared by the recordings which have the same limiter. nil is unlimited.
+	// It is for a program which runs several recordings in a process, since the command line records one stream.
+	Global *RateLimiter
+	// PlaylistRequestsPerSecond limits the reloads of the media playlist. 0 is unlimited.
+	// The master playlist, keys, init sections and the steering manifest are not limited.
+	PlaylistRequestsPerSecond float64
+}
+
+// RateLimiter is a token bucket. It also measures the actual rate.
+// It is safe for concurrent use.
+type RateLimiter struct {
+	mu sync.Mutex
+	// rate is the tokens per second. 0 is unlimited.
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// total is the tokens taken since start.
+	total float64
+	start time.Time
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter returns a limiter of rate tokens per second. i.g. bytes per second
+// It allows a burst of the tokens of a second. 0 is unlimited, which only measures the rate.
+func NewRateLimiter(rate float64) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: math.Max(rate, 1), tokens: math.Max(rate, 1), now: time.Now, sleep: time.Sleep}
+}
+
+// wait takes n tokens. It blocks until the bucket has them.
+func (l *RateLimiter) wait(n float64) {
+	l.mu.Lock()
+	now := l.now()
+	if l.start.IsZero() {
+		l.start = now
+	}
+	l.total += n
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	// the tokens may be negative, which makes the next callers wait in order
+	l.tokens -= n
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if d > 0 {
+		l.sleep(d)
+	}
+}
+
+// chunk returns the maximum tokens which are taken at once.
+func (l *RateLimiter) chunk() int {
+	if l.rate <= 0 {
+		return math.MaxInt32
+	}
+	return int(l.burst)
+}
+
+// Throughput returns the tokens taken and the actual rate per second since the first one.
+func (l *RateLimiter) Throughput() (float64, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.start.IsZero() {
+		return 0, 0
+	}
+	elapsed := l.now().Sub(l.start).Seconds()
+	if elapsed <= 0 {
+		return l.total, 0
+	}
+	return l.total, l.total / elapsed
+}
+
+// throttledReader reads a response body within the bandwidth of the limiters.
+type throttledReader struct {
+	r        io.ReadCloser
+	limiters []*RateLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	for _, l := range r.limiters {
+		if max := l.chunk(); len(p) > max {
+			p = p[:max]
+		}
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			l.wait(float64(n))
+		}
+	}
+	return n, err
+}
+
+func (r *throttledReader) Close() error {
+	return r.r.Close()
+}
+
+// throttle is the limiters of a recording.
+type throttle struct {
+	// bandwidth is the limiter of the recording. It is unlimited without the options to measure the throughput.
+	bandwidth *RateLimiter
+	global    *RateLimiter
+	playlist  *RateLimiter
+}
+
+func newThrottle(opt *ThrottleOptions) *throttle {
+	if opt == nil {
+		opt = &ThrottleOptions{}
+	}
+	t := &throttle{bandwidth: NewRateLimiter(opt.BytesPerSecond), global: opt.Global}
+	if opt.PlaylistRequestsPerSecond > 0 {
+		t.playlist = NewRateLimiter(opt.PlaylistRequestsPerSecond)
+	}
+	return t
+}
+
+// limit sets the bandwidth limiters to the client.
+func (t *throttle) limit(cli *client) {
+	cli.bandwidth = []*RateLimiter{t.bandwidth}
+	if t.global != nil {
+		cli.bandwidth = append(cli.bandwidth, t.global)
+	}
+}
+
+// waitPlaylist waits for the request limiter before a reload of the media playlist.
+func (t *throttle) waitPlaylist() {
+	if t.playlist != nil {
+		t.playlist.wait(1)
+	}
+}
+
+// report logs the actual throughput of the recording.
+func (t *throttle) report(logger *zap.Logger) {
+	bytes, rate := t.bandwidth.Throughput()
+	logger.Info("throughput", zap.Float64("bytes", bytes), zap.Float64("bytes_per_second", rate), zap.Float64("limit", t.bandwidth.rate))
+}
+
+// ParseRate parses a rate in bytes with a suffix of K, M or G like curl --limit-rate. i.g. 500K, 1.5M
+func ParseRate(s string) (float64, error) {
+	if s == "" {
+		return 0, xerrors.New("empty rate")
+	}
+	num, unit := s, 1.0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		unit = 1 << 10
+	case "M":
+		unit = 1 << 20
+	case "G":
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		num = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, xerrors.Errorf("invalid rate %q", s)
+	}
+	return v * unit, nil
+}
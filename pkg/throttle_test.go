@@ -0,0 +1,136 @@
+package hls_downloader
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+)
+
+// testRateLimiter returns a limiter whose clock advances only by sleep.
+func testRateLimiter(rate float64) (*RateLimiter, *time.Duration) {
+	l := NewRateLimiter(rate)
+	now := time.Unix(1700000000, 0)
+	var slept time.Duration
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	return l, &slept
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, slept := testRateLimiter(1000)
+	// the burst of a second doesn't wait
+	l.wait(1000)
+	assert.Equal(t, *slept, time.Duration(0))
+	l.wait(500)
+	assert.Equal(t, *slept, 500*time.Millisecond)
+	l.wait(1000)
+	assert.Equal(t, *slept, 1500*time.Millisecond)
+	total, rate := l.Throughput()
+	assert.Equal(t, total, 2500.0)
+	assert.Equal(t, rate, 2500/1.5)
+
+	// unlimited only measures
+	l, slept = testRateLimiter(0)
+	l.wait(1 << 30)
+	assert.Equal(t, *slept, time.Duration(0))
+	total, _ = l.Throughput()
+	assert.Equal(t, total, float64(1<<30))
+}
+
+func TestThrottledReader(t *testing.T) {
+	recording, recordingSlept := testRateLimiter(1000)
+	global, globalSlept := testRateLimiter(500)
+	r := &throttledReader{r: io.NopCloser(bytes.NewReader(make([]byte, 3000))), limiters: []*RateLimiter{recording, global}}
+	b := make([]byte, 4096)
+	n, err := r.Read(b)
+	assert.Nil(t, err)
+	// a read is limited to the smallest burst
+	assert.Equal(t, n, 500)
+	rest, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, len(rest), 2500)
+	assert.Equal(t, *globalSlept, 5*time.Second)
+	assert.Equal(t, *recordingSlept, 2*time.Second)
+	total, _ := global.Throughput()
+	assert.Equal(t, total, 3000.0)
+}
+
+func TestClientThrottle(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(make([]byte, 2048))
+	}))
+	defer ts.Close()
+
+	global, _ := testRateLimiter(1024)
+	th := newThrottle(&ThrottleOptions{BytesPerSecond: 4096, Global: global, PlaylistRequestsPerSecond: 2})
+	assert.Equal(t, th.bandwidth.rate, 4096.0)
+	assert.Equal(t, th.playlist.rate, 2.0)
+	th.bandwidth, _ = testRateLimiter(4096)
+	playlist, playlistSlept := testRateLimiter(2)
+	th.playlist = playlist
+	cli := (&Config{}).newClient(http.DefaultTransport, nil, 0)
+	th.limit(cli)
+	segmentCli := (&Config{}).newClient(http.DefaultTransport, nil, 0)
+	th.limit(segmentCli)
+
+	for i := 0; i < 4; i++ {
+		th.waitPlaylist()
+		resp, err := cli.get(ts.URL)
+		assert.Nil(t, err)
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, len(b), 2048)
+	}
+	// 2 reloads of the burst, then every 0.5 seconds
+	assert.Equal(t, *playlistSlept, time.Second)
+	// the other requests of the client are not limited. i.g. keys
+	resp, err := cli.get(ts.URL)
+	assert.Nil(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, *playlistSlept, time.Second)
+
+	resp, err = segmentCli.get(ts.URL)
+	assert.Nil(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	total, _ := th.bandwidth.Throughput()
+	assert.Equal(t, total, 6*2048.0)
+	total, _ = global.Throughput()
+	assert.Equal(t, total, 6*2048.0)
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		rate float64
+		err  bool
+	}{
+		{in: "1000", rate: 1000},
+		{in: "500K", rate: 500 * 1024},
+		{in: "1.5m", rate: 1.5 * 1024 * 1024},
+		{in: "1G", rate: 1024 * 1024 * 1024},
+		{in: "", err: true},
+		{in: "M", err: true},
+		{in: "-1K", err: true},
+		{in: "fast", err: true},
+	}
+	for _, tt := range tests {
+		rate, err := ParseRate(tt.in)
+		if tt.err {
+			assert.NotNil(t, err, tt.in)
+			continue
+		}
+		assert.Nil(t, err, tt.in)
+		assert.Equal(t, rate, tt.rate, tt.in)
+	}
+}
@@ -0,0 +1,252 @@
+package hls_downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// tokenExpiryMargin renews a token before its expiry not to send an expiring token.
+const tokenExpiryMargin = 30 * time.Second
+
+// TokenProvider gives the access token of the requests.
+// It is shared by the playlist and segment requests, so it must be safe for concurrent use.
+type TokenProvider interface {
+	// Token returns the current token. It gets a new one at first and after the expiry.
+	Token() (string, error)
+	// Refresh gets a new token because the server rejected stale.
+	// If the token is already renewed from stale, i.g. by another request, it returns the current one.
+	Refresh(stale string) (string, error)
+}
+
+// tokenCache is the TokenProvider which keeps the token got by fetch.
+type tokenCache struct {
+	mu    sync.Mutex
+	token string
+	// expiry is zero if the token doesn't expire.
+	expiry time.Time
+	fetch  func() (string, time.Time, error)
+}
+
+func (c *tokenCache) Token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && (c.expiry.IsZero() || time.Now().Add(tokenExpiryMargin).Before(c.expiry)) {
+		return c.token, nil
+	}
+	return c.renew()
+}
+
+func (c *tokenCache) Refresh(stale string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && c.token != stale {
+		return c.token, nil
+	}
+	return c.renew()
+}
+
+func (c *tokenCache) renew() (string, error) {
+	token, expiry, err := c.fetch()
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", xerrors.New("empty token")
+	}
+	c.token, c.expiry = token, expiry
+	return token, nil
+}
+
+// tokenCommandTimeout is the time limit of the command of NewCommandTokenProvider.
+// The requests wait for the token, so a hung command must not block them forever.
+const tokenCommandTimeout = 30 * time.Second
+
+// NewCommandTokenProvider returns the TokenProvider which runs the command and uses its stdout as the token.
+// i.g. NewCommandTokenProvider("gcloud", "auth", "print-access-token")
+// The command runs again when the token is rejected. It is killed after 30 seconds.
+func NewCommandTokenProvider(name string, args ...string) TokenProvider {
+	return newCommandTokenProvider(tokenCommandTimeout, name, args...)
+}
+
+func newCommandTokenProvider(timeout time.Duration, name string, args ...string) TokenProvider {
+	return &tokenCache{fetch: func() (string, time.Time, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(name, args...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		// the children of a shell keep stdout open after the shell is killed, so the process group is killed
+		setProcessGroup(cmd)
+		if err := cmd.Start(); err != nil {
+			return "", time.Time{}, xerrors.Errorf("%s failed: %w", name, err)
+		}
+		exited := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = killProcessGroup(cmd)
+			case <-exited:
+			}
+		}()
+		err := cmd.Wait()
+		close(exited)
+		if ctx.Err() != nil {
+			return "", time.Time{}, xerrors.Errorf("%s timed out after %v: %w", name, timeout, ctx.Err())
+		}
+		if err != nil {
+			return "", time.Time{}, xerrors.Errorf("%s failed: %s: %w", name, strings.TrimSpace(stderr.String()), err)
+		}
+		return strings.TrimSpace(stdout.String()), time.Time{}, nil
+	}}
+}
+
+// fileTokenProvider reads the token from a file which is rewritten by another process. i.g. a sidecar
+type fileTokenProvider struct {
+	path    string
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+}
+
+// NewFileTokenProvider returns the TokenProvider which reads the token from the file.
+// The file is read again when it is modified or the token is rejected.
+func NewFileTokenProvider(path string) TokenProvider {
+	return &fileTokenProvider{path: path}
+}
+
+func (p *fileTokenProvider) Token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return "", xerrors.Errorf("os.Stat failed: %w", err)
+	}
+	if p.token != "" && fi.ModTime().Equal(p.modTime) {
+		return p.token, nil
+	}
+	return p.read()
+}
+
+func (p *fileTokenProvider) Refresh(stale string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.read()
+}
+
+func (p *fileTokenProvider) read() (string, error) {
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return "", xerrors.Errorf("os.Stat failed: %w", err)
+	}
+	b, err := os.ReadFile(p.path)
+	if err != nil {
+		return "", xerrors.Errorf("os.ReadFile failed: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", xerrors.Errorf("empty token in %s", p.path)
+	}
+	p.token, p.modTime = token, fi.ModTime()
+	return token, nil
+}
+
+// OAuth2Options is the client of the OAuth 2.0 client credentials grant. see RFC6749 4.4
+type OAuth2Options struct {
+	// TokenURL is the token endpoint. i.g. https://auth.example.com/oauth2/token
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// Client requests the token endpoint. nil is a client with a timeout of 30 seconds.
+	Client *http.Client
+}
+
+// NewOAuth2TokenProvider returns the TokenProvider which gets an access token by the client credentials grant.
+// The token is renewed before expires_in.
+func NewOAuth2TokenProvider(opt *OAuth2Options) TokenProvider {
+	cli := opt.Client
+	if cli == nil {
+		cli = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &tokenCache{fetch: func() (string, time.Time, error) {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		if len(opt.Scopes) > 0 {
+			form.Set("scope", strings.Join(opt.Scopes, " "))
+		}
+		req, err := http.NewRequest("POST", opt.TokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", time.Time{}, xerrors.Errorf("http.NewRequest failed: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.SetBasicAuth(url.QueryEscape(opt.ClientID), url.QueryEscape(opt.ClientSecret))
+		start := time.Now()
+		resp, err := cli.Do(req)
+		if err != nil {
+			return "", time.Time{}, xerrors.Errorf("Do failed: %w", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var body struct {
+			AccessToken      string `json:"access_token"`
+			ExpiresIn        int64  `json:"expires_in"`
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+			return "", time.Time{}, xerrors.Errorf("json.Decode failed: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", time.Time{}, xerrors.Errorf("token endpoint %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+		}
+		var expiry time.Time
+		if body.ExpiresIn > 0 {
+			expiry = start.Add(time.Duration(body.ExpiresIn) * time.Second)
+		}
+		return body.AccessToken, expiry, nil
+	}}
+}
+
+// TokenAuth sends the token of Provider, and gets a new token when the server rejects it.
+type TokenAuth struct {
+	Provider TokenProvider
+	// Param sends the token in the query parameter instead of the Authorization header. i.g. token
+	Param string
+}
+
+func (a *TokenAuth) Authenticate(req *http.Request) error {
+	token, err := a.Provider.Token()
+	if err != nil {
+		return xerrors.Errorf("Token failed: %w", err)
+	}
+	return a.authenticator(token).Authenticate(req)
+}
+
+// Refresh renews the token which is sent with req.
+func (a *TokenAuth) Refresh(req *http.Request) error {
+	stale := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if a.Param != "" {
+		stale = req.URL.Query().Get(a.Param)
+	}
+	if _, err := a.Provider.Refresh(stale); err != nil {
+		return xerrors.Errorf("Refresh failed: %w", err)
+	}
+	return nil
+}
+
+func (a *TokenAuth) authenticator(token string) Authenticator {
+	if a.Param != "" {
+		return &QueryTokenAuth{Param: a.Param, Token: token}
+	}
+	return &BearerAuth{Token: token}
+}
@@ -0,0 +1,238 @@
+package hls_downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestTokenCache(t *testing.T) {
+	var fetched int
+	expiresIn := time.Hour
+	c := &tokenCache{fetch: func() (string, time.Time, error) {
+		fetched++
+		return fmt.Sprintf("token%d", fetched), time.Now().Add(expiresIn), nil
+	}}
+
+	token, err := c.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, token, "token1")
+	token, err = c.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, token, "token1")
+
+	// a stale token is refreshed only once
+	token, err = c.Refresh("token1")
+	assert.Nil(t, err)
+	assert.Equal(t, token, "token2")
+	token, err = c.Refresh("token1")
+	assert.Nil(t, err)
+	assert.Equal(t, token, "token2")
+
+	// a token is renewed before the expiry
+	expiresIn = tokenExpiryMargin / 2
+	token, err = c.Refresh("token2")
+	assert.Nil(t, err)
+	assert.Equal(t, token, "token3")
+	token, err = c.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, token, "token4")
+
+	c = &tokenCache{fetch: func() (string, time.Time, error) { return "", time.Time{}, nil }}
+	_, err = c.Token()
+	assert.NotNil(t, err)
+}
+
+func TestCommandTokenProvider(t *testing.T) {
+	p := NewCommandTokenProvider("sh", "-c", "echo abc")
+	token, err := p.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, token, "abc")
+
+	p = NewCommandTokenProvider("sh", "-c", "echo denied >&2; exit 1")
+	_, err = p.Token()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "denied")
+
+	// a hung command is killed
+	p = newCommandTokenProvider(100*time.Millisecond, "sleep", "10")
+	start := time.Now()
+	_, err = p.Token()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// the child of the shell is also killed
+	p = newCommandTokenProvider(200*time.Millisecond, "sh", "-c", "sleep 10; echo abc")
+	start = time.Now()
+	_, err = p.Token()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestFileTokenProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	p := NewFileTokenProvider(path)
+	_, err := p.Token()
+	assert.NotNil(t, err)
+
+	assert.Nil(t, os.WriteFile(path, []byte("abc\n"), 0600))
+	token, err := p.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, token, "abc")
+
+	// the rewritten file is read again
+	assert.Nil(t, os.WriteFile(path, []byte("def\n"), 0600))
+	mtime := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, mtime, mtime))
+	token, err = p.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, token, "def")
+
+	assert.Nil(t, os.WriteFile(path, []byte("ghi"), 0600))
+	assert.Nil(t, os.Chtimes(path, mtime, mtime))
+	token, err = p.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, token, "def")
+	token, err = p.Refresh("def")
+	assert.Nil(t, err)
+	assert.Equal(t, token, "ghi")
+}
+
+func TestOAuth2TokenProvider(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		user, password, _ := r.BasicAuth()
+		if r.Method != "POST" || user != "client" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"error":"invalid_client"}`)
+			return
+		}
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, r.PostForm.Get("grant_type"), "client_credentials")
+		assert.Equal(t, r.PostForm.Get("scope"), "a b")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"token%d","token_type":"Bearer","expires_in":3600}`, requests)
+	}))
+	defer ts.Close()
+
+	p := NewOAuth2TokenProvider(&OAuth2Options{TokenURL: ts.URL, ClientID: "client", ClientSecret: "secret", Scopes: []string{"a", "b"}})
+	token, err := p.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, token, "token1")
+	token, err = p.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, token, "token1")
+	token, err = p.Refresh("token1")
+	assert.Nil(t, err)
+	assert.Equal(t, token, "token2")
+	assert.Equal(t, requests, 2)
+
+	p = NewOAuth2TokenProvider(&OAuth2Options{TokenURL: ts.URL, ClientID: "client", ClientSecret: "wrong"})
+	_, err = p.Token()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid_client")
+}
+
+// testTokenServer accepts only the current token in the Authorization header or the query string.
+type testTokenServer struct {
+	mu      sync.Mutex
+	current string
+	tokens  []string
+}
+
+func (s *testTokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.Header.Get("Authorization")
+	}
+	s.tokens = append(s.tokens, token)
+	if token != s.current && token != "Bearer "+s.current {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	_, _ = io.WriteString(w, "a_ts_file_binary")
+}
+
+func TestClientRefresh(t *testing.T) {
+	s := &testTokenServer{current: "new"}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	next := []string{"old", "new"}
+	provider := &tokenCache{fetch: func() (string, time.Time, error) {
+		token := next[0]
+		if len(next) > 1 {
+			next = next[1:]
+		}
+		return token, time.Time{}, nil
+	}}
+	config := &Config{Auth: &TokenAuth{Provider: provider}}
+	resp, retries, err := config.newClient(http.DefaultTransport, nil, 0).fetch(ts.URL)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, retries, 1)
+	assert.Equal(t, s.tokens, []string{"Bearer old", "Bearer new"})
+
+	// the request gives up if the new token is also rejected
+	s.current = "newer"
+	s.tokens = nil
+	resp, retries, err = config.newClient(http.DefaultTransport, nil, 0).fetch(ts.URL)
+	assert.NotNil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+	assert.Equal(t, retries, maxAuthRetries)
+	assert.Equal(t, s.tokens, []string{"Bearer new", "Bearer new"})
+
+	// Authenticator without Refresher isn't retried
+	s.tokens = nil
+	config = &Config{Auth: &QueryTokenAuth{Token: "old"}}
+	_, retries, err = config.newClient(http.DefaultTransport, nil, 0).fetch(ts.URL)
+	assert.NotNil(t, err)
+	assert.Equal(t, retries, 0)
+	assert.Equal(t, s.tokens, []string{"old"})
+}
+
+func TestSegmentDownloaderRefresh(t *testing.T) {
+	s := &testTokenServer{current: "new"}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	next := []string{"old", "new"}
+	provider := &tokenCache{fetch: func() (string, time.Time, error) {
+		token := next[0]
+		next = next[1:]
+		return token, time.Time{}, nil
+	}}
+	resChan := make(chan downloadResult, 1)
+	segChan := make(chan segment, 1)
+	d := newSegmentDownloader(&fakePlaylistController{resChan: resChan}, segChan, http.DefaultTransport, time.Second, "", "")
+	d.cli.auth = &TokenAuth{Provider: provider, Param: "token"}
+	d.storage = NewMemoryStorage()
+	d.manifest = newRecordingManifest(d.storage, ts.URL)
+	go d.Run()
+	defer close(segChan)
+
+	seg := segment{duration: 1, uri: ts.URL + "/1.ts", no: 1}
+	local := seg
+	seg.local = &local
+	segChan <- seg
+	r := <-resChan
+	assert.Nil(t, r.err)
+	assert.Equal(t, s.tokens, []string{"old", "new"})
+
+	assert.Nil(t, d.manifest.add(seg.local))
+	assert.Equal(t, d.manifest.manifest.Segments[0].Retries, 1)
+	assert.Equal(t, d.manifest.manifest.Segments[0].Status, http.StatusOK)
+}
@@ -0,0 +1,192 @@
+package hls_downloader
+
+import (
+	"fmt"
+)
+
+const (
+	TSIssueSyncByte           = "sync_byte"
+	TSIssueTransportError     = "transport_error"
+	TSIssueContinuityCounter  = "continuity_counter"
+	TSIssuePCR                = "pcr"
+	TSIssueDTS                = "dts"
+	TSIssuePATMissing         = "pat_missing"
+	TSIssuePMTMissing         = "pmt_missing"
+	TSIssueIDRMissing         = "idr_missing"
+	TSIssueInvalidPacketCount = "invalid_packet_count"
+)
+
+// TSIssue is a problem found by the TS analyzer.
+type TSIssue struct {
+	Kind string `json:"kind"`
+	// Packet is the index of the ts packet in the segment.
+	Packet  int    `json:"packet"`
+	PID     int    `json:"pid"`
+	Message string `json:"message"`
+}
+
+// TSAnalysis is the result of the TS analyzer for a segment.
+type TSAnalysis struct {
+	Packets int       `json:"packets"`
+	Issues  []TSIssue `json:"issues"`
+}
+
+// tsAnalyzer checks the integrity of MPEG-TS segments.
+// Continuity counters, PCR and DTS are checked also across segment boundaries.
+type tsAnalyzer struct {
+	demuxer *tsDemuxer
+	lastNo  int
+	cc      map[int]int
+	lastPCR int64
+	lastDTS map[int]int64
+
+	// state of the current segment
+	analysis  *TSAnalysis
+	packet    int
+	seenPAT   bool
+	seenPMT   bool
+	seenVideo bool
+}
+
+func newTSAnalyzer() *tsAnalyzer {
+	a := &tsAnalyzer{lastNo: -1}
+	a.reset()
+	a.demuxer = newTSDemuxer(a.onPES)
+	return a
+}
+
+// reset forgets the state of the previous segment.
+func (a *tsAnalyzer) reset() {
+	a.cc = map[int]int{}
+	a.lastPCR = -1
+	a.lastDTS = map[int]int64{}
+}
+
+func (a *tsAnalyzer) issue(kind string, pid int, format string, args ...interface{}) {
+	a.analysis.Issues = append(a.analysis.Issues, TSIssue{
+		Kind:    kind,
+		Packet:  a.packet,
+		PID:     pid,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (a *tsAnalyzer) process(seg *segment, data []byte, report *SegmentReport) error {
+	if (seg.key != nil && seg.key.method != "NONE") || seg.initSection != nil {
+		// encrypted or not MPEG-TS
+		return nil
+	}
+	report.TS = a.analyze(seg, data)
+	return nil
+}
+
+func (a *tsAnalyzer) analyze(seg *segment, data []byte) *TSAnalysis {
+	if seg.discontinuity || a.lastNo < 0 || seg.no != a.lastNo+1 {
+		// the timestamps and the counters are not continuous
+		a.reset()
+	}
+	a.lastNo = seg.no
+	a.analysis = &TSAnalysis{Issues: []TSIssue{}}
+	a.seenPAT, a.seenPMT, a.seenVideo = false, false, false
+
+	if len(data)%tsPacketSize != 0 {
+		a.packet = len(data) / tsPacketSize
+		a.issue(TSIssueInvalidPacketCount, -1, "size %d is not a multiple of %d", len(data), tsPacketSize)
+	}
+	for a.packet = 0; (a.packet+1)*tsPacketSize <= len(data); a.packet++ {
+		b := data[a.packet*tsPacketSize : (a.packet+1)*tsPacketSize]
+		a.analysis.Packets++
+		p, err := parseTSPacket(b)
+		if err != nil {
+			if b[0] != tsSyncByte {
+				a.issue(TSIssueSyncByte, -1, "sync byte is 0x%02x", b[0])
+			} else {
+				a.issue(TSIssueSyncByte, -1, "%v", err)
+			}
+			continue
+		}
+		a.check(p)
+		_ = a.demuxer.handle(p)
+	}
+	_ = a.demuxer.flush()
+	if !a.seenPAT {
+		a.issue(TSIssuePATMissing, patPID, "PAT is not found")
+	}
+	if !a.seenPMT {
+		a.issue(TSIssuePMTMissing, a.demuxer.pmtPID, "PMT is not found")
+	}
+	return a.analysis
+}
+
+// check checks a ts packet before the demuxer.
+func (a *tsAnalyzer) check(p *tsPacket) {
+	if p.transportErrorIndicator {
+		a.issue(TSIssueTransportError, p.pid, "transport_error_indicator is set")
+	}
+	if p.pid == nullPID {
+		return
+	}
+
+	switch {
+	case p.pid == patPID:
+		a.seenPAT = true
+	case p.pid == a.demuxer.pmtPID && a.seenPAT:
+		a.seenPMT = true
+	case !a.seenPAT || !a.seenPMT:
+		if _, ok := a.demuxer.streams[p.pid]; ok && p.pusi {
+			if !a.seenPAT {
+				a.seenPAT = true
+				a.issue(TSIssuePATMissing, patPID, "PAT is not found at the start of the segment")
+			}
+			if !a.seenPMT {
+				a.seenPMT = true
+				a.issue(TSIssuePMTMissing, a.demuxer.pmtPID, "PMT is not found at the start of the segment")
+			}
+		}
+	}
+
+	// see ISO/IEC 13818-1 2.4.3.3 continuity_counter
+	if last, ok := a.cc[p.pid]; ok && !p.discontinuity {
+		expected := last
+		if p.hasPayload {
+			expected = (last + 1) & 0x0f
+		}
+		// a duplicate packet has the same counter
+		if p.cc != expected && !(p.hasPayload && p.cc == last) {
+			a.issue(TSIssueContinuityCounter, p.pid, "continuity_counter %d, expected %d", p.cc, expected)
+		}
+	}
+	a.cc[p.pid] = p.cc
+
+	if p.pcr >= 0 {
+		if p.discontinuity {
+			a.lastPCR = -1
+		}
+		if a.lastPCR >= 0 && !forward(a.lastPCR/300, p.pcr/300) && a.lastPCR != p.pcr {
+			a.issue(TSIssuePCR, p.pid, "PCR %d is not after %d", p.pcr, a.lastPCR)
+		}
+		a.lastPCR = p.pcr
+	}
+}
+
+// forward returns true if the 33 bits timestamp b is after a.
+func forward(a, b int64) bool {
+	d := (b - a) & (1<<33 - 1)
+	return d != 0 && d < 1<<32
+}
+
+func (a *tsAnalyzer) onPES(pes *pesPacket) error {
+	if pes.dts >= 0 {
+		if last, ok := a.lastDTS[pes.pid]; ok && !forward(last, pes.dts) {
+			a.issue(TSIssueDTS, pes.pid, "DTS %d is not after %d", pes.dts, last)
+		}
+		a.lastDTS[pes.pid] = pes.dts
+	}
+	if (pes.streamType == streamTypeH264 || pes.streamType == streamTypeH265) && !a.seenVideo {
+		a.seenVideo = true
+		if !isRandomAccess(pes.streamType, pes.data) {
+			a.issue(TSIssueIDRMissing, pes.pid, "the first video frame is not IDR")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func testIssueKinds(a *TSAnalysis) []string {
+	kinds := []string{}
+	for _, i := range a.Issues {
+		kinds = append(kinds, i.Kind)
+	}
+	return kinds
+}
+
+func newTestAVMuxer() *testTSMuxer {
+	return newTestTSMuxer(map[int]byte{testVideoPID: streamTypeH264, testAudioPID: streamTypeAAC})
+}
+
+func TestTSAnalyzer(t *testing.T) {
+	m := newTestAVMuxer()
+	a := newTSAnalyzer()
+
+	seg1 := m.segment(900000, 4)
+	r := a.analyze(&segment{no: 1}, seg1)
+	assert.Equal(t, r.Packets, len(seg1)/tsPacketSize)
+	assert.Equal(t, testIssueKinds(r), []string{})
+
+	// continuous segment
+	r = a.analyze(&segment{no: 2}, m.segment(900000+4*testFrameDuration, 4))
+	assert.Equal(t, testIssueKinds(r), []string{})
+
+	// DTS and PCR go back without a discontinuity
+	r = a.analyze(&segment{no: 3}, m.segment(900000, 4))
+	assert.Equal(t, testIssueKinds(r), []string{TSIssuePCR, TSIssueDTS, TSIssueDTS})
+
+	// EXT-X-DISCONTINUITY resets the state
+	r = a.analyze(&segment{no: 4, discontinuity: true}, m.segment(0, 4))
+	assert.Equal(t, testIssueKinds(r), []string{})
+
+	// the continuity counters of PAT and PMT don't continue
+	r = a.analyze(&segment{no: 5}, newTestAVMuxer().segment(4*testFrameDuration, 4))
+	assert.Equal(t, testIssueKinds(r), []string{TSIssueContinuityCounter, TSIssueContinuityCounter})
+	assert.Equal(t, r.Issues[0].PID, patPID)
+	assert.Equal(t, r.Issues[0].Packet, 0)
+	assert.Equal(t, r.Issues[1].PID, testPMTPID)
+}
+
+func TestTSAnalyzerSegmentStart(t *testing.T) {
+	m := newTestAVMuxer()
+	a := newTSAnalyzer()
+	a.analyze(&segment{no: 1}, m.segment(0, 2))
+
+	// without PAT and PMT
+	seg := m.segment(2*testFrameDuration, 2)
+	r := a.analyze(&segment{no: 2}, seg[2*tsPacketSize:])
+	assert.Equal(t, testIssueKinds(r), []string{TSIssuePATMissing, TSIssuePMTMissing})
+
+	// without IDR
+	m.out = nil
+	m.tables()
+	m.pes(testVideoPID, 0, 0, []byte{0, 0, 1, 0x41, 0x9a})
+	r = a.analyze(&segment{no: 1, discontinuity: true}, m.out)
+	assert.Equal(t, testIssueKinds(r), []string{TSIssueIDRMissing})
+
+	// broken packets
+	seg = m.segment(0, 2)
+	seg[tsPacketSize*3] = 0
+	seg[tsPacketSize*4+1] |= 0x80
+	r = a.analyze(&segment{no: 1, discontinuity: true}, append(seg, 0x47))
+	assert.Equal(t, testIssueKinds(r), []string{TSIssueInvalidPacketCount, TSIssueSyncByte, TSIssueTransportError})
+	assert.Equal(t, r.Issues[1].Packet, 3)
+
+	// encrypted segments are not analyzed
+	report := &SegmentReport{}
+	assert.Nil(t, a.process(&segment{no: 2, key: &segmentKey{method: "AES-128"}}, seg, report))
+	assert.True(t, report.TS == nil)
+}
+
+type testSegmentProcessor struct {
+	err error
+}
+
+func (p *testSegmentProcessor) process(seg *segment, data []byte, report *SegmentReport) error {
+	return p.err
+}
+
+func TestSegmentDownloaderProcess(t *testing.T) {
+	dir := t.TempDir()
+	d := newSegmentDownloader(nil, nil, nil, 0, dir, "")
+	// the report of the previous recording is removed
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, localReport), []byte("{\"no\":100}\n"), 0644))
+	var err error
+	d.report, err = newRecordingReport(NewLocalStorage(dir))
+	assert.Nil(t, err)
+	d.processors = []segmentProcessor{newTSAnalyzer(), &testSegmentProcessor{err: os.ErrNotExist}}
+	d.process(&segment{no: 1, uri: "http://example.com/1.ts"}, newTestAVMuxer().segment(0, 2))
+	d.process(&segment{no: 2, uri: "http://example.com/2.ts"}, []byte{0})
+
+	f, err := os.Open(filepath.Join(dir, localReport))
+	assert.Nil(t, err)
+	defer func() { _ = f.Close() }()
+	var reports []SegmentReport
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r SegmentReport
+		assert.Nil(t, json.Unmarshal(s.Bytes(), &r))
+		reports = append(reports, r)
+	}
+	assert.Equal(t, len(reports), 2)
+	assert.Equal(t, reports[0].URI, "http://example.com/1.ts")
+	assert.Equal(t, reports[0].TS.Issues, []TSIssue{})
+	assert.Equal(t, reports[0].Errors, []string{os.ErrNotExist.Error()})
+	assert.Equal(t, reports[1].TS.Issues[0].Kind, TSIssueInvalidPacketCount)
+}
@@ -0,0 +1,263 @@
+package hls_downloader
+
+import (
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// see ISO/IEC 13818-1
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	patPID       = 0
+	nullPID      = 0x1fff
+
+	streamTypeAAC      = 0x0f
+	streamTypeMetadata = 0x15
+	streamTypeH264     = 0x1b
+	streamTypeH265     = 0x24
+)
+
+var ErrInvalidTSPacket = xerrors.New("invalid ts packet")
+
+type tsPacket struct {
+	pid                     int
+	pusi                    bool
+	cc                      int
+	hasPayload              bool
+	discontinuity           bool
+	randomAccess            bool
+	pcr                     int64
+	payload                 []byte
+	transportErrorIndicator bool
+}
+
+// parseTSPacket parses a 188 bytes ts packet. pcr is -1 if the packet doesn't have PCR.
+func parseTSPacket(b []byte) (*tsPacket, error) {
+	if len(b) != tsPacketSize || b[0] != tsSyncByte {
+		return nil, ErrInvalidTSPacket
+	}
+	p := &tsPacket{
+		transportErrorIndicator: b[1]&0x80 != 0,
+		pusi:                    b[1]&0x40 != 0,
+		pid:                     int(b[1]&0x1f)<<8 | int(b[2]),
+		cc:                      int(b[3] & 0x0f),
+		hasPayload:              b[3]&0x10 != 0,
+		pcr:                     -1,
+	}
+	i := 4
+	if b[3]&0x20 != 0 {
+		// adaptation field
+		l := int(b[4])
+		i = 5 + l
+		if i > tsPacketSize {
+			return nil, xerrors.Errorf("adaptation_field_length %d: %w", l, ErrInvalidTSPacket)
+		}
+		if l > 0 {
+			flags := b[5]
+			p.discontinuity = flags&0x80 != 0
+			p.randomAccess = flags&0x40 != 0
+			if flags&0x10 != 0 && l >= 7 {
+				base := int64(b[6])<<25 | int64(b[7])<<17 | int64(b[8])<<9 | int64(b[9])<<1 | int64(b[10])>>7
+				ext := int64(b[10]&0x01)<<8 | int64(b[11])
+				p.pcr = base*300 + ext
+			}
+		}
+	}
+	if p.hasPayload {
+		p.payload = b[i:]
+	}
+	return p, nil
+}
+
+type tsStream struct {
+	pid         int
+	streamType  byte
+	descriptors []byte
+}
+
+type pesPacket struct {
+	pid        int
+	streamType byte
+	streamID   byte
+	// pts and dts are 90kHz. -1 if absent.
+	pts  int64
+	dts  int64
+	data []byte
+}
+
+// tsDemuxer demultiplexes ts packets into PES packets.
+type tsDemuxer struct {
+	pmtPID  int
+	pcrPID  int
+	streams map[int]*tsStream
+	pending map[int][]byte
+	// onPacket is called for each ts packet if it is set.
+	onPacket func(*tsPacket)
+	// onPES is called for each PES packet.
+	onPES func(*pesPacket) error
+}
+
+func newTSDemuxer(onPES func(*pesPacket) error) *tsDemuxer {
+	return &tsDemuxer{
+		pmtPID:  -1,
+		pcrPID:  -1,
+		streams: map[int]*tsStream{},
+		pending: map[int][]byte{},
+		onPES:   onPES,
+	}
+}
+
+// feed demultiplexes ts packets. The length of b shall be a multiple of 188.
+func (d *tsDemuxer) feed(b []byte) error {
+	if len(b)%tsPacketSize != 0 {
+		return xerrors.Errorf("length %d is not a multiple of %d: %w", len(b), tsPacketSize, ErrInvalidTSPacket)
+	}
+	for i := 0; i < len(b); i += tsPacketSize {
+		p, err := parseTSPacket(b[i : i+tsPacketSize])
+		if err != nil {
+			return xerrors.Errorf("packet at %d: %w", i, err)
+		}
+		if d.onPacket != nil {
+			d.onPacket(p)
+		}
+		if err := d.handle(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *tsDemuxer) handle(p *tsPacket) error {
+	if !p.hasPayload || p.pid == nullPID {
+		return nil
+	}
+	switch {
+	case p.pid == patPID:
+		if p.pusi {
+			d.parsePAT(p.payload)
+		}
+	case p.pid == d.pmtPID:
+		if p.pusi {
+			d.parsePMT(p.payload)
+		}
+	default:
+		if _, ok := d.streams[p.pid]; !ok {
+			return nil
+		}
+		if p.pusi {
+			if err := d.emit(p.pid); err != nil {
+				return err
+			}
+			d.pending[p.pid] = append([]byte{}, p.payload...)
+		} else if d.pending[p.pid] != nil {
+			d.pending[p.pid] = append(d.pending[p.pid], p.payload...)
+		}
+	}
+	return nil
+}
+
+// flush emits the pending PES packets. Call it at the end of a segment.
+func (d *tsDemuxer) flush() error {
+	pids := make([]int, 0, len(d.pending))
+	for pid := range d.pending {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		if err := d.emit(pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// psiSection returns the section of PSI. see ISO/IEC 13818-1 2.4.4
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+	s := payload[1+pointer:]
+	l := int(s[1]&0x0f)<<8 | int(s[2])
+	if 3+l > len(s) || l < 9 {
+		return nil
+	}
+	// without CRC_32
+	return s[:3+l-4]
+}
+
+func (d *tsDemuxer) parsePAT(payload []byte) {
+	s := psiSection(payload)
+	if s == nil || s[0] != 0x00 {
+		return
+	}
+	for i := 8; i+4 <= len(s); i += 4 {
+		program := int(s[i])<<8 | int(s[i+1])
+		if program == 0 {
+			// network PID
+			continue
+		}
+		d.pmtPID = int(s[i+2]&0x1f)<<8 | int(s[i+3])
+		return
+	}
+}
+
+func (d *tsDemuxer) parsePMT(payload []byte) {
+	s := psiSection(payload)
+	if s == nil || s[0] != 0x02 || len(s) < 12 {
+		return
+	}
+	d.pcrPID = int(s[8]&0x1f)<<8 | int(s[9])
+	programInfoLength := int(s[10]&0x0f)<<8 | int(s[11])
+	for i := 12 + programInfoLength; i+5 <= len(s); {
+		streamType := s[i]
+		pid := int(s[i+1]&0x1f)<<8 | int(s[i+2])
+		esInfoLength := int(s[i+3]&0x0f)<<8 | int(s[i+4])
+		end := i + 5 + esInfoLength
+		if end > len(s) {
+			return
+		}
+		d.streams[pid] = &tsStream{pid: pid, streamType: streamType, descriptors: s[i+5 : end]}
+		i = end
+	}
+}
+
+// parseTimestamp parses 33 bits PTS or DTS.
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]&0x0e)<<29 | int64(b[1])<<22 | int64(b[2]&0xfe)<<14 | int64(b[3])<<7 | int64(b[4])>>1
+}
+
+func (d *tsDemuxer) emit(pid int) error {
+	b := d.pending[pid]
+	delete(d.pending, pid)
+	if b == nil {
+		return nil
+	}
+	// see ISO/IEC 13818-1 2.4.3.6 PES packet
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return nil
+	}
+	pes := &pesPacket{pid: pid, streamType: d.streams[pid].streamType, streamID: b[3], pts: -1, dts: -1}
+	headerLength := int(b[8])
+	if 9+headerLength > len(b) {
+		return nil
+	}
+	flags := b[7] >> 6
+	if flags&0x02 != 0 && headerLength >= 5 {
+		pes.pts = parseTimestamp(b[9:14])
+		pes.dts = pes.pts
+	}
+	if flags == 0x03 && headerLength >= 10 {
+		pes.dts = parseTimestamp(b[14:19])
+	}
+	pes.data = b[9+headerLength:]
+	if l := int(b[4])<<8 | int(b[5]); l > 0 && 6+l <= len(b) && 6+l >= 9+headerLength {
+		pes.data = b[9+headerLength : 6+l]
+	}
+	return d.onPES(pes)
+}
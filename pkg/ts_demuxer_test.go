@@ -0,0 +1,177 @@
+package hls_downloader
+
+import (
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+const (
+	testVideoPID = 0x100
+	testAudioPID = 0x101
+	// testMetadataPID is the ID3 timed metadata.
+	testMetadataPID = 0x102
+	testPMTPID      = 0x1000
+)
+
+// testTSMuxer writes PAT, PMT and PES packets for tests.
+type testTSMuxer struct {
+	streams map[int]byte
+	cc      map[int]int
+	out     []byte
+	// sps is the SPS of the segments. nil is 320x240.
+	sps []byte
+}
+
+func newTestTSMuxer(streams map[int]byte) *testTSMuxer {
+	return &testTSMuxer{streams: streams, cc: map[int]int{}}
+}
+
+func (m *testTSMuxer) packets(pid int, payload []byte, pcr int64) {
+	first := true
+	for first || len(payload) > 0 {
+		p := make([]byte, tsPacketSize)
+		p[0] = tsSyncByte
+		p[1] = byte(pid >> 8)
+		p[2] = byte(pid)
+		if first {
+			p[1] |= 0x40
+		}
+		p[3] = 0x10 | byte(m.cc[pid]&0x0f)
+		m.cc[pid]++
+		var af []byte
+		if first && pcr >= 0 {
+			base := pcr / 300
+			af = []byte{0x50, byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1), byte(base<<7) | 0x7e, 0}
+		}
+		room := tsPacketSize - 4
+		if af != nil {
+			room -= 1 + len(af)
+		}
+		if stuffing := room - len(payload); stuffing > 0 {
+			if af == nil {
+				// the adaptation field for stuffing
+				af = []byte{}
+				if stuffing > 1 {
+					af = append(af, 0x00)
+				}
+				stuffing -= 1 + len(af)
+			}
+			for ; stuffing > 0; stuffing-- {
+				af = append(af, 0xff)
+			}
+		}
+		i := 4
+		if af != nil {
+			p[3] |= 0x20
+			p[4] = byte(len(af))
+			copy(p[5:], af)
+			i = 5 + len(af)
+		}
+		n := copy(p[i:], payload)
+		payload = payload[n:]
+		m.out = append(m.out, p...)
+		first = false
+	}
+}
+
+func (m *testTSMuxer) psi(pid int, tableID byte, body []byte) {
+	l := 5 + len(body) + 4
+	section := []byte{tableID, 0xb0 | byte(l>>8), byte(l), 0, 1, 0xc1, 0, 0}
+	section = append(section, body...)
+	// CRC_32 is not verified
+	section = append(section, 0, 0, 0, 0)
+	m.packets(pid, append([]byte{0}, section...), -1)
+}
+
+// tables writes PAT and PMT.
+func (m *testTSMuxer) tables() {
+	pmt, pcr := testPMTPID, testVideoPID
+	m.psi(patPID, 0x00, []byte{0, 1, 0xe0 | byte(pmt>>8), byte(pmt)})
+	body := []byte{0xe0 | byte(pcr>>8), byte(pcr), 0xf0, 0}
+	for _, pid := range []int{testVideoPID, testAudioPID, testMetadataPID} {
+		if typ, ok := m.streams[pid]; ok {
+			body = append(body, typ, 0xe0|byte(pid>>8), byte(pid), 0xf0, 0)
+		}
+	}
+	m.psi(pmt, 0x02, body)
+}
+
+func testTimestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0e | 1,
+		byte(ts >> 22),
+		byte(ts>>14) | 1,
+		byte(ts >> 7),
+		byte(ts<<1) | 1,
+	}
+}
+
+// pes writes a PES packet. dts is omitted if it equals to pts.
+func (m *testTSMuxer) pes(pid int, pts, dts int64, data []byte) {
+	streamID := byte(0xe0)
+	if m.streams[pid] == streamTypeAAC {
+		streamID = 0xc0
+	}
+	header := testTimestamp(2, pts)
+	flags := byte(0x80)
+	if dts != pts {
+		header = append(testTimestamp(3, pts), testTimestamp(1, dts)...)
+		flags = 0xc0
+	}
+	b := []byte{0, 0, 1, streamID, 0, 0, 0x80, flags, byte(len(header))}
+	b = append(b, header...)
+	b = append(b, data...)
+	if l := len(b) - 6; l < 0x10000 && streamID != 0xe0 {
+		b[4], b[5] = byte(l>>8), byte(l)
+	}
+	pcr := int64(-1)
+	if pid == testVideoPID {
+		pcr = dts * 300
+	}
+	m.packets(pid, b, pcr)
+}
+
+func TestTSDemuxer(t *testing.T) {
+	m := newTestTSMuxer(map[int]byte{testVideoPID: streamTypeH264, testAudioPID: streamTypeAAC})
+	m.tables()
+	video := make([]byte, 500)
+	for i := range video {
+		video[i] = byte(i)
+	}
+	m.pes(testVideoPID, 9000+3003, 9000, video)
+	m.pes(testAudioPID, 1<<33-1, 1<<33-1, []byte("audio"))
+	m.pes(testVideoPID, 12003, 12003, []byte("video"))
+
+	var got []*pesPacket
+	var pcrs []int64
+	d := newTSDemuxer(func(p *pesPacket) error {
+		got = append(got, p)
+		return nil
+	})
+	d.onPacket = func(p *tsPacket) {
+		if p.pcr >= 0 {
+			pcrs = append(pcrs, p.pcr)
+		}
+	}
+	assert.Nil(t, d.feed(m.out))
+	assert.Nil(t, d.flush())
+
+	assert.Equal(t, d.pmtPID, testPMTPID)
+	assert.Equal(t, d.pcrPID, testVideoPID)
+	assert.Equal(t, len(d.streams), 2)
+	assert.Equal(t, d.streams[testAudioPID].streamType, byte(streamTypeAAC))
+	assert.Equal(t, len(got), 3)
+	assert.Equal(t, got[0].pid, testVideoPID)
+	assert.Equal(t, got[0].pts, int64(12003))
+	assert.Equal(t, got[0].dts, int64(9000))
+	assert.Equal(t, got[0].data, video)
+	// the pending PES packets are flushed in order of PID
+	assert.Equal(t, got[1].dts, int64(12003))
+	assert.Equal(t, got[2].pts, int64(1<<33-1))
+	assert.Equal(t, got[2].data, []byte("audio"))
+	assert.Equal(t, pcrs, []int64{9000 * 300, 12003 * 300})
+
+	err := d.feed(m.out[:100])
+	assert.True(t, err != nil)
+}
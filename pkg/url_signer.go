@@ -0,0 +1,218 @@
+package hls_downloader
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultSignTTL is the lifetime of a signature. A URL is signed again before each request,
+// so a short lifetime is enough.
+const DefaultSignTTL = 5 * time.Minute
+
+func signTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultSignTTL
+	}
+	return ttl
+}
+
+// HMACSignerOptions signs a URL by HMAC-SHA256 of the path and the expiry in the query string.
+//
+//	signature = hex(HMAC-SHA256(Key, path + "?" + ExpiresParam + "=" + expires))
+//
+// i.g. /live/1.ts?expires=1700000000&signature=5d41...
+type HMACSignerOptions struct {
+	Key []byte
+	// TTL is the lifetime of a signature. 0 is DefaultSignTTL.
+	TTL time.Duration
+	// ExpiresParam is the query parameter of the expiry in Unix time. "" is "expires".
+	ExpiresParam string
+	// SignatureParam is the query parameter of the signature. "" is "signature".
+	SignatureParam string
+}
+
+type hmacSigner struct {
+	opt HMACSignerOptions
+	now func() time.Time
+}
+
+func NewHMACSigner(opt *HMACSignerOptions) (URLSigner, error) {
+	if len(opt.Key) == 0 {
+		return nil, xerrors.New("no key of the HMAC signer")
+	}
+	s := &hmacSigner{opt: *opt, now: time.Now}
+	if s.opt.ExpiresParam == "" {
+		s.opt.ExpiresParam = "expires"
+	}
+	if s.opt.SignatureParam == "" {
+		s.opt.SignatureParam = "signature"
+	}
+	return s, nil
+}
+
+func (s *hmacSigner) Sign(u *url.URL) error {
+	expires := strconv.FormatInt(s.now().Add(signTTL(s.opt.TTL)).Unix(), 10)
+	mac := hmac.New(sha256.New, s.opt.Key)
+	mac.Write([]byte(u.EscapedPath() + "?" + s.opt.ExpiresParam + "=" + expires))
+	q := u.Query()
+	q.Set(s.opt.ExpiresParam, expires)
+	q.Set(s.opt.SignatureParam, hex.EncodeToString(mac.Sum(nil)))
+	u.RawQuery = q.Encode()
+	return nil
+}
+
+// CloudFrontSignerOptions signs a URL by a canned policy of Amazon CloudFront.
+// see https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/private-content-creating-signed-url-canned-policy.html
+type CloudFrontSignerOptions struct {
+	// KeyPairID is the ID of the public key in CloudFront.
+	KeyPairID string
+	// PrivateKey is the RSA private key in PEM, PKCS #1 or PKCS #8.
+	PrivateKey []byte
+	// TTL is the lifetime of a signature. 0 is DefaultSignTTL.
+	TTL time.Duration
+}
+
+// cloudFrontParams are the query parameters of a signed URL of CloudFront.
+var cloudFrontParams = []string{"Expires", "Signature", "Key-Pair-Id", "Policy"}
+
+type cloudFrontSigner struct {
+	keyPairID string
+	key       *rsa.PrivateKey
+	ttl       time.Duration
+	now       func() time.Time
+}
+
+func NewCloudFrontSigner(opt *CloudFrontSignerOptions) (URLSigner, error) {
+	if opt.KeyPairID == "" {
+		return nil, xerrors.New("no key pair id of the CloudFront signer")
+	}
+	key, err := parseRSAPrivateKey(opt.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudFrontSigner{keyPairID: opt.KeyPairID, key: key, ttl: signTTL(opt.TTL), now: time.Now}, nil
+}
+
+func parseRSAPrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, xerrors.New("no PEM block of the private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, xerrors.Errorf("x509.ParsePKCS8PrivateKey failed: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, xerrors.Errorf("not a RSA private key: %T", key)
+	}
+	return rsaKey, nil
+}
+
+func (s *cloudFrontSigner) Sign(u *url.URL) error {
+	q := u.Query()
+	for _, p := range cloudFrontParams {
+		q.Del(p)
+	}
+	u.RawQuery = q.Encode()
+	expires := s.now().Add(s.ttl).Unix()
+	// the resource is the URL without the parameters of the signature
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, u.String(), expires)
+	sum := sha1.Sum([]byte(policy))
+	sig, err := rsa.SignPKCS1v15(nil, s.key, crypto.SHA1, sum[:])
+	if err != nil {
+		return xerrors.Errorf("rsa.SignPKCS1v15 failed: %w", err)
+	}
+	// the parameters of the signature are at the end of the query string
+	params := fmt.Sprintf("Expires=%d&Signature=%s&Key-Pair-Id=%s", expires, cloudFrontBase64(sig), url.QueryEscape(s.keyPairID))
+	if u.RawQuery != "" {
+		params = u.RawQuery + "&" + params
+	}
+	u.RawQuery = params
+	return nil
+}
+
+// cloudFrontBase64 is base64 whose invalid characters in a query string are replaced. + -> -, = -> _, / -> ~
+func cloudFrontBase64(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
+
+// DefaultAkamaiTokenName is the query parameter of the token of Akamai EdgeAuth.
+const DefaultAkamaiTokenName = "__token__"
+
+// AkamaiSignerOptions signs a URL by a token of Akamai EdgeAuth (Token Authentication 2.0).
+//
+//	token = "st=<start>~exp=<expires>~acl=<ACL>~hmac=" + hex(HMAC-SHA256(Key, "st=<start>~exp=<expires>~acl=<ACL>"))
+//
+// Without ACL, the token is for the path of each URL, which is signed but not included in the token.
+type AkamaiSignerOptions struct {
+	// Key is the encryption key in hex digits.
+	Key string
+	// ACL is the paths which the token is valid for. i.g. /live/*
+	// Multiple paths are delimited by "!".
+	ACL string
+	// TTL is the lifetime of a token. 0 is DefaultSignTTL.
+	TTL time.Duration
+	// TokenName is the query parameter of the token. "" is DefaultAkamaiTokenName.
+	TokenName string
+}
+
+type akamaiSigner struct {
+	key       []byte
+	acl       string
+	ttl       time.Duration
+	tokenName string
+	now       func() time.Time
+}
+
+func NewAkamaiSigner(opt *AkamaiSignerOptions) (URLSigner, error) {
+	key, err := hex.DecodeString(opt.Key)
+	if err != nil || len(key) == 0 {
+		return nil, xerrors.New("the key of the Akamai signer must be hex digits")
+	}
+	s := &akamaiSigner{key: key, acl: opt.ACL, ttl: signTTL(opt.TTL), tokenName: opt.TokenName, now: time.Now}
+	if s.tokenName == "" {
+		s.tokenName = DefaultAkamaiTokenName
+	}
+	return s, nil
+}
+
+func (s *akamaiSigner) Sign(u *url.URL) error {
+	now := s.now()
+	token := fmt.Sprintf("st=%d~exp=%d", now.Unix(), now.Add(s.ttl).Unix())
+	if s.acl != "" {
+		token += "~acl=" + s.acl
+	}
+	source := token
+	if s.acl == "" {
+		source += "~url=" + u.EscapedPath()
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(source))
+	// the edge servers take the token as is, so it is not escaped. i.g. __token__=st=1~exp=2~acl=/live/*~hmac=...
+	q := u.Query()
+	q.Del(s.tokenName)
+	params := s.tokenName + "=" + token + "~hmac=" + hex.EncodeToString(mac.Sum(nil))
+	if len(q) > 0 {
+		params = q.Encode() + "&" + params
+	}
+	u.RawQuery = params
+	return nil
+}
@@ -0,0 +1,136 @@
+package hls_downloader
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func testHMAC(key []byte, message string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHMACSigner(t *testing.T) {
+	_, err := NewHMACSigner(&HMACSignerOptions{})
+	assert.NotNil(t, err)
+
+	signer, err := NewHMACSigner(&HMACSignerOptions{Key: []byte("secret")})
+	assert.Nil(t, err)
+	signer.(*hmacSigner).now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	u, _ := url.Parse("http://example.com/live/1.ts?a=1&expires=1&signature=old")
+	assert.Nil(t, signer.Sign(u))
+	q := u.Query()
+	assert.Equal(t, q.Get("a"), "1")
+	assert.Equal(t, q["expires"], []string{"1700000300"})
+	assert.Equal(t, q["signature"], []string{testHMAC([]byte("secret"), "/live/1.ts?expires=1700000300")})
+
+	signer, err = NewHMACSigner(&HMACSignerOptions{Key: []byte("secret"), TTL: time.Minute, ExpiresParam: "e", SignatureParam: "s"})
+	assert.Nil(t, err)
+	signer.(*hmacSigner).now = func() time.Time { return time.Unix(1700000000, 0) }
+	u, _ = url.Parse("http://example.com/live/1.ts")
+	assert.Nil(t, signer.Sign(u))
+	assert.Equal(t, u.RawQuery, "e=1700000060&s="+testHMAC([]byte("secret"), "/live/1.ts?e=1700000060"))
+}
+
+func TestCloudFrontSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	_, err = NewCloudFrontSigner(&CloudFrontSignerOptions{PrivateKey: pkcs8})
+	assert.NotNil(t, err)
+	_, err = NewCloudFrontSigner(&CloudFrontSignerOptions{KeyPairID: "K1", PrivateKey: []byte("not a key")})
+	assert.NotNil(t, err)
+
+	for _, pemKey := range [][]byte{pkcs8, pkcs1} {
+		signer, err := NewCloudFrontSigner(&CloudFrontSignerOptions{KeyPairID: "K1", PrivateKey: pemKey})
+		assert.Nil(t, err)
+		signer.(*cloudFrontSigner).now = func() time.Time { return time.Unix(1700000000, 0) }
+
+		u, _ := url.Parse("https://d111111abcdef8.cloudfront.net/live/1.ts?a=1&Expires=1&Signature=old&Key-Pair-Id=K0")
+		assert.Nil(t, signer.Sign(u))
+		assert.True(t, strings.HasPrefix(u.RawQuery, "a=1&Expires=1700000300&Signature="), u.RawQuery)
+		assert.True(t, strings.HasSuffix(u.RawQuery, "&Key-Pair-Id=K1"), u.RawQuery)
+
+		policy := `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/live/1.ts?a=1","Condition":{"DateLessThan":{"AWS:EpochTime":1700000300}}}]}`
+		sig := strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(u.Query().Get("Signature"))
+		b, err := base64.StdEncoding.DecodeString(sig)
+		assert.Nil(t, err)
+		sum := sha1.Sum([]byte(policy))
+		assert.Nil(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, sum[:], b))
+	}
+}
+
+func TestAkamaiSigner(t *testing.T) {
+	_, err := NewAkamaiSigner(&AkamaiSignerOptions{Key: "not hex"})
+	assert.NotNil(t, err)
+
+	key := "0123456789abcdef"
+	rawKey, _ := hex.DecodeString(key)
+	signer, err := NewAkamaiSigner(&AkamaiSignerOptions{Key: key, ACL: "/live/*"})
+	assert.Nil(t, err)
+	signer.(*akamaiSigner).now = func() time.Time { return time.Unix(1700000000, 0) }
+	u, _ := url.Parse("https://example.akamaized.net/live/1.ts?a=1&__token__=old")
+	assert.Nil(t, signer.Sign(u))
+	token := "st=1700000000~exp=1700000300~acl=/live/*"
+	assert.Equal(t, u.RawQuery, "a=1&__token__="+token+"~hmac="+testHMAC(rawKey, token))
+
+	signer, err = NewAkamaiSigner(&AkamaiSignerOptions{Key: key, TTL: time.Minute, TokenName: "hdnts"})
+	assert.Nil(t, err)
+	signer.(*akamaiSigner).now = func() time.Time { return time.Unix(1700000000, 0) }
+	u, _ = url.Parse("https://example.akamaized.net/live/1.ts")
+	assert.Nil(t, signer.Sign(u))
+	token = "st=1700000000~exp=1700000060"
+	assert.Equal(t, u.RawQuery, "hdnts="+token+"~hmac="+testHMAC(rawKey, token+"~url=/live/1.ts"))
+}
+
+func TestClientSignedURL(t *testing.T) {
+	var queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		q := r.URL.Query()
+		if q.Get("signature") != testHMAC([]byte("secret"), r.URL.Path+"?expires="+q.Get("expires")) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	signer, err := NewHMACSigner(&HMACSignerOptions{Key: []byte("secret")})
+	assert.Nil(t, err)
+	now := time.Unix(1700000000, 0)
+	signer.(*hmacSigner).now = func() time.Time { return now }
+	cli := (&Config{Auth: &SignedURLAuth{Signer: signer}}).newClient(http.DefaultTransport, nil, 0)
+
+	// the URL is signed again before each request
+	for i := 0; i < 2; i++ {
+		resp, err := cli.get(ts.URL + "/live/1.ts")
+		assert.Nil(t, err)
+		_ = resp.Body.Close()
+		now = now.Add(time.Hour)
+	}
+	assert.Equal(t, len(queries), 2)
+	assert.Contains(t, queries[0], fmt.Sprintf("expires=%d", 1700000300))
+	assert.Contains(t, queries[1], fmt.Sprintf("expires=%d", 1700003900))
+}
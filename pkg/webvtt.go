@@ -0,0 +1,203 @@
+package hls_downloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var ErrInvalidWebVTT = xerrors.New("invalid WebVTT")
+
+// webvttTimestampMap is X-TIMESTAMP-MAP. see RFC8216 3.5
+// The cue time LOCAL is the MPEG-2 time MPEGTS.
+type webvttTimestampMap struct {
+	mpegts int64
+	local  time.Duration
+}
+
+type webvttCue struct {
+	id       string
+	start    time.Duration
+	end      time.Duration
+	settings string
+	text     string
+}
+
+// webvttFile is a WebVTT segment. see https://www.w3.org/TR/webvtt1/
+type webvttFile struct {
+	timestampMap *webvttTimestampMap
+	// blocks are STYLE and REGION blocks.
+	blocks []string
+	cues   []*webvttCue
+}
+
+// webvttBlockRegexp matches the blank lines between blocks.
+var webvttBlockRegexp = regexp.MustCompile(`\n{2,}`)
+
+// parseWebVTT parses a WebVTT file. NOTE blocks are ignored.
+func parseWebVTT(b []byte) (*webvttFile, error) {
+	s := strings.ReplaceAll(strings.ReplaceAll(string(b), "\r\n", "\n"), "\r", "\n")
+	s = strings.TrimPrefix(s, "\ufeff")
+	if !strings.HasPrefix(s, "WEBVTT") || (len(s) > 6 && s[6] != ' ' && s[6] != '\t' && s[6] != '\n') {
+		return nil, xerrors.Errorf("WEBVTT is not found: %w", ErrInvalidWebVTT)
+	}
+	f := &webvttFile{}
+	blocks := webvttBlockRegexp.Split(strings.TrimRight(s, "\n"), -1)
+	for _, line := range strings.Split(blocks[0], "\n")[1:] {
+		if strings.HasPrefix(line, "X-TIMESTAMP-MAP=") {
+			m, err := parseWebVTTTimestampMap(strings.TrimPrefix(line, "X-TIMESTAMP-MAP="))
+			if err != nil {
+				return nil, err
+			}
+			f.timestampMap = m
+		}
+	}
+	for _, block := range blocks[1:] {
+		lines := strings.Split(block, "\n")
+		switch {
+		case strings.HasPrefix(lines[0], "NOTE"):
+			continue
+		case lines[0] == "STYLE" || lines[0] == "REGION":
+			f.blocks = append(f.blocks, block)
+			continue
+		}
+		cue := &webvttCue{}
+		if !strings.Contains(lines[0], "-->") {
+			cue.id, lines = lines[0], lines[1:]
+		}
+		if len(lines) == 0 || !strings.Contains(lines[0], "-->") {
+			// not a cue
+			continue
+		}
+		timing := strings.SplitN(lines[0], "-->", 2)
+		var err error
+		if cue.start, err = parseWebVTTTimestamp(strings.TrimSpace(timing[0])); err != nil {
+			return nil, err
+		}
+		end := strings.Fields(timing[1])
+		if len(end) == 0 {
+			return nil, xerrors.Errorf("end time is not found, %q: %w", lines[0], ErrInvalidWebVTT)
+		}
+		if cue.end, err = parseWebVTTTimestamp(end[0]); err != nil {
+			return nil, err
+		}
+		cue.settings = strings.Join(end[1:], " ")
+		cue.text = strings.Join(lines[1:], "\n")
+		f.cues = append(f.cues, cue)
+	}
+	return f, nil
+}
+
+// parseWebVTTTimestampMap parses the value of X-TIMESTAMP-MAP. i.g. MPEGTS:900000,LOCAL:00:00:00.000
+func parseWebVTTTimestampMap(s string) (*webvttTimestampMap, error) {
+	m := &webvttTimestampMap{}
+	for _, kv := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(kv), ":", 2)
+		if len(kv) != 2 {
+			return nil, xerrors.Errorf("X-TIMESTAMP-MAP %q: %w", s, ErrInvalidWebVTT)
+		}
+		var err error
+		switch kv[0] {
+		case "MPEGTS":
+			if m.mpegts, err = strconv.ParseInt(kv[1], 10, 64); err != nil {
+				return nil, xerrors.Errorf("MPEGTS %q: %w", kv[1], ErrInvalidWebVTT)
+			}
+		case "LOCAL":
+			if m.local, err = parseWebVTTTimestamp(kv[1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+var webvttTimestampRegexp = regexp.MustCompile(`^(?:(\d{2,}):)?([0-5]\d):([0-5]\d)\.(\d{3})$`)
+
+// parseWebVTTTimestamp parses a timestamp. i.g. 01:02:03.456, 02:03.456
+func parseWebVTTTimestamp(s string) (time.Duration, error) {
+	m := webvttTimestampRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, xerrors.Errorf("timestamp %q: %w", s, ErrInvalidWebVTT)
+	}
+	var n [4]int64
+	for i, v := range m[1:] {
+		if v != "" {
+			n[i], _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return time.Duration(n[0])*time.Hour + time.Duration(n[1])*time.Minute + time.Duration(n[2])*time.Second + time.Duration(n[3])*time.Millisecond, nil
+}
+
+// formatWebVTTTimestamp formats a timestamp with the separator of milliseconds. i.g. 01:02:03.456
+// SRT uses a comma as the separator.
+func formatWebVTTTimestamp(d time.Duration, sep string) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+// writeWebVTT writes the blocks and the cues as a WebVTT file.
+func writeWebVTT(w io.Writer, blocks []string, cues []*webvttCue) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "WEBVTT\n")
+	for _, b := range blocks {
+		fmt.Fprintf(bw, "\n%s\n", b)
+	}
+	for _, c := range cues {
+		fmt.Fprint(bw, "\n")
+		if c.id != "" {
+			fmt.Fprintf(bw, "%s\n", c.id)
+		}
+		fmt.Fprintf(bw, "%s --> %s", formatWebVTTTimestamp(c.start, "."), formatWebVTTTimestamp(c.end, "."))
+		if c.settings != "" {
+			fmt.Fprintf(bw, " %s", c.settings)
+		}
+		fmt.Fprintf(bw, "\n%s\n", c.text)
+	}
+	if err := bw.Flush(); err != nil {
+		return xerrors.Errorf("Flush failed: %w", err)
+	}
+	return nil
+}
+
+var (
+	// webvttTagRegexp matches the tags. i.g. <v Bob>, </c>, <b.loud>, <00:00:01.000>
+	webvttTagRegexp      = regexp.MustCompile(`<(/?)([^>.\s]*)[^>]*>`)
+	webvttEntityReplacer = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&nbsp;", " ", "&lrm;", "", "&rlm;", "", "&amp;", "&")
+)
+
+// srtText removes the tags except <b>, <i> and <u> which SRT also supports, and unescapes the entities.
+func srtText(s string) string {
+	s = webvttTagRegexp.ReplaceAllStringFunc(s, func(tag string) string {
+		m := webvttTagRegexp.FindStringSubmatch(tag)
+		switch m[2] {
+		case "b", "i", "u":
+			return "<" + m[1] + m[2] + ">"
+		}
+		return ""
+	})
+	return webvttEntityReplacer.Replace(s)
+}
+
+// writeSRT writes the cues as a SubRip file. The cue settings are removed.
+func writeSRT(w io.Writer, cues []*webvttCue) error {
+	bw := bufio.NewWriter(w)
+	for i, c := range cues {
+		if i > 0 {
+			fmt.Fprint(bw, "\n")
+		}
+		fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n", i+1, formatWebVTTTimestamp(c.start, ","), formatWebVTTTimestamp(c.end, ","), srtText(c.text))
+	}
+	if err := bw.Flush(); err != nil {
+		return xerrors.Errorf("Flush failed: %w", err)
+	}
+	return nil
+}